@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pgm/goconseq/run"
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkCmd = &cobra.Command{
+		Use:   "check conseqfile",
+		Short: "Check a conseq file for problems without running anything",
+		Long: `Parses the file and reports problems which would otherwise only be found while running: invalid templates,
+references to undefined variables, inputs or executors, inputs which no rule produces, dependency cycles
+and outputs which nothing uses. Exits with a non-zero status if any errors were found.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			log.SetOutput(ioutil.Discard)
+
+			overrides, err := parseConfigOverrides()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			problems, err := run.CheckRulesInFile(args[0], overrides)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			errorCount := 0
+			for _, problem := range problems {
+				fmt.Println(problem.String())
+				if problem.Severity == run.SeverityError {
+					errorCount++
+				}
+			}
+			fmt.Printf("%d errors, %d warnings\n", errorCount, len(problems)-errorCount)
+			if errorCount > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
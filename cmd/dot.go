@@ -1,56 +1,129 @@
 package cmd
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
 
+	"github.com/pgm/goconseq/graph"
 	"github.com/pgm/goconseq/run"
 
 	"github.com/spf13/cobra"
 )
 
+var dotOutput string
+var dotFormat string
+var dotInstances bool
+var dotRule string
+var dotArtifactFilters []string
+var dotDepth int
+
+// focusDiagram restricts the diagram to the neighborhood of the rules and artifacts selected by the flags
+func focusDiagram(d *graph.Diagram) (*graph.Diagram, error) {
+	if dotRule == "" && len(dotArtifactFilters) == 0 {
+		return d, nil
+	}
+
+	ids := make([]string, 0)
+	if dotRule != "" {
+		ids = append(ids, d.FindNodes(graph.RuleNode, func(node *graph.DiagramNode) bool {
+			return node.Properties["name"] == dotRule
+		})...)
+	}
+	if len(dotArtifactFilters) > 0 {
+		query, predicates, err := graph.ParseFilters(dotArtifactFilters)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, d.FindNodes(graph.ArtifactNode, func(node *graph.DiagramNode) bool {
+			for k, v := range query {
+				if node.Properties[k] != v {
+					return false
+				}
+			}
+			for k, predicate := range predicates {
+				value, present := node.Properties[k]
+				if !predicate.Matches(value, present) {
+					return false
+				}
+			}
+			return true
+		})...)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No rules or artifacts matched the given filters")
+	}
+
+	return d.Neighborhood(ids, dotDepth), nil
+}
+
+func writeDiagram(d *graph.Diagram, format string, out io.Writer) error {
+	switch format {
+	case "dot":
+		d.WriteDot(out)
+	case "mermaid":
+		d.WriteMermaid(out)
+	case "json":
+		return d.WriteJSON(out)
+	default:
+		return fmt.Errorf("Unknown format \"%s\" (expected dot, mermaid or json)", format)
+	}
+	return nil
+}
+
 var (
 	dotCmd = &cobra.Command{
-		Use:   "dot",
-		Short: "export dot graph",
+		Use:   "dot conseqfile",
+		Short: "Write the graph of rules (or applied rules and artifacts) as dot, mermaid or json",
+		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			graph, db, err := run.ReplayAndExport(stateDir, args[0])
+			log.SetOutput(ioutil.Discard)
+
+			overrides, err := parseConfigOverrides()
 			if err != nil {
-				log.Fatalf("%s", err)
+				fmt.Println(err)
+				os.Exit(1)
 			}
-			db.Close()
 
-			dirName, err := ioutil.TempDir("", "dot")
+			ruleGraph, db, err := run.ReplayAndExport(stateDir, args[0], overrides)
 			if err != nil {
-				panic(err)
+				fmt.Println(err)
+				os.Exit(1)
 			}
 
-			if graph == nil {
-				panic("nil graph")
+			var diagram *graph.Diagram
+			if dotInstances {
+				diagram = db.InstanceDiagram()
+			} else {
+				diagram = ruleGraph.Diagram()
 			}
+			db.Close()
 
-			dotFile := path.Join(dirName, "t.dot")
-			pngName := path.Join(dirName, "dot.png")
-			f, err := os.Create(dotFile)
+			diagram, err = focusDiagram(diagram)
 			if err != nil {
-				panic(err)
+				fmt.Println(err)
+				os.Exit(1)
 			}
 
-			graph.PrintGraph(f)
-			f.Close()
-
-			log.Printf("args %s %s %s %s", dotFile, "-Tpng", "-o", pngName)
-			err = exec.Command("dot", dotFile, "-Tpng", "-o", pngName).Run()
-			if err != nil {
-				panic(err)
+			var out io.Writer
+			if dotOutput == "" {
+				out = os.Stdout
+			} else {
+				f, err := os.Create(dotOutput)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				out = f
 			}
 
-			err = exec.Command("open", pngName).Run()
+			err = writeDiagram(diagram, dotFormat, out)
 			if err != nil {
-				panic(err)
+				fmt.Println(err)
+				os.Exit(1)
 			}
 		},
 	}
@@ -58,4 +131,10 @@ var (
 
 func init() {
 	rootCmd.AddCommand(dotCmd)
+	dotCmd.Flags().StringVarP(&dotOutput, "output", "o", "", "If set, the file to write the graph to instead of stdout")
+	dotCmd.Flags().StringVarP(&dotFormat, "format", "t", "dot", "The format to write the graph in: dot, mermaid or json")
+	dotCmd.Flags().BoolVarP(&dotInstances, "instances", "i", false, "Show the applied rules and artifacts recorded in the state directory instead of the rules")
+	dotCmd.Flags().StringVar(&dotRule, "rule", "", "Only show the neighborhood of the rule with this name")
+	dotCmd.Flags().StringArrayVar(&dotArtifactFilters, "artifact", nil, "Only show the neighborhood of artifacts matching this filter (ie: type=x). May be repeated to add more conditions")
+	dotCmd.Flags().IntVar(&dotDepth, "depth", 2, "When filtering, the number of edges to follow away from the matching nodes (0 for no limit)")
 }
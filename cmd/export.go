@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/run"
+	"github.com/spf13/cobra"
+)
+
+var exportOutput string
+var exportBundleDir string
+var exportCopyFiles bool
+
+var (
+	exportCmd = &cobra.Command{
+		Use:   "export conseqfile [filter1] [filter2] ... ",
+		Short: "Export the provenance of the matching artifacts as a W3C PROV-JSON document",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			log.SetOutput(ioutil.Discard)
+
+			if exportCopyFiles && exportBundleDir == "" {
+				fmt.Println("--copy-files requires --bundle")
+				os.Exit(1)
+			}
+			if exportOutput != "" && exportBundleDir != "" {
+				fmt.Println("--output can't be used with --bundle, which always writes prov.json within the bundle")
+				os.Exit(1)
+			}
+
+			conseqFile := args[0]
+			query, predicates, err := graph.ParseFilters(args[1:])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			overrides, err := parseConfigOverrides()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			_, db, err := run.ReplayAndExport(stateDir, conseqFile, overrides)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer db.Close()
+
+			artifacts := db.FindArtifactsMatching(query, predicates)
+			sort.Slice(artifacts, func(i, j int) bool {
+				return artifacts[i].GetID() < artifacts[j].GetID()
+			})
+
+			exporter := db.NewProvExporter()
+			exporter.BundleDir = exportBundleDir
+			exporter.CopyFiles = exportCopyFiles
+			for _, artifact := range artifacts {
+				_, err = exporter.Add(artifact)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+
+			var out io.Writer
+			if exportBundleDir != "" {
+				err = os.MkdirAll(exportBundleDir, os.ModePerm)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				exportOutput = path.Join(exportBundleDir, "prov.json")
+			}
+			if exportOutput == "" {
+				out = os.Stdout
+			} else {
+				f, err := os.Create(exportOutput)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				out = f
+			}
+
+			err = exporter.Write(out)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "If set, the file to write the PROV-JSON document to")
+	exportCmd.Flags().StringVar(&exportBundleDir, "bundle", "", "If set, write a bundle to this directory containing prov.json and the run scripts of each applied rule")
+	exportCmd.Flags().BoolVar(&exportCopyFiles, "copy-files", false, "Also copy the files referenced by the artifacts into the bundle")
+}
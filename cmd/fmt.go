@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pgm/goconseq/parser"
+	"github.com/spf13/cobra"
+)
+
+var fmtCheck bool
+
+// formatFile rewrites the file in canonical form, or with check only reports whether it would change. Returns
+// true if the file was not already formatted.
+func formatFile(filename string, check bool) (bool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	formatted, err := parser.Format(string(content), filename)
+	if err != nil {
+		return false, err
+	}
+	if formatted == string(content) {
+		return false, nil
+	}
+	if check {
+		return true, nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(filename, []byte(formatted), info.Mode())
+}
+
+var fmtCmd = &cobra.Command{
+	Use:   "fmt conseqfile...",
+	Short: "Rewrite conseq files in a canonical layout",
+	Long: `Rewrites each file with consistent indentation and spacing, keeping comments. Included files are not
+formatted unless they are also listed. With --check, nothing is written and the names of files which are not
+formatted are printed instead, exiting with a non-zero status if there are any.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		for _, filename := range args {
+			changed, err := formatFile(filename, fmtCheck)
+			if err != nil {
+				fmt.Println(err)
+				failed = true
+				continue
+			}
+			if changed && fmtCheck {
+				fmt.Println(filename)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fmtCmd)
+	fmtCmd.Flags().BoolVar(&fmtCheck, "check", false, "Only list the files which are not formatted instead of rewriting them")
+}
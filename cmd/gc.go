@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/pgm/goconseq/adhoc"
+	"github.com/pgm/goconseq/persist"
+	"github.com/spf13/cobra"
+)
+
+var gcDryRun bool
+var gcKeepFailedLogs bool
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func printGCPlan(plan *persist.GCPlan) {
+	usage := make([]adhoc.KVPairs, len(plan.Usage))
+	for i, u := range plan.Usage {
+		usage[i] = adhoc.KVPairs{"rule": u.Name,
+			"applications": strconv.Itoa(u.Applications),
+			"size":         formatBytes(u.Bytes)}
+	}
+	if len(usage) > 0 {
+		fmt.Printf("Disk usage by rule:\n")
+		adhoc.PrintTable(os.Stdout, usage, []string{"rule", "applications", "size"}, "  ")
+		fmt.Printf("\n")
+	}
+
+	fmt.Printf("%d orphaned work directories (%s):\n", len(plan.OrphanedWorkDirs)+len(plan.FailedWorkDirs), formatBytes(plan.OrphanedBytes))
+	for _, workDir := range plan.OrphanedWorkDirs {
+		fmt.Printf("  %s\n", workDir)
+	}
+	for _, workDir := range plan.FailedWorkDirs {
+		fmt.Printf("  %s (keeping logs)\n", workDir)
+	}
+
+	if len(plan.RetainedWorkDirs) > 0 {
+		fmt.Printf("%d orphaned work directories kept because they contain files which are still referenced or the logs of a failed application:\n", len(plan.RetainedWorkDirs))
+		for _, workDir := range plan.RetainedWorkDirs {
+			fmt.Printf("  %s\n", workDir)
+		}
+	}
+
+	fmt.Printf("%d unreferenced files:\n", len(plan.UnreferencedFiles))
+	for _, file := range plan.UnreferencedFiles {
+		fmt.Printf("  %s\n", file.LocalPath)
+	}
+}
+
+var (
+	gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove work directories and files which are no longer referenced by any artifact",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			log.SetOutput(ioutil.Discard)
+
+			db := persist.NewDB(stateDir)
+			defer db.Close()
+
+			plan, err := db.PlanGC(gcKeepFailedLogs)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			printGCPlan(plan)
+
+			if gcDryRun {
+				fmt.Printf("Dry run: nothing was removed\n")
+				return
+			}
+
+			err = db.ExecuteGC(plan)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("Removed %d work directories and %d files\n", len(plan.OrphanedWorkDirs)+len(plan.FailedWorkDirs), len(plan.UnreferencedFiles))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "n", false, "Only report what would be removed")
+	gcCmd.Flags().BoolVar(&gcKeepFailedLogs, "keep-failed-logs", false, "Keep stdout.txt and stderr.txt in the work directories of failed applications")
+}
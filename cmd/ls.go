@@ -1,37 +1,23 @@
 package cmd
 
 import (
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
 	"strings"
 
 	"github.com/pgm/goconseq/adhoc"
+	"github.com/pgm/goconseq/graph"
 	"github.com/pgm/goconseq/run"
 	"github.com/spf13/cobra"
 )
 
-var filterExp = regexp.MustCompile("([^=]+)=(.*)")
 var groupBy string
 var format string
 var selectFields string
 var outputFilename string
 
-func parseQuery(filters []string) (map[string]string, error) {
-	query := make(map[string]string)
-	for _, filter := range filters {
-		parts := filterExp.FindStringSubmatch(filter)
-		if parts == nil {
-			return nil, fmt.Errorf("Could not parse \"%s\" as a filter", filter)
-		}
-		query[parts[1]] = parts[2]
-	}
-	return query, nil
-}
-
 func parseFields(fields string) []string {
 	return strings.Split(fields, ",")
 }
@@ -40,24 +26,31 @@ var (
 	lsCmd = &cobra.Command{
 		Use:   "ls conseqfile [filter1] [filter2] ... ",
 		Short: "List artifacts",
-		Args:  cobra.MinimumNArgs(1),
+		Long: `List artifacts which match all of the filters. Filters are of the form NAME=VALUE, NAME!=VALUE,
+NAME~REGEX, NAME:exists or NAME:missing.`,
+		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			log.SetOutput(ioutil.Discard)
 
 			conseqFile := args[0]
-			query, err := parseQuery(args[1:])
+			query, predicates, err := graph.ParseFilters(args[1:])
+
+			if err != nil {
+				log.Fatal(err)
+			}
 
+			overrides, err := parseConfigOverrides()
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			_, db, err := run.ReplayAndExport(stateDir, conseqFile)
+			_, db, err := run.ReplayAndExport(stateDir, conseqFile, overrides)
 			if err != nil {
 				log.Fatal(err)
 			}
 			defer db.Close()
 
-			artifacts := db.FindArtifacts(query)
+			artifacts := db.FindArtifactsMatching(query, predicates)
 
 			asKV := make([]adhoc.KVPairs, len(artifacts))
 			for i, artifacts := range artifacts {
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pgm/goconseq/lsp"
+	"github.com/spf13/cobra"
+)
+
+var lspCmd = &cobra.Command{
+	Use:   "lsp",
+	Short: "Run a language server for conseq files",
+	Long: `Runs a language server which communicates with an editor over stdin and stdout. It reports parse and
+evaluation errors, jumps to the definitions of rules and variables, shows which rules produce and consume
+an input or output on hover and completes property names from the open files and the artifacts in the
+state directory.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// stdout is used for the protocol, so nothing else can be written to it
+		log.SetOutput(ioutil.Discard)
+
+		server := lsp.NewServer(os.Stdin, os.Stdout, stateDir)
+		if err := server.Serve(); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lspCmd)
+}
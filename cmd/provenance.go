@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/persist"
+	"github.com/pgm/goconseq/run"
+	"github.com/spf13/cobra"
+)
+
+var provenanceFormat string
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatProperties(props map[string]string) string {
+	pairs := make([]string, 0, len(props))
+	for _, k := range sortedKeys(props) {
+		pairs = append(pairs, fmt.Sprintf("'%s': '%s'", k, props[k]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func printProvenance(w io.Writer, p *persist.ArtifactProvenance, indent string) {
+	fmt.Fprintf(w, "%sartifact %d %s\n", indent, p.ArtifactID, formatProperties(p.Properties))
+	if p.ProducedBy == nil {
+		fmt.Fprintf(w, "%s  (producer unknown)\n", indent)
+		return
+	}
+
+	producedBy := p.ProducedBy
+	fmt.Fprintf(w, "%s  produced by %s (applied rule %d) in %s\n", indent, producedBy.Name, producedBy.AppliedRuleID, producedBy.WorkDir)
+	fmt.Fprintf(w, "%s  rule hash: %s\n", indent, producedBy.Hash)
+
+	names := make([]string, 0, len(producedBy.Inputs))
+	for name := range producedBy.Inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s  input %s:\n", indent, name)
+		for _, input := range producedBy.Inputs[name] {
+			printProvenance(w, input, indent+"    ")
+		}
+	}
+}
+
+var (
+	provenanceCmd = &cobra.Command{
+		Use:   "provenance conseqfile [filter1] [filter2] ... ",
+		Short: "Show how the matching artifacts were produced",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			log.SetOutput(ioutil.Discard)
+
+			conseqFile := args[0]
+			query, predicates, err := graph.ParseFilters(args[1:])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			overrides, err := parseConfigOverrides()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			_, db, err := run.ReplayAndExport(stateDir, conseqFile, overrides)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer db.Close()
+
+			artifacts := db.FindArtifactsMatching(query, predicates)
+			sort.Slice(artifacts, func(i, j int) bool {
+				return artifacts[i].GetID() < artifacts[j].GetID()
+			})
+
+			provenance := make([]*persist.ArtifactProvenance, len(artifacts))
+			for i, artifact := range artifacts {
+				provenance[i] = db.GetProvenance(artifact)
+			}
+
+			if provenanceFormat == "json" {
+				b, err := json.MarshalIndent(provenance, "", "  ")
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				os.Stdout.Write(b)
+				fmt.Println()
+			} else if provenanceFormat == "text" {
+				for _, p := range provenance {
+					printProvenance(os.Stdout, p, "")
+					fmt.Println()
+				}
+			} else {
+				fmt.Printf("Invalid format: %s\n", provenanceFormat)
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(provenanceCmd)
+	provenanceCmd.Flags().StringVarP(&provenanceFormat, "format", "t", "text", "The output format (text or json)")
+}
@@ -2,15 +2,110 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"strings"
 
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
 	"github.com/pgm/goconseq/run"
+	"github.com/pgm/goconseq/serve"
 	"github.com/spf13/cobra"
 )
 
+// parseConfigOverrides parses the values of --set into a map of variable name to value
+func parseConfigOverrides() (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, pair := range configVars {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Could not parse \"%s\" as NAME=VALUE", pair)
+		}
+		overrides[parts[0]] = parts[1]
+	}
+	return overrides, nil
+}
+
+// exitWithError reports an error which prevented the command from running. Unlike log.Fatal, the message is shown
+// even when logging is disabled.
+func exitWithError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// isTerminal returns true if f is a terminal rather than a file or a pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func printObsolete(w io.Writer, obsolete *persist.ObsoleteSet) {
+	if obsolete == nil || obsolete.IsEmpty() {
+		return
+	}
+	fmt.Fprintf(w, "Warning: %d artifacts and %d rule applications are obsolete because the artifacts they were derived from are no longer defined:\n",
+		len(obsolete.Artifacts), len(obsolete.AppliedRules))
+	for _, artifact := range obsolete.Artifacts {
+		fmt.Fprintf(w, "  %s\n", artifact.String())
+	}
+	for _, appliedRule := range obsolete.AppliedRules {
+		fmt.Fprintf(w, "  r%d %s\n", appliedRule.ID, appliedRule.Name)
+	}
+}
+
+func printForced(w io.Writer, forced []*persist.AppliedRule) {
+	if len(forced) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Forced %d previous rule applications to be executed again:\n", len(forced))
+	for _, appliedRule := range forced {
+		fmt.Fprintf(w, "  r%d %s\n", appliedRule.ID, appliedRule.Name)
+	}
+}
+
+func formatInputs(inputs *persist.Bindings) string {
+	if s := inputs.String(); s != "" {
+		return s
+	}
+	return "(no inputs)"
+}
+
+func printDryRun(dryRun *run.DryRun) {
+	for _, planned := range dryRun.Rules {
+		fmt.Printf("%s: %d new, %d reused, %d invalidated\n", planned.Name, len(planned.New), len(planned.Reused), len(planned.Invalidated))
+		for _, inputs := range planned.New {
+			fmt.Printf("  new: %s\n", formatInputs(inputs))
+		}
+		for _, appliedRule := range planned.Reused {
+			fmt.Printf("  reused r%d: %s\n", appliedRule.ID, formatInputs(appliedRule.Inputs))
+		}
+		for _, appliedRule := range planned.Invalidated {
+			fmt.Printf("  invalidated r%d: %s\n", appliedRule.ID, formatInputs(appliedRule.Inputs))
+		}
+	}
+	if dryRun.Incomplete {
+		fmt.Println("Note: some new applications would have to execute before it is known what their outputs are, so the rules which consume them may have more applications than shown")
+	}
+}
+
 // runCmd represents the run command
 var (
-	stateDir string
+	stateDir     string
+	configVars   []string
+	runDryRun    bool
+	runVerbose   bool
+	runEvents    string
+	runHTTP      string
+	selection    model.RuleSelection
+	forceRules   []string
+	forceFilters []string
 
 	runCmd = &cobra.Command{
 		Use:   "run",
@@ -21,13 +116,73 @@ and usage of using your command. For example:
 Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println("run called")
-			stats, err := run.RunRulesInFile(stateDir, args[0])
+			if !runVerbose {
+				log.SetOutput(ioutil.Discard)
+			}
+			overrides, err := parseConfigOverrides()
+			if err != nil {
+				exitWithError(err)
+			}
+			force := model.ForceRerun{Rules: forceRules}
+			force.Query, force.Predicates, err = graph.ParseFilters(forceFilters)
 			if err != nil {
-				log.Fatalf("%s", err)
+				exitWithError(err)
+			}
+			if runDryRun {
+				dryRun, err := run.DryRunRulesInFile(stateDir, args[0], overrides, selection, force)
+				if err != nil {
+					exitWithError(err)
+				}
+				printDryRun(dryRun)
+				return
+			}
+
+			var observer run.Observer
+			var events *run.EventWriter
+			progressOut := os.Stdout
+			if runEvents != "" {
+				eventsOut := os.Stdout
+				if runEvents == "-" {
+					// keep stdout for the events alone
+					progressOut = os.Stderr
+				} else {
+					eventsOut, err = os.Create(runEvents)
+					if err != nil {
+						exitWithError(err)
+					}
+					defer eventsOut.Close()
+				}
+				events = run.NewEventWriter(eventsOut)
+			}
+			observer = run.NewProgress(progressOut, isTerminal(progressOut))
+			if events != nil {
+				observer = run.NewMultiObserver(observer, events)
+			}
+			if runHTTP != "" {
+				// listen before starting so that a bad address is reported before anything runs
+				listener, err := listen(runHTTP)
+				if err != nil {
+					exitWithError(err)
+				}
+				defer listener.Close()
+				state := serve.NewRunState()
+				go http.Serve(listener, serve.NewServer(stateDir, args[0], overrides, state).Handler())
+				fmt.Fprintf(progressOut, "Serving the progress of the run on http://%s/\n", listener.Addr())
+				observer = run.NewMultiObserver(observer, state)
+			}
+
+			stats, err := run.RunRulesInFile(stateDir, args[0], overrides, selection, force, observer)
+			if err != nil {
+				exitWithError(err)
+			}
+			if events != nil && events.Err() != nil {
+				exitWithError(fmt.Errorf("Could not write events: %s", events.Err()))
 			}
 			log.Printf("Executions: %d, ExistingAppliedRules: %d", stats.Executions, stats.ExistingAppliedRules)
+			printForced(progressOut, stats.Forced)
+			printObsolete(progressOut, stats.Obsolete)
 		},
 	}
 )
@@ -44,5 +199,15 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// runCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	runCmd.Flags().StringArrayVar(&selection.Targets, "target", nil, "Only run this rule and the rules it depends on. May be repeated")
+	runCmd.Flags().StringArrayVar(&selection.Until, "until", nil, "Only run the rules this rule depends on, but not the rule itself. May be repeated")
+	runCmd.Flags().StringArrayVar(&selection.Exclude, "exclude", nil, "Don't run this rule or any rule which depends on it. May be repeated")
+	runCmd.Flags().StringArrayVar(&forceRules, "force", nil, "Execute the previous applications of this rule again, along with everything downstream of them. May be repeated")
+	runCmd.Flags().StringArrayVar(&forceFilters, "force-filter", nil, "Execute the previous applications which produced an artifact matching this filter again, along with everything downstream of them. Filters are of the same form as for ls and may be repeated")
+	runCmd.Flags().BoolVarP(&runVerbose, "verbose", "v", false, "Write debug logging to stderr")
+	runCmd.Flags().StringVar(&runHTTP, "http", "", "Serve the progress of the run as a page and a JSON API on this address, such as localhost:8080, while it runs. See serve for the API")
+	runCmd.Flags().StringVar(&runEvents, "events", "", "Write an event for each step of the run as a line of JSON to this file, or to stdout if it is -")
+	runCmd.Flags().BoolVarP(&runDryRun, "dry-run", "n", false, "Only report which rule applications would be executed, reused or invalidated")
 	rootCmd.PersistentFlags().StringVarP(&stateDir, "dir", "", "state", "Directory to store working results (defaults to 'state')")
+	rootCmd.PersistentFlags().StringArrayVar(&configVars, "set", nil, "Set the variable NAME=VALUE, overriding any value from a let statement. May be repeated")
 }
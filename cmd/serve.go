@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/pgm/goconseq/serve"
+	"github.com/spf13/cobra"
+)
+
+var serveAddr string
+
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on %s: %s", addr, err)
+	}
+	return listener, nil
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve conseqfile",
+	Short: "Serve a page and a read-only JSON API describing the artifacts and rule applications",
+	Long: `Serves a page listing the artifacts and rule applications recorded in the state directory along with a
+read-only JSON API:
+
+  /api/status                   the state of the run, when started with run --http
+  /api/artifacts?filter=...     the artifacts matching all of the filters, which take the same form as for ls
+  /api/applications?rule=NAME   the recorded rule applications, optionally only those of one rule
+  /api/logs?id=N&name=stdout    the last lines of the stdout or stderr of an application
+
+To follow a run as it progresses, use run --http instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.SetOutput(ioutil.Discard)
+
+		overrides, err := parseConfigOverrides()
+		if err != nil {
+			exitWithError(err)
+		}
+		server := serve.NewServer(stateDir, args[0], overrides, nil)
+		listener, err := listen(serveAddr)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Printf("Serving on http://%s/\n", listener.Addr())
+		exitWithError(http.Serve(listener, server.Handler()))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&serveAddr, "http", "localhost:8080", "The address to listen on")
+}
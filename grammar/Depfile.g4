@@ -2,14 +2,32 @@ grammar Depfile;
 
 all_declarations: ( declaration)* EOF;
 
-declaration: var_stmt | add_if_missing | rule_declaration;
+declaration:
+	var_stmt
+	| artifact_stmt
+	| add_if_missing
+	| rule_declaration
+	| include_stmt
+	| conditional;
 
 /*
- # | rule # | include_stmt # | exec_profile # | remember_executed # | conditional # | eval_statement
+ # | exec_profile # | remember_executed # | eval_statement
  */
 
+conditional:
+	'if' condition ':' declaration* else_clause? 'endif';
+
+else_clause: 'else' ':' declaration*;
+
+condition: quoted_string (EQEQ | NOTEQ) quoted_string;
+
+include_stmt: 'include' quoted_string;
+
 rule_declaration:
-	'rule' IDENTIFIER ':' input_bindings? output? run_statement*;
+	'rule' identifier ':' input_bindings? (
+		output
+		| expected_outputs
+	)? run_statement*;
 
 run_statement: 'run' quoted_string ('with' quoted_string)?;
 
@@ -17,20 +35,65 @@ input_bindings: 'inputs' ':' binding (',' binding)*;
 
 filename_ref: 'filename' '(' quoted_string ')';
 
-binding: IDENTIFIER '=' ALL? ( artifact_template | filename_ref);
+// inputs bound with "all" can be split into one group per distinct value of a property with "by"
+binding:
+	identifier '=' (ALL | OPTIONAL | NOT)? (
+		artifact_template
+		| filename_ref
+	) (BY quoted_string)?;
 
 output: 'outputs' ':' artifact_def (',' artifact_def)*;
 
-var_stmt: LET IDENTIFIER EQUALS quoted_string;
+expected_outputs:
+	'outputs-expected' ':' expected_template (
+		',' expected_template
+	)*;
+
+expected_template:
+	'{' expected_template_pair (',' expected_template_pair)* ','? '}';
+
+// a property without a value may have any value
+expected_template_pair: quoted_string (':' quoted_string)?;
+
+var_stmt: LET identifier EQUALS quoted_string;
+
+// keywords which were added to the language can still be used as names, so that files which used them as names
+// before they were keywords continue to parse
+identifier:
+	IDENTIFIER
+	| OPTIONAL
+	| NOT
+	| BY
+	| EXISTS
+	| MISSING
+	| 'artifact'
+	| 'include'
+	| 'if'
+	| 'else'
+	| 'endif'
+	| 'outputs-expected';
 
 quoted_string: LONG_STRING | SHORT_STRING;
 
+artifact_stmt: 'artifact' artifact_def;
+
 add_if_missing: 'add-if-missing' artifact_def;
 
 artifact_template:
 	'{' artifact_template_pair (',' artifact_template_pair)* ','? '}';
 
-artifact_template_pair: quoted_string ':' quoted_string;
+artifact_template_pair: quoted_string ':' query_value;
+
+query_value:
+	quoted_string
+	| (NOTEQ | REGEX) quoted_string
+	| EXISTS
+	| MISSING;
+
+// results.json is either a list of artifacts or an object with a single "outputs" property containing the list
+results_file:
+	result_outputs EOF
+	| '{' quoted_string ':' result_outputs '}' EOF;
 
 result_outputs: '[' artifact_def (',' artifact_def)* ','? ']';
 
@@ -41,7 +104,8 @@ artifact_def_pair: quoted_string ':' artifact_def_pair_value;
 
 artifact_def_pair_value:
 	quoted_string
-	| '{' quoted_string ':' quoted_string '}';
+	| '{' quoted_string ':' quoted_string '}'
+	| filename_ref;
 
 json_value: quoted_string;
 
@@ -49,7 +113,15 @@ json_value: quoted_string;
 
 LET: 'let';
 ALL: 'all';
+OPTIONAL: 'optional';
+NOT: 'not';
+BY: 'by';
 EQUALS: '=';
+EQEQ: '==';
+NOTEQ: '!=';
+REGEX: '~';
+EXISTS: 'exists';
+MISSING: 'missing';
 
 // different flavors of strings 
 SHORT_STRING:
@@ -57,8 +129,8 @@ SHORT_STRING:
 	| '"' ( STRING_ESCAPE_SEQ | ~[\\\r\n\f"])* '"';
 
 LONG_STRING:
-	'\'\'\'' LONG_STRING_ITEM* '\'\'\''
-	| '"""' LONG_STRING_ITEM* '"""';
+	'\'\'\'' LONG_STRING_ITEM*? '\'\'\''
+	| '"""' LONG_STRING_ITEM*? '"""';
 
 fragment LONG_STRING_ITEM: LONG_STRING_CHAR | STRING_ESCAPE_SEQ;
 
@@ -1,6 +1,10 @@
 package graph
 
-import "strings"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 type stringProperty struct {
 	Name  string
@@ -9,17 +13,25 @@ type stringProperty struct {
 
 type PropertiesTemplate struct {
 	//	pairs []*propPair
-	constProps      map[stringProperty]bool
+	constProps map[stringProperty]bool
+	// properties whose values are not known until the rule runs
 	additionalProps map[string]bool
+	// constraints other than equality on properties of the artifacts being queried for
+	predicates map[string]*Predicate
 }
 
 func (pt *PropertiesTemplate) Get(name string) string {
+	value, _ := pt.lookup(name)
+	return value
+}
+
+func (pt *PropertiesTemplate) lookup(name string) (string, bool) {
 	for k, _ := range pt.constProps {
 		if k.Name == name {
-			return k.Value
+			return k.Value, true
 		}
 	}
-	return ""
+	return "", false
 }
 
 type artifact struct {
@@ -28,16 +40,21 @@ type artifact struct {
 	producedBy []*Rule
 }
 
+// String formats the properties like a query in a conseq file, sorted by name. Properties whose values aren't
+// known in advance are shown as *.
 func (pt *PropertiesTemplate) String() string {
-	sb := strings.Builder{}
+	pairs := make([]string, 0, len(pt.constProps)+len(pt.additionalProps)+len(pt.predicates))
 	for sp := range pt.constProps {
-		sb.WriteString("{")
-		sb.WriteString(sp.Name)
-		sb.WriteString(",")
-		sb.WriteString(sp.Value)
-		sb.WriteString("}")
+		pairs = append(pairs, fmt.Sprintf("'%s': '%s'", sp.Name, sp.Value))
 	}
-	return sb.String()
+	for name := range pt.additionalProps {
+		pairs = append(pairs, fmt.Sprintf("'%s': *", name))
+	}
+	for name, predicate := range pt.predicates {
+		pairs = append(pairs, fmt.Sprintf("'%s': %s", name, predicate.String()))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ", ") + "}"
 }
 
 func (a *artifact) String() string {
@@ -53,6 +70,7 @@ func (pp *PropertiesTemplate) ensureInitialized() {
 	if pp.constProps == nil {
 		pp.constProps = make(map[stringProperty]bool)
 		pp.additionalProps = make(map[string]bool)
+		pp.predicates = make(map[string]*Predicate)
 	}
 }
 
@@ -62,6 +80,12 @@ func (pp *PropertiesTemplate) AddConstantProperty(name string, value string) {
 	pp.constProps[pair] = true
 }
 
+// AddVariableProperty records that there is a property with the given name, but its value is not known in advance
+func (pp *PropertiesTemplate) AddVariableProperty(name string) {
+	pp.ensureInitialized()
+	pp.additionalProps[name] = true
+}
+
 func (pp *PropertiesTemplate) Has(name string, value string) bool {
 	if pp.constProps == nil {
 		return false
@@ -69,9 +93,35 @@ func (pp *PropertiesTemplate) Has(name string, value string) bool {
 	return pp.constProps[stringProperty{Name: name, Value: value}]
 }
 
+// AddPredicate constrains the named property with something other than an exact value
+func (pp *PropertiesTemplate) AddPredicate(name string, predicate *Predicate) {
+	pp.ensureInitialized()
+	pp.predicates[name] = predicate
+}
+
+// HasVariable returns true if the named property was added via AddVariableProperty
+func (pp *PropertiesTemplate) HasVariable(name string) bool {
+	return pp.additionalProps[name]
+}
+
+// Contains returns true if an artifact with these properties could satisfy other. Variable properties are
+// assumed to match any value.
 func (pp *PropertiesTemplate) Contains(other *PropertiesTemplate) bool {
 	for pair, _ := range other.constProps {
-		if !pp.Has(pair.Name, pair.Value) {
+		if !pp.Has(pair.Name, pair.Value) && !pp.HasVariable(pair.Name) {
+			return false
+		}
+	}
+	for name, predicate := range other.predicates {
+		if pp.HasVariable(name) {
+			// the property will exist, but we can't know its value yet
+			if predicate.Op == OpMissing {
+				return false
+			}
+			continue
+		}
+		value, present := pp.lookup(name)
+		if !predicate.Matches(value, present) {
 			return false
 		}
 	}
@@ -0,0 +1,173 @@
+package graph
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	RuleNode     = "rule"
+	ArtifactNode = "artifact"
+)
+
+// states of nodes in an instance diagram
+const (
+	StateComplete = "complete" // applied rule which has recorded its outputs
+	StatePending  = "pending"  // applied rule which has started but not recorded its outputs
+	StateCurrent  = "current"  // artifact which is part of the current run
+	StateStale    = "stale"    // artifact which was consumed but is no longer part of the current run
+)
+
+type DiagramNode struct {
+	ID         string
+	Kind       string
+	Label      string
+	State      string
+	Properties map[string]string
+}
+
+type DiagramEdge struct {
+	From string
+	To   string
+	// set when the edge is from an artifact to a rule which consumed it with "all"
+	IsAll bool
+}
+
+// Diagram is a renderable form of either the rule graph or the graph of applied rules and artifacts recorded in
+// the DB. Nodes and edges are kept in the order they were added so that the rendered output is stable.
+type Diagram struct {
+	Nodes []*DiagramNode
+	Edges []*DiagramEdge
+
+	nodeByID map[string]*DiagramNode
+	edgeSet  map[DiagramEdge]bool
+}
+
+func NewDiagram() *Diagram {
+	return &Diagram{nodeByID: make(map[string]*DiagramNode),
+		edgeSet: make(map[DiagramEdge]bool)}
+}
+
+// AddNode adds the node unless a node with the same ID already exists. Returns the node in the diagram.
+func (d *Diagram) AddNode(node *DiagramNode) *DiagramNode {
+	if existing, ok := d.nodeByID[node.ID]; ok {
+		return existing
+	}
+	d.nodeByID[node.ID] = node
+	d.Nodes = append(d.Nodes, node)
+	return node
+}
+
+func (d *Diagram) GetNode(id string) *DiagramNode {
+	return d.nodeByID[id]
+}
+
+func (d *Diagram) AddEdge(from string, to string, isAll bool) {
+	edge := DiagramEdge{From: from, To: to, IsAll: isAll}
+	if d.edgeSet[edge] {
+		return
+	}
+	d.edgeSet[edge] = true
+	d.Edges = append(d.Edges, &edge)
+}
+
+// FindNodes returns the IDs of the nodes of the given kind for which match returns true
+func (d *Diagram) FindNodes(kind string, match func(node *DiagramNode) bool) []string {
+	ids := make([]string, 0)
+	for _, node := range d.Nodes {
+		if node.Kind == kind && match(node) {
+			ids = append(ids, node.ID)
+		}
+	}
+	return ids
+}
+
+// Neighborhood returns the subset of the diagram containing the given nodes and every node reachable from them
+// (following edges in either direction) in at most depth steps. If depth is 0, there is no limit.
+func (d *Diagram) Neighborhood(ids []string, depth int) *Diagram {
+	neighbors := make(map[string][]string)
+	for _, edge := range d.Edges {
+		neighbors[edge.From] = append(neighbors[edge.From], edge.To)
+		neighbors[edge.To] = append(neighbors[edge.To], edge.From)
+	}
+
+	included := make(map[string]bool)
+	frontier := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !included[id] {
+			included[id] = true
+			frontier = append(frontier, id)
+		}
+	}
+	for step := 0; len(frontier) > 0 && (depth == 0 || step < depth); step++ {
+		next := make([]string, 0)
+		for _, id := range frontier {
+			for _, neighbor := range neighbors[id] {
+				if !included[neighbor] {
+					included[neighbor] = true
+					next = append(next, neighbor)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	subset := NewDiagram()
+	for _, node := range d.Nodes {
+		if included[node.ID] {
+			subset.AddNode(node)
+		}
+	}
+	for _, edge := range d.Edges {
+		if included[edge.From] && included[edge.To] {
+			subset.AddEdge(edge.From, edge.To, edge.IsAll)
+		}
+	}
+	return subset
+}
+
+func (pt *PropertiesTemplate) constantProperties() map[string]string {
+	props := make(map[string]string)
+	for sp := range pt.constProps {
+		props[sp.Name] = sp.Value
+	}
+	return props
+}
+
+// Diagram converts the rule graph into a diagram. Rules are ordered by name and the artifacts they produce
+// follow in the order they were declared.
+func (g *Graph) Diagram() *Diagram {
+	rules := make([]*Rule, 0)
+	g.ForEachRule(func(r *Rule) {
+		rules = append(rules, r)
+	})
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].name < rules[j].name
+	})
+
+	d := NewDiagram()
+	artifactIDs := make(map[*artifact]string)
+	for _, r := range rules {
+		d.AddNode(&DiagramNode{ID: "rule_" + r.name, Kind: RuleNode, Label: r.name, Properties: map[string]string{"name": r.name}})
+	}
+	for _, r := range rules {
+		for _, a := range r.produces {
+			id := fmt.Sprintf("artifact_%d", len(artifactIDs)+1)
+			artifactIDs[a] = id
+			label := a.props.Get("type")
+			if label == "" {
+				label = "artifact"
+			}
+			d.AddNode(&DiagramNode{ID: id, Kind: ArtifactNode, Label: label, Properties: a.props.constantProperties()})
+			d.AddEdge("rule_"+r.name, id, false)
+		}
+	}
+	for _, r := range rules {
+		for _, rel := range r.consumes {
+			if id, ok := artifactIDs[rel.artifact]; ok {
+				d.AddEdge(id, "rule_"+r.name, rel.isAll)
+			}
+		}
+	}
+	return d
+}
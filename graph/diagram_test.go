@@ -0,0 +1,118 @@
+package graph
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chainGraph() *Graph {
+	gb := NewGraphBuilder()
+	gb.AddRule("a")
+	gb.AddRuleProduces("a", parseProps("type:a-out"))
+	gb.AddRule("b")
+	gb.AddRuleConsumes("b", false, parseProps("type:a-out"))
+	gb.AddRuleProduces("b", parseProps("type:b-out"))
+	gb.AddRule("c")
+	gb.AddRuleConsumes("c", true, parseProps("type:b-out"))
+	return gb.Build()
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// instanceDiagram builds a small diagram like the one the DB produces for applied rules and artifacts
+func instanceDiagram() *Diagram {
+	d := NewDiagram()
+	d.AddNode(&DiagramNode{ID: "r1", Kind: RuleNode, Label: "a (r1)", State: StateComplete, Properties: map[string]string{"name": "a"}})
+	d.AddNode(&DiagramNode{ID: "artifact_1", Kind: ArtifactNode, Label: "type: a-out\nvalue: \"1\"", State: StateCurrent, Properties: map[string]string{"type": "a-out", "value": "\"1\""}})
+	d.AddNode(&DiagramNode{ID: "artifact_2", Kind: ArtifactNode, Label: "type: a-out\nvalue: 0", State: StateStale, Properties: map[string]string{"type": "a-out", "value": "0"}})
+	d.AddNode(&DiagramNode{ID: "r2", Kind: RuleNode, Label: "b (r2)", State: StatePending, Properties: map[string]string{"name": "b"}})
+	d.AddEdge("r1", "artifact_1", false)
+	d.AddEdge("artifact_1", "r2", true)
+	d.AddEdge("artifact_2", "r2", true)
+	return d
+}
+
+func assertGolden(t *testing.T, name string, write func(w io.Writer) error) {
+	buf := bytes.Buffer{}
+	assert.Nil(t, write(&buf))
+
+	goldenFile := path.Join("testdata", name)
+	if *updateGolden {
+		assert.Nil(t, ioutil.WriteFile(goldenFile, buf.Bytes(), 0644))
+	}
+	expected, err := ioutil.ReadFile(goldenFile)
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), buf.String())
+}
+
+func TestRuleGraphDiagram(t *testing.T) {
+	d := chainGraph().Diagram()
+
+	assert.Equal(t, 5, len(d.Nodes))
+	assert.Equal(t, 4, len(d.Edges))
+
+	assertGolden(t, "rule_graph.dot", func(w io.Writer) error {
+		d.WriteDot(w)
+		return nil
+	})
+	assertGolden(t, "rule_graph.mmd", func(w io.Writer) error {
+		d.WriteMermaid(w)
+		return nil
+	})
+	assertGolden(t, "rule_graph.json", d.WriteJSON)
+}
+
+func TestInstanceDiagram(t *testing.T) {
+	d := instanceDiagram()
+
+	assertGolden(t, "instance_graph.dot", func(w io.Writer) error {
+		d.WriteDot(w)
+		return nil
+	})
+	assertGolden(t, "instance_graph.mmd", func(w io.Writer) error {
+		d.WriteMermaid(w)
+		return nil
+	})
+	assertGolden(t, "instance_graph.json", d.WriteJSON)
+}
+
+func TestArtifactRuleMermaid(t *testing.T) {
+	// the artifact rule's name isn't a valid Mermaid ID
+	gb := NewGraphBuilder()
+	gb.AddRule("<artifact rule>")
+	gb.AddRuleProduces("<artifact rule>", parseProps("type:sample"))
+	gb.AddRule("count")
+	gb.AddRuleConsumes("count", false, parseProps("type:sample"))
+
+	assertGolden(t, "artifact_rule_graph.mmd", func(w io.Writer) error {
+		gb.Build().Diagram().WriteMermaid(w)
+		return nil
+	})
+}
+
+func TestDiagramNeighborhood(t *testing.T) {
+	d := chainGraph().Diagram()
+
+	ids := d.FindNodes(RuleNode, func(node *DiagramNode) bool {
+		return node.Properties["name"] == "a"
+	})
+	assert.Equal(t, []string{"rule_a"}, ids)
+
+	subset := d.Neighborhood(ids, 1)
+	assert.Equal(t, 2, len(subset.Nodes))
+	assert.Equal(t, 1, len(subset.Edges))
+
+	subset = d.Neighborhood(ids, 2)
+	assert.Equal(t, 3, len(subset.Nodes))
+	assert.Equal(t, 2, len(subset.Edges))
+
+	subset = d.Neighborhood(ids, 0)
+	assert.Equal(t, 5, len(subset.Nodes))
+	assert.Equal(t, 4, len(subset.Edges))
+}
@@ -3,45 +3,48 @@ package graph
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
-func (g *Graph) PrintGraph(writer io.Writer) {
-	ruleToID := make(map[*Rule]int)
-	artifactToID := make(map[*artifact]int)
-	nextID := 1
-
-	// enuerate rules and assign an id to each
-	g.ForEachRule(func(r *Rule) {
-		ruleToID[r] = nextID
-		nextID += 1
-	})
+var dotFillColors = map[string]string{
+	StateComplete: "palegreen",
+	StatePending:  "gold",
+	StateCurrent:  "lightblue",
+	StateStale:    "lightgray"}
 
-	g.ForEachArtifact(func(a *artifact) {
-		artifactToID[a] = nextID
-		nextID += 1
-	})
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	return "\"" + s + "\""
+}
 
+// WriteDot writes the diagram in graphviz's dot format. Nodes which have a state are filled with a color
+// indicating that state.
+func (d *Diagram) WriteDot(writer io.Writer) {
 	fmt.Fprintf(writer, "digraph {\n")
-	for r := range ruleToID {
-		fmt.Fprintf(writer, "rule_%x [label=\"%s\"];\n", ruleToID[r], r.name)
-	}
-	for a := range artifactToID {
-		typeValue := a.props.Get("type")
-		if typeValue == "" {
-			typeValue = "artifact"
+	for _, node := range d.Nodes {
+		attrs := []string{"label=" + dotQuote(node.Label)}
+		if node.Kind == ArtifactNode {
+			attrs = append(attrs, "shape=box")
+		}
+		if color, ok := dotFillColors[node.State]; ok {
+			attrs = append(attrs, "style=filled", "fillcolor="+color)
 		}
-		fmt.Fprintf(writer, "artifact_%x [label=\"%s\", shape=box];\n", artifactToID[a], typeValue)
+		fmt.Fprintf(writer, "%s [%s];\n", dotQuote(node.ID), strings.Join(attrs, ", "))
 	}
 
-	// now edges
-	for r := range ruleToID {
-		for _, a := range r.produces {
-			fmt.Fprintf(writer, "rule_%x -> artifact_%x ;\n", ruleToID[r], artifactToID[a])
-		}
-		for _, ar := range r.consumes {
-			fmt.Fprintf(writer, "artifact_%x -> rule_%x ;\n", artifactToID[ar.artifact], ruleToID[r])
+	for _, edge := range d.Edges {
+		if edge.IsAll {
+			fmt.Fprintf(writer, "%s -> %s [label=\"all\"];\n", dotQuote(edge.From), dotQuote(edge.To))
+		} else {
+			fmt.Fprintf(writer, "%s -> %s;\n", dotQuote(edge.From), dotQuote(edge.To))
 		}
 	}
 
 	fmt.Fprintf(writer, "}\n")
 }
+
+func (g *Graph) PrintGraph(writer io.Writer) {
+	g.Diagram().WriteDot(writer)
+}
@@ -12,9 +12,15 @@ type Rule struct {
 	consumes []*artifactRel
 }
 
+func (r *Rule) Name() string {
+	return r.name
+}
+
 type artifactRel struct {
-	isAll    bool
-	artifact *artifact
+	isAll bool
+	// the rule can be applied even if no such artifact exists
+	isOptional bool
+	artifact   *artifact
 }
 
 func (ar *artifactRel) String() string {
@@ -37,53 +43,55 @@ type Graph struct {
 	// rulesByName map[string]*rule
 }
 
-// func (g *Graph) findUpstreamRules(name string) []string {
-// 	result := make([]string, 0, 10)
-// 	rule := g.rulesByName[name]
-// 	for _, consume := range rule.consumes {
-// 		if consume.isAll {
-// 			panic("unimp")
-// 		} else {
-// 			upstreamRules := consume.artifact.producedBy
-// 			for _, upstreamRule := range upstreamRules {
-// 				result = append(result, upstreamRule.name)
-// 				result = append(result, g.findUpstreamRules(upstreamRule.name)...)
-// 			}
-// 		}
-// 	}
-// 	return result
-// }
-
-// func (g *Graph) findDownstreamRules(name string) []string {
-// 	result := make([]string, 0, 10)
-// 	rule := g.rulesByName[name]
-// 	for _, artifact := range rule.produces {
-// 		for _, downstreamRule := range artifact.consumedBy {
-// 			result = append(result, downstreamRule.name)
-// 			result = append(result, g.findDownstreamRules(downstreamRule.name)...)
-// 		}
-// 	}
-// 	return result
-// }
+// collectRules returns the sorted names of the given rules and of every rule reachable from them by repeatedly
+// following next. Names of rules which aren't in the graph are returned as is.
+func (g *Graph) collectRules(names []string, next func(r *Rule) []*Rule) []string {
+	ruleByName := make(map[string]*Rule)
+	g.ForEachRule(func(r *Rule) {
+		ruleByName[r.name] = r
+	})
 
-// func (g *Graph) subgraphWithRules(ruleNames []string) *Graph {
-// 	ruleNameSet := make(map[string]bool)
-// 	for _, name := range ruleNames {
-// 		ruleNameSet[name] = true
-// 	}
+	result := newStrSet()
+	var visit func(name string)
+	visit = func(name string) {
+		if !result.Add(name) {
+			return
+		}
+		if r, ok := ruleByName[name]; ok {
+			for _, nextRule := range next(r) {
+				visit(nextRule.name)
+			}
+		}
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return result.Sorted()
+}
 
-// 	newRoots := make([]*rule, 0, len(g.roots))
-// 	for _, rule := range g.roots {
-// 		if
-// 	}
-// }
+// Upstream returns the names of the given rules and of all the rules which produce artifacts they depend on,
+// directly or indirectly
+func (g *Graph) Upstream(names []string) []string {
+	return g.collectRules(names, func(r *Rule) []*Rule {
+		var rules []*Rule
+		for _, rel := range r.consumes {
+			rules = append(rules, rel.artifact.producedBy...)
+		}
+		return rules
+	})
+}
 
-// func (g *Graph) Subset(ruleName string) *Graph {
-// 	// finds the graph that should be executed if we want to restrict ourselves to just paths including ruleName
-// 	ruleNames := g.findUpstreamRules(ruleName)
-// 	ruleNames = append(ruleNames, g.findDownstreamRules(ruleName)...)
-// 	return g.subgraphWithRules(ruleNames)
-// }
+// Downstream returns the names of the given rules and of all the rules which consume artifacts derived from
+// theirs
+func (g *Graph) Downstream(names []string) []string {
+	return g.collectRules(names, func(r *Rule) []*Rule {
+		var rules []*Rule
+		for _, a := range r.produces {
+			rules = append(rules, a.consumedBy...)
+		}
+		return rules
+	})
+}
 
 func (g *Graph) ForEachArtifact(f func(a *artifact)) {
 	seen := make(map[*artifact]bool)
@@ -117,6 +125,30 @@ func (g *Graph) ForEachRule(f func(r *Rule)) {
 	}
 }
 
+// rulesForArtifacts returns the sorted names of the rules which rulesOf returns for each artifact which could
+// satisfy the query
+func (g *Graph) rulesForArtifacts(queryProps *PropertiesTemplate, rulesOf func(a *artifact) []*Rule) []string {
+	names := newStrSet()
+	g.ForEachArtifact(func(a *artifact) {
+		if a.props.Contains(queryProps) {
+			for _, r := range rulesOf(a) {
+				names.Add(r.name)
+			}
+		}
+	})
+	return names.Sorted()
+}
+
+// Producers returns the names of the rules which produce artifacts that could satisfy the query
+func (g *Graph) Producers(queryProps *PropertiesTemplate) []string {
+	return g.rulesForArtifacts(queryProps, func(a *artifact) []*Rule { return a.producedBy })
+}
+
+// Consumers returns the names of the rules which consume artifacts that could satisfy the query
+func (g *Graph) Consumers(queryProps *PropertiesTemplate) []string {
+	return g.rulesForArtifacts(queryProps, func(a *artifact) []*Rule { return a.consumedBy })
+}
+
 // func (g *Graph) Print() {
 // 	printRule := func(r *rule) {
 // 		for _, a := range r.consumes {
@@ -178,21 +210,23 @@ func (g *GraphBuilder) Build() *Graph {
 	// then for each consume relationship, find all matching artifacts and update the rule's consumes list
 	for name, r := range g.ruleByName {
 		rels := g.consumeRels[name]
-		if len(rels) == 0 {
-			roots = append(roots, r)
-		} else {
-			for _, rel := range rels {
-				log.Printf("consume rel %s: %s", name, rel.String())
-				matches := index.Find(rel.artifact.props)
-				if len(matches) > 0 {
-					for _, match := range matches {
-						r.consumes = append(r.consumes, &artifactRel{isAll: rel.isAll, artifact: match})
-					}
-				} else {
-					log.Printf("Warning: %s will never execute because no artifact will be created that satisfies %s", name, rel.String())
+		required := false
+		for _, rel := range rels {
+			log.Printf("consume rel %s: %s", name, rel.String())
+			required = required || !rel.isOptional
+			matches := index.Find(rel.artifact.props)
+			if len(matches) > 0 {
+				for _, match := range matches {
+					r.consumes = append(r.consumes, &artifactRel{isAll: rel.isAll, isOptional: rel.isOptional, artifact: match})
 				}
+			} else if !rel.isOptional {
+				log.Printf("Warning: %s will never execute because no artifact will be created that satisfies %s", name, rel.String())
 			}
 		}
+		// rules which only have optional inputs are roots if nothing will be created that they need to wait for
+		if !required && len(r.consumes) == 0 {
+			roots = append(roots, r)
+		}
 	}
 
 	// now that the rules objects are fully populated, iterate through all the referenced artifacts and update the back refs
@@ -224,6 +258,17 @@ func (g *GraphBuilder) AddRuleConsumes(name string, isAll bool, props *Propertie
 		isAll:    isAll,
 		artifact: &artifact{props: props}})
 }
+
+// AddRuleOptionallyConsumes records the given rule uses the artifacts with the given properties if they exist. The
+// rule will not be applied until all rules which could produce such artifacts have completed.
+func (g *GraphBuilder) AddRuleOptionallyConsumes(name string, props *PropertiesTemplate) {
+	rels := g.consumeRels[name]
+	g.consumeRels[name] = append(rels, &artifactRel{
+		isAll:      true,
+		isOptional: true,
+		artifact:   &artifact{props: props}})
+}
+
 func newRule(name string) *Rule {
 	return &Rule{name: name,
 		produces: make([]*artifact, 0, 1),
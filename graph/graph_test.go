@@ -35,6 +35,44 @@ func TestPropContains(t *testing.T) {
 	}
 }
 
+func TestPropContainsVariable(t *testing.T) {
+	produced := parseProps("type:aligned")
+	produced.AddVariableProperty("sample")
+
+	assert.True(t, produced.Contains(parseProps("type:aligned", "sample:a")))
+	assert.False(t, produced.Contains(parseProps("type:other", "sample:a")))
+	assert.False(t, produced.Contains(parseProps("type:aligned", "lane:1")))
+}
+
+func TestPropContainsPredicates(t *testing.T) {
+	query := func(name string, op string, value string) *PropertiesTemplate {
+		pps := parseProps("type:sample")
+		predicate, err := NewPredicate(op, value)
+		assert.Nil(t, err)
+		pps.AddPredicate(name, predicate)
+		return pps
+	}
+
+	produced := parseProps("type:sample", "name:sample_1")
+	produced.AddVariableProperty("status")
+
+	assert.True(t, produced.Contains(query("name", OpRegex, "^sample_[0-9]+$")))
+	assert.False(t, produced.Contains(query("name", OpRegex, "^other")))
+	assert.False(t, produced.Contains(query("name", OpNotEquals, "sample_1")))
+	assert.True(t, produced.Contains(query("lane", OpNotEquals, "1")))
+	assert.True(t, produced.Contains(query("lane", OpMissing, "")))
+	assert.False(t, produced.Contains(query("lane", OpExists, "")))
+	// the value of status isn't known until the rule runs, so assume it may match
+	assert.True(t, produced.Contains(query("status", OpNotEquals, "failed")))
+	assert.True(t, produced.Contains(query("status", OpExists, "")))
+	assert.False(t, produced.Contains(query("status", OpMissing, "")))
+}
+
+func TestInvalidPredicate(t *testing.T) {
+	_, err := NewPredicate(OpRegex, "[")
+	assert.NotNil(t, err)
+}
+
 func TestMinGraph(t *testing.T) {
 	gb := NewGraphBuilder()
 	gb.AddRule("r1")
@@ -103,3 +141,68 @@ func TestGraphWithDeepAllRef(t *testing.T) {
 	assert.Equal(t, 1, len(ex.blockedBy))
 	assert.Equal(t, "{"+InitialState+" a b}", ex.blockedBy["c"].String())
 }
+
+func TestGraphWithOptionalRef(t *testing.T) {
+	gb := NewGraphBuilder()
+	gb.AddRule("a")
+	gb.AddRule("b")
+	gb.AddRule("c")
+
+	gb.AddRuleProduces("a", parseProps("p:a"))
+	gb.AddRuleOptionallyConsumes("b", parseProps("p:a"))
+	// nothing produces p:c so c can start right away
+	gb.AddRuleOptionallyConsumes("c", parseProps("p:c"))
+
+	g := gb.Build()
+	ex := ConstructExecutionPlan(g)
+	assert.Equal(t, "{b}", ex.afterEach["a"].String())
+	assert.Equal(t, "{a b c}", ex.afterEach[InitialState].String())
+	assert.Equal(t, "{"+InitialState+" a}", ex.blockedBy["b"].String())
+	assert.Nil(t, ex.blockedBy["c"])
+}
+
+func TestProducersAndConsumers(t *testing.T) {
+	gb := NewGraphBuilder()
+	gb.AddRule("a")
+	gb.AddRule("b")
+	gb.AddRule("c")
+	gb.AddRuleProduces("a", parseProps("type:x", "sample:1"))
+	gb.AddRuleProduces("b", parseProps("type:x", "sample:2"))
+	gb.AddRuleConsumes("c", false, parseProps("type:x"))
+	g := gb.Build()
+
+	assert.Equal(t, []string{"a", "b"}, g.Producers(parseProps("type:x")))
+	assert.Equal(t, []string{"b"}, g.Producers(parseProps("type:x", "sample:2")))
+	assert.Equal(t, []string{"c"}, g.Consumers(parseProps("type:x", "sample:2")))
+	assert.Equal(t, []string{}, g.Producers(parseProps("type:y")))
+}
+
+func TestUpstreamAndDownstream(t *testing.T) {
+	gb := NewGraphBuilder()
+	gb.AddRule("a")
+	gb.AddRule("b")
+	gb.AddRule("c")
+	gb.AddRule("d")
+	gb.AddRuleProduces("a", parseProps("type:a"))
+	gb.AddRuleConsumes("b", false, parseProps("type:a"))
+	gb.AddRuleProduces("b", parseProps("type:b"))
+	gb.AddRuleConsumes("c", false, parseProps("type:b"))
+	gb.AddRuleConsumes("d", false, parseProps("type:a"))
+	g := gb.Build()
+
+	assert.Equal(t, []string{"a", "b", "c"}, g.Upstream([]string{"c"}))
+	assert.Equal(t, []string{"a", "b", "d"}, g.Upstream([]string{"b", "d"}))
+	assert.Equal(t, []string{"b", "c"}, g.Downstream([]string{"b"}))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, g.Downstream([]string{"a"}))
+}
+
+func TestParseFilters(t *testing.T) {
+	query, predicates, err := ParseFilters([]string{"type=bam", "sample~^S[0-9]+$", "qc:missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"type": "bam"}, query)
+	assert.Equal(t, OpRegex, predicates["sample"].Op)
+	assert.Equal(t, OpMissing, predicates["qc"].Op)
+
+	_, _, err = ParseFilters([]string{"type"})
+	assert.NotNil(t, err)
+}
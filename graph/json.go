@@ -0,0 +1,58 @@
+package graph
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type jsonNode struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Label      string            `json:"label"`
+	State      string            `json:"state,omitempty"`
+	Properties map[string]string `json:"properties"`
+}
+
+type jsonEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	IsAll bool   `json:"all"`
+}
+
+type jsonDiagram struct {
+	Nodes []*jsonNode `json:"nodes"`
+	Edges []*jsonEdge `json:"edges"`
+}
+
+// WriteJSON writes the diagram as a JSON document of nodes and edges in the format:
+//
+//	{"nodes": [{"id": "rule_a", "kind": "rule", "label": "a", "state": "complete", "properties": {"name": "a"}}, ...],
+//	 "edges": [{"from": "rule_a", "to": "artifact_1", "all": false}, ...]}
+//
+// kind is either "rule" or "artifact". state is only present for nodes of an instance diagram and is one of
+// "complete" or "pending" for applied rules and "current" or "stale" for artifacts. all is true when the edge
+// is from an artifact to a rule which consumed it as part of an "all" binding.
+func (d *Diagram) WriteJSON(writer io.Writer) error {
+	doc := jsonDiagram{Nodes: make([]*jsonNode, len(d.Nodes)), Edges: make([]*jsonEdge, len(d.Edges))}
+	for i, node := range d.Nodes {
+		props := node.Properties
+		if props == nil {
+			props = map[string]string{}
+		}
+		doc.Nodes[i] = &jsonNode{ID: node.ID, Kind: node.Kind, Label: node.Label, State: node.State, Properties: props}
+	}
+	for i, edge := range d.Edges {
+		doc.Edges[i] = &jsonEdge{From: edge.From, To: edge.To, IsAll: edge.IsAll}
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(b, '\n'))
+	return err
+}
+
+func (g *Graph) PrintJSON(writer io.Writer) error {
+	return g.Diagram().WriteJSON(writer)
+}
@@ -0,0 +1,61 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+func mermaidQuote(s string) string {
+	s = strings.ReplaceAll(s, "\"", "#quot;")
+	s = strings.ReplaceAll(s, "<", "#lt;")
+	s = strings.ReplaceAll(s, ">", "#gt;")
+	s = strings.ReplaceAll(s, "\n", "<br>")
+	return "\"" + s + "\""
+}
+
+// WriteMermaid writes the diagram as a Mermaid flowchart which can be embedded in Markdown. Rules are drawn with
+// rounded corners, artifacts as boxes and nodes with a state are assigned a class named after that state.
+func (d *Diagram) WriteMermaid(writer io.Writer) {
+	// node IDs are derived from rule names, which may contain characters Mermaid doesn't allow in IDs (such as
+	// those of the artifact rule), so each node is numbered instead
+	mermaidIDs := make(map[string]string, len(d.Nodes))
+	for i, node := range d.Nodes {
+		mermaidIDs[node.ID] = fmt.Sprintf("n%d", i)
+	}
+
+	fmt.Fprintf(writer, "flowchart TD\n")
+	for _, node := range d.Nodes {
+		if node.Kind == ArtifactNode {
+			fmt.Fprintf(writer, "    %s[%s]\n", mermaidIDs[node.ID], mermaidQuote(node.Label))
+		} else {
+			fmt.Fprintf(writer, "    %s(%s)\n", mermaidIDs[node.ID], mermaidQuote(node.Label))
+		}
+	}
+
+	for _, edge := range d.Edges {
+		if edge.IsAll {
+			fmt.Fprintf(writer, "    %s -- all --> %s\n", mermaidIDs[edge.From], mermaidIDs[edge.To])
+		} else {
+			fmt.Fprintf(writer, "    %s --> %s\n", mermaidIDs[edge.From], mermaidIDs[edge.To])
+		}
+	}
+
+	// only define the classes which are used
+	for _, state := range []string{StateComplete, StatePending, StateCurrent, StateStale} {
+		ids := make([]string, 0)
+		for _, node := range d.Nodes {
+			if node.State == state {
+				ids = append(ids, mermaidIDs[node.ID])
+			}
+		}
+		if len(ids) > 0 {
+			fmt.Fprintf(writer, "    classDef %s fill:%s\n", state, dotFillColors[state])
+			fmt.Fprintf(writer, "    class %s %s\n", strings.Join(ids, ","), state)
+		}
+	}
+}
+
+func (g *Graph) PrintMermaid(writer io.Writer) {
+	g.Diagram().WriteMermaid(writer)
+}
@@ -0,0 +1,96 @@
+package graph
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// operators which can be used in a query in place of matching a value exactly
+const (
+	OpNotEquals = "!="
+	OpRegex     = "~"
+	OpExists    = "exists"
+	OpMissing   = "missing"
+)
+
+var filterExp = regexp.MustCompile("^([^=!~:]+)(=|!=|~)(.*)$")
+var existenceFilterExp = regexp.MustCompile("^([^=!~:]+):(exists|missing)$")
+
+// Predicate is a constraint on a single property of an artifact
+type Predicate struct {
+	Op    string
+	Value string
+	exp   *regexp.Regexp
+}
+
+// NewPredicate creates a predicate, checking that the value is valid for the operator
+func NewPredicate(op string, value string) (*Predicate, error) {
+	p := &Predicate{Op: op, Value: value}
+	switch op {
+	case OpNotEquals, OpExists, OpMissing:
+	case OpRegex:
+		exp, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression %s: %s", value, err)
+		}
+		p.exp = exp
+	default:
+		return nil, fmt.Errorf("Unknown operator %s", op)
+	}
+	return p, nil
+}
+
+// Matches returns true if a property with the given value satisfies the predicate. present is false if the
+// artifact does not have the property at all. Properties which are missing are considered to not be equal
+// to any value.
+func (p *Predicate) Matches(value string, present bool) bool {
+	switch p.Op {
+	case OpNotEquals:
+		return !present || value != p.Value
+	case OpRegex:
+		return present && p.exp.MatchString(value)
+	case OpExists:
+		return present
+	case OpMissing:
+		return !present
+	}
+	panic(fmt.Sprintf("Unknown operator %s", p.Op))
+}
+
+func (p *Predicate) String() string {
+	switch p.Op {
+	case OpExists, OpMissing:
+		return p.Op
+	}
+	return fmt.Sprintf("%s '%s'", p.Op, p.Value)
+}
+
+// ParseFilters parses filters of the form NAME=VALUE, NAME!=VALUE, NAME~REGEX, NAME:exists or NAME:missing into
+// the properties which must match exactly and the predicates on the rest
+func ParseFilters(filters []string) (map[string]string, map[string]*Predicate, error) {
+	query := make(map[string]string)
+	predicates := make(map[string]*Predicate)
+	for _, filter := range filters {
+		var name string
+		var predicate *Predicate
+		var err error
+		if parts := filterExp.FindStringSubmatch(filter); parts != nil {
+			name = parts[1]
+			if parts[2] == "=" {
+				query[name] = parts[3]
+				continue
+			}
+			predicate, err = NewPredicate(parts[2], parts[3])
+		} else if parts := existenceFilterExp.FindStringSubmatch(filter); parts != nil {
+			name = parts[1]
+			predicate, err = NewPredicate(parts[2], "")
+		} else {
+			return nil, nil, fmt.Errorf("Could not parse \"%s\" as a filter", filter)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		predicates[name] = predicate
+	}
+	return query, predicates, nil
+}
@@ -13,13 +13,18 @@ func newStrSet() *strSet {
 	return &strSet{make(map[string]bool)}
 }
 
-func (ss *strSet) String() string {
+// Sorted returns the values in the set in sorted order
+func (ss *strSet) Sorted() []string {
 	values := make([]string, 0, len(ss.set))
 	for k := range ss.set {
 		values = append(values, k)
 	}
 	sort.Strings(values)
-	return "{" + strings.Join(values, " ") + "}"
+	return values
+}
+
+func (ss *strSet) String() string {
+	return "{" + strings.Join(ss.Sorted(), " ") + "}"
 }
 
 func (ss *strSet) Add(value string) bool {
@@ -0,0 +1,415 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/parser"
+	"github.com/pgm/goconseq/persist"
+	"github.com/pgm/goconseq/run"
+)
+
+// keywords offered as completions outside of artifacts and queries
+var keywords = []string{"add-if-missing", "all", "artifact", "by", "else", "endif", "exists", "filename", "if",
+	"include", "inputs", "let", "missing", "not", "optional", "outputs", "outputs-expected", "rule", "run", "with"}
+
+// document is a file open in the editor
+type document struct {
+	filename string
+	text     string
+	// the result of evaluating the last version of the text without errors, or nil if there hasn't been one
+	config *model.Config
+	// the property names from the last version of the text which could be parsed
+	propertyNames []string
+}
+
+// Server answers requests from an editor about conseq files over the language server protocol
+type Server struct {
+	reader    *bufio.Reader
+	writer    io.Writer
+	documents map[string]*document
+	// the names of the properties of the artifacts recorded in the state directory
+	dbPropertyNames []string
+}
+
+// NewServer creates a server which reads requests from in and writes responses to out. If stateDir contains a
+// conseq database, the property names of the artifacts in it are offered as completions.
+func NewServer(in io.Reader, out io.Writer, stateDir string) *Server {
+	s := &Server{reader: bufio.NewReader(in),
+		writer:    out,
+		documents: make(map[string]*document)}
+
+	if _, err := os.Stat(path.Join(stateDir, "db.journal")); err == nil {
+		db := persist.NewDB(stateDir)
+		db.DisableUpdates()
+		s.dbPropertyNames = db.PropertyNames()
+		db.Close()
+	}
+	return s
+}
+
+// Serve handles messages until the editor sends exit or closes the connection
+func (s *Server) Serve() error {
+	for {
+		msg, err := readMessage(s.reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, respErr := s.handle(msg)
+		if msg.ID == nil {
+			// notifications don't get a response
+			if respErr != nil {
+				log.Printf("Error handling %s: %s", msg.Method, respErr.Message)
+			}
+			continue
+		}
+		resp := &response{JSONRPC: "2.0", ID: msg.ID, Result: result, Error: respErr}
+		if err := writeMessage(s.writer, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) (interface{}, *responseError) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   syncFull,
+				"definitionProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"'", "\""}},
+			},
+			"serverInfo": map[string]string{"name": "conseq"},
+		}, nil
+	case "initialized", "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &responseError{Code: invalidParams, Message: err.Error()}
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &responseError{Code: invalidParams, Message: err.Error()}
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &responseError{Code: invalidParams, Message: err.Error()}
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, s.publishDiagnostics(params.TextDocument.URI, []Diagnostic{})
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &responseError{Code: invalidParams, Message: err.Error()}
+		}
+		doc, ok := s.documents[params.TextDocument.URI]
+		if !ok {
+			return nil, nil
+		}
+		switch msg.Method {
+		case "textDocument/definition":
+			return s.definition(doc, params.Position), nil
+		case "textDocument/hover":
+			return s.hover(doc, params.Position), nil
+		default:
+			return s.completion(doc, params.Position), nil
+		}
+	}
+	return nil, &responseError{Code: methodNotFound, Message: fmt.Sprintf("Unsupported method %s", msg.Method)}
+}
+
+func uriToFilename(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("Only file URIs are supported, not %s", uri)
+	}
+	return u.Path, nil
+}
+
+func filenameToURI(filename string) string {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		absPath = filename
+	}
+	return (&url.URL{Scheme: "file", Path: absPath}).String()
+}
+
+// update re-evaluates the document after it changed and reports any errors to the editor
+func (s *Server) update(uri string, text string) *responseError {
+	filename, err := uriToFilename(uri)
+	if err != nil {
+		return &responseError{Code: invalidParams, Message: err.Error()}
+	}
+	doc, ok := s.documents[uri]
+	if !ok {
+		doc = &document{filename: filename}
+		s.documents[uri] = doc
+	}
+	doc.text = text
+
+	config := model.NewConfig()
+	statements, err := parser.ParseSource(text, filename)
+	if err == nil {
+		err = statements.Eval(config)
+	}
+	if err == nil {
+		doc.config = config
+	}
+	if names := parser.PropertyNames(text); names != nil {
+		doc.propertyNames = names
+	}
+
+	return s.publishDiagnostics(uri, diagnostics(err, filename))
+}
+
+func (s *Server) publishDiagnostics(uri string, diagnostics []Diagnostic) *responseError {
+	err := writeMessage(s.writer, &notification{JSONRPC: "2.0",
+		Method: "textDocument/publishDiagnostics",
+		Params: &publishDiagnosticsParams{URI: uri, Diagnostics: diagnostics}})
+	if err != nil {
+		return &responseError{Code: invalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// diagnostics converts the error from parsing and evaluating filename into diagnostics. Errors in included
+// files are reported at the start of the document.
+func diagnostics(err error, filename string) []Diagnostic {
+	result := []Diagnostic{}
+	if err == nil {
+		return result
+	}
+
+	var parseErrors parser.ParseErrors
+	switch e := err.(type) {
+	case parser.ParseErrors:
+		parseErrors = e
+	case *parser.ParseError:
+		parseErrors = parser.ParseErrors{e}
+	default:
+		return append(result, Diagnostic{Severity: severityError, Source: "conseq", Message: err.Error()})
+	}
+
+	for _, e := range parseErrors {
+		diagnostic := Diagnostic{Severity: severityError, Source: "conseq", Message: e.Message}
+		if (e.Filename == "" || e.Filename == filename) && e.Line > 0 {
+			length := len([]rune(e.Token))
+			if length == 0 {
+				length = 1
+			}
+			diagnostic.Range = Range{Start: Position{Line: e.Line - 1, Character: e.Column},
+				End: Position{Line: e.Line - 1, Character: e.Column + length}}
+		} else {
+			diagnostic.Message = e.Location() + ": " + e.Message
+		}
+		result = append(result, diagnostic)
+	}
+	return result
+}
+
+func isWordChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '+' || c == '-'
+}
+
+// wordAt returns the identifier at the position and the text on the line before it
+func wordAt(text string, pos Position) (string, string) {
+	lines := strings.Split(text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return "", ""
+	}
+	line := []rune(lines[pos.Line])
+	if pos.Character > len(line) {
+		return "", ""
+	}
+	start, end := pos.Character, pos.Character
+	for start > 0 && isWordChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isWordChar(line[end]) {
+		end++
+	}
+	return string(line[start:end]), string(line[:start])
+}
+
+func sourceToLocation(source model.SourceLocation) *Location {
+	start := Position{Line: source.Line - 1, Character: source.Column}
+	return &Location{URI: filenameToURI(source.Filename), Range: Range{Start: start, End: start}}
+}
+
+// definition finds where the rule or variable at the position was defined. Variables are referenced in
+// templates as config.NAME.
+func (s *Server) definition(doc *document, pos Position) *Location {
+	if doc.config == nil {
+		return nil
+	}
+	word, before := wordAt(doc.text, pos)
+	if word == "" {
+		return nil
+	}
+
+	if source, ok := doc.config.VarSources[word]; ok && strings.HasSuffix(before, "config.") {
+		return sourceToLocation(source)
+	}
+	if rule, ok := doc.config.Rules[word]; ok {
+		return sourceToLocation(rule.Source)
+	}
+	if source, ok := doc.config.VarSources[word]; ok {
+		return sourceToLocation(source)
+	}
+	return nil
+}
+
+func formatRuleNames(names []string) string {
+	if len(names) == 0 {
+		return "(none)"
+	}
+	return strings.Join(names, ", ")
+}
+
+// hover describes which rules produce and consume the artifacts matching the input or output at the position
+func (s *Server) hover(doc *document, pos Position) *Hover {
+	if doc.config == nil {
+		return nil
+	}
+	ref := parser.TemplateAt(doc.text, pos.Line+1, pos.Character)
+	if ref == nil {
+		return nil
+	}
+	rule, ok := doc.config.Rules[ref.Rule]
+	if !ok {
+		return nil
+	}
+
+	var props *graph.PropertiesTemplate
+	var what string
+	if ref.Input != "" {
+		if rule.Query == nil {
+			return nil
+		}
+		props = rule.Query.GetInputProps(ref.Input)
+		what = "input " + ref.Input
+	} else {
+		outputs := rule.GetOutputProps()
+		if ref.Output >= len(outputs) {
+			return nil
+		}
+		props = outputs[ref.Output]
+		what = "output"
+	}
+	if props == nil {
+		return nil
+	}
+
+	// evaluate a copy so the artifact rule doesn't show up in the document's rules
+	config := model.NewConfig()
+	for name, r := range doc.config.Rules {
+		config.Rules[name] = r
+	}
+	config.Artifacts = doc.config.Artifacts
+	config.AddIfMissing = doc.config.AddIfMissing
+	if len(config.Artifacts) > 0 || len(config.AddIfMissing) > 0 {
+		run.AddArtifactRule(config, nil)
+	}
+	g := run.RulesToGraph(config.Rules)
+
+	value := fmt.Sprintf("**%s** of rule %s: `%s`\n\nProduced by: %s\n\nConsumed by: %s", what, rule.Name, props,
+		formatRuleNames(g.Producers(props)), formatRuleNames(g.Consumers(props)))
+	return &Hover{Contents: markupContent{Kind: "markdown", Value: value}}
+}
+
+// inBraces returns true if the position is within an artifact or query, ignoring braces in strings and comments
+func inBraces(text string, pos Position) bool {
+	depth := 0
+	var quote rune
+	inComment := false
+	for lineNumber, line := range strings.Split(text, "\n") {
+		if lineNumber > pos.Line {
+			break
+		}
+		runes := []rune(line)
+		if lineNumber == pos.Line && pos.Character < len(runes) {
+			runes = runes[:pos.Character]
+		}
+		inComment = false
+		for _, c := range runes {
+			switch {
+			case inComment:
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '#':
+				inComment = true
+			case c == '{':
+				depth++
+			case c == '}':
+				depth--
+			}
+		}
+		// short strings can't span lines, and long strings rarely contain the other kind of quote
+		if quote != 0 && lineNumber < pos.Line {
+			quote = 0
+		}
+	}
+	return depth > 0
+}
+
+// completion offers property names within artifacts and queries and keywords elsewhere
+func (s *Server) completion(doc *document, pos Position) []CompletionItem {
+	items := []CompletionItem{}
+	if !inBraces(doc.text, pos) {
+		for _, keyword := range keywords {
+			items = append(items, CompletionItem{Label: keyword, Kind: completionKindKeyword})
+		}
+		return items
+	}
+
+	names := make(map[string]string)
+	for _, name := range s.dbPropertyNames {
+		names[name] = "artifact property"
+	}
+	for _, name := range doc.propertyNames {
+		names[name] = "property"
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		items = append(items, CompletionItem{Label: name, Kind: completionKindField, Detail: names[name]})
+	}
+	return items
+}
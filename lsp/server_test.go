@@ -0,0 +1,103 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDocument = `let x = 'a'
+
+rule a:
+  outputs: {'type': 'thing', 'value': '{{config.x}}'}
+
+rule b:
+  inputs: in={'type': 'thing'}
+  run 'echo'
+`
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsp-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	uri := filenameToURI(path.Join(dir, "test.conseq"))
+
+	in := &bytes.Buffer{}
+	send := func(id int, method string, params interface{}) {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+		if id > 0 {
+			msg["id"] = id
+		}
+		assert.Nil(t, writeMessage(in, msg))
+	}
+	position := func(line int, character int) interface{} {
+		return map[string]interface{}{"textDocument": map[string]string{"uri": uri},
+			"position": map[string]int{"line": line, "character": character}}
+	}
+
+	send(0, "textDocument/didOpen", map[string]interface{}{"textDocument": map[string]string{"uri": uri, "text": "rule a: inputs:"}})
+	send(0, "textDocument/didChange", map[string]interface{}{"textDocument": map[string]string{"uri": uri},
+		"contentChanges": []map[string]string{{"text": testDocument}}})
+	// on config.x within the output of rule a
+	send(1, "textDocument/definition", position(3, 49))
+	// within the input of rule b
+	send(2, "textDocument/hover", position(6, 15))
+	send(3, "textDocument/completion", position(6, 15))
+	send(0, "exit", nil)
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, NewServer(in, out, dir).Serve())
+
+	diagnostics := make([]publishDiagnosticsParams, 0)
+	results := make(map[int]json.RawMessage)
+	reader := bufio.NewReader(out)
+	for {
+		body, err := readBody(reader)
+		if err != nil {
+			break
+		}
+		var msg struct {
+			ID     *int
+			Params json.RawMessage
+			Result json.RawMessage
+		}
+		assert.Nil(t, json.Unmarshal(body, &msg))
+		if msg.ID == nil {
+			var params publishDiagnosticsParams
+			assert.Nil(t, json.Unmarshal(msg.Params, &params))
+			diagnostics = append(diagnostics, params)
+		} else {
+			results[*msg.ID] = msg.Result
+		}
+	}
+
+	// the first version of the document has a syntax error and the second doesn't
+	assert.Equal(t, 2, len(diagnostics))
+	assert.Equal(t, 1, len(diagnostics[0].Diagnostics))
+	assert.Equal(t, 0, diagnostics[0].Diagnostics[0].Range.Start.Line)
+	assert.Equal(t, 0, len(diagnostics[1].Diagnostics))
+
+	var location Location
+	assert.Nil(t, json.Unmarshal(results[1], &location))
+	assert.Equal(t, uri, location.URI)
+	assert.Equal(t, 0, location.Range.Start.Line)
+
+	var hover Hover
+	assert.Nil(t, json.Unmarshal(results[2], &hover))
+	assert.Contains(t, hover.Contents.Value, "Produced by: a")
+	assert.Contains(t, hover.Contents.Value, "Consumed by: b")
+
+	var items []CompletionItem
+	assert.Nil(t, json.Unmarshal(results[3], &items))
+	labels := make([]string, len(items))
+	for i, item := range items {
+		labels[i] = item.Label
+	}
+	assert.Equal(t, []string{"type", "value"}, labels)
+}
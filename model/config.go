@@ -1,5 +1,12 @@
 package model
 
+import (
+	"os"
+	"strings"
+
+	"github.com/pgm/goconseq/graph"
+)
+
 const FileRefType = "$filename_ref"
 
 type ArtifactValue struct {
@@ -10,21 +17,91 @@ type ArtifactValue struct {
 type Config struct {
 	Rules map[string]*Rule
 	Vars  map[string]string
+	// where each of the variables in Vars was defined
+	VarSources map[string]SourceLocation
+	// values provided on the command line which take precedence over the values of let statements
+	Overrides map[string]string
 	//	Artifacts []model.PropPairs
-	Executors  map[string]Executor
-	StateDir   string
-	Artifacts  []map[string]ArtifactValue
-	ReplayOnly bool
+	Executors map[string]Executor
+	StateDir  string
+	// artifacts from artifact statements, which replace any previous version of the artifact
+	Artifacts []map[string]ArtifactValue
+	// artifacts from add-if-missing statements, which are only added if there is no existing artifact with the
+	// same (non-file) properties
+	AddIfMissing []map[string]ArtifactValue
+	ReplayOnly   bool
+	// if set, the applications which would be executed are recorded instead of being started
+	DryRun bool
+	// the part of the graph of rules to run
+	Selection RuleSelection
+	// previous applications which are executed again instead of being reused
+	Force ForceRerun
+}
+
+// RuleSelection restricts a run to some of the rules. Rules which aren't selected are not evaluated, so their
+// previous applications are left as they are.
+type RuleSelection struct {
+	// only run these rules and the rules upstream of them
+	Targets []string
+	// only run the rules upstream of these, but not these rules themselves
+	Until []string
+	// don't run these rules or the rules downstream of them
+	Exclude []string
+}
+
+func (s *RuleSelection) IsEmpty() bool {
+	return len(s.Targets) == 0 && len(s.Until) == 0 && len(s.Exclude) == 0
+}
+
+// ForceRerun selects previous applications which should be executed again even though nothing they depend on
+// has changed. The applications downstream of them are executed again too.
+type ForceRerun struct {
+	// all previous applications of these rules
+	Rules []string
+	// if any are set, the previous applications which produced an artifact with these properties which also
+	// satisfies the predicates
+	Query      map[string]string
+	Predicates map[string]*graph.Predicate
 }
 
 func NewConfig() *Config {
 	c := &Config{Rules: make(map[string]*Rule),
-		Vars:      make(map[string]string),
-		Executors: make(map[string]Executor)}
+		Vars:       make(map[string]string),
+		VarSources: make(map[string]SourceLocation),
+		Overrides:  make(map[string]string),
+		Executors:  make(map[string]Executor)}
 
 	return c
 }
 
+// LookupVar returns the value of a variable. Values from Overrides take precedence over those defined by let
+// statements, and environment variables are used as defaults for variables which are not otherwise defined.
+func (c *Config) LookupVar(name string) (string, bool) {
+	if value, ok := c.Overrides[name]; ok {
+		return value, true
+	}
+	if value, ok := c.Vars[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// TemplateVars returns all variables which can be referenced as config.NAME within templates
+func (c *Config) TemplateVars() map[string]string {
+	vars := make(map[string]string)
+	for _, pair := range os.Environ() {
+		parts := strings.SplitN(pair, "=", 2)
+		vars[parts[0]] = parts[1]
+	}
+	for name, value := range c.Vars {
+		vars[name] = value
+	}
+	for name, value := range c.Overrides {
+		vars[name] = value
+	}
+	return vars
+}
+
 func (c *Config) AddRule(rule *Rule) {
 	if rule.ExpectedOutputs != nil && rule.Outputs != nil {
 		panic("Cannot have both expected outputs and constant outputs defined for rule")
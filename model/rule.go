@@ -2,15 +2,25 @@ package model
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"sort"
+	"strings"
 
 	"github.com/pgm/goconseq/graph"
 )
 
 type InputQuery struct {
-	IsAll      bool
+	IsAll bool
+	// if no artifact matches, the input is bound to null instead of the rule not being applied
+	IsOptional bool
+	// the rule is only applied if no artifact matches
+	IsNegated bool
+	// if set, the artifacts of an "all" input are split into groups with the same value of this property
+	GroupBy    string
 	Properties map[string]string
+	// constraints on properties other than matching an exact value
+	Predicates map[string]*graph.Predicate
 }
 
 type RunWithStatement struct {
@@ -28,15 +38,55 @@ type QueryTemplate struct {
 	Properties []*TemplateProperty
 }
 
+// Matches returns true if props has exactly the properties named in the template and the values of those
+// which are constant are the same.
+func (t *QueryTemplate) Matches(props map[string]string) bool {
+	if len(props) != len(t.Properties) {
+		return false
+	}
+	for _, prop := range t.Properties {
+		value, ok := props[prop.Name]
+		if !ok {
+			return false
+		}
+		if !prop.NoValue && !IsTemplate(prop.Value) && prop.Value != value {
+			return false
+		}
+	}
+	return true
+}
+
 type QueryI interface {
 	AsDict() map[string]interface{}
 	GetProps() []*graph.PropertiesTemplate
+	GetAllProps() []*graph.PropertiesTemplate
+	GetOptionalProps() []*graph.PropertiesTemplate
+	// InputNames returns the names of the inputs which can be referenced from templates
+	InputNames() []string
+	// GetInputProps returns the properties of the named input, including negated inputs
+	GetInputProps(name string) *graph.PropertiesTemplate
 	IsEmpty() bool
 	ExecuteQuery(db interface{}) []interface{}
 }
 
+// SourceLocation identifies where in the conseq files something was defined
+type SourceLocation struct {
+	Filename string
+	Line     int
+	// 0-based, as reported by ANTLR
+	Column int
+}
+
+func (l SourceLocation) String() string {
+	if l.Filename == "" {
+		return fmt.Sprintf("line %d", l.Line)
+	}
+	return fmt.Sprintf("%s:%d", l.Filename, l.Line)
+}
+
 type Rule struct {
 	Name              string
+	Source            SourceLocation
 	Query             QueryI
 	ExpectedOutputs   []*QueryTemplate
 	Outputs           []RuleOutput
@@ -109,6 +159,11 @@ func (r *Rule) Hash() string {
 	return string(b)
 }
 
+// IsTemplate returns true if the value contains template expressions which are expanded when a rule runs
+func IsTemplate(value string) bool {
+	return strings.Contains(value, "{{") || strings.Contains(value, "{%")
+}
+
 type RuleOutputProperty struct {
 	Name       string
 	IsFilename bool
@@ -152,6 +207,22 @@ func (r *Rule) GetQueryProps() []*graph.PropertiesTemplate {
 	return r.Query.GetProps()
 }
 
+func (r *Rule) GetAllQueryProps() []*graph.PropertiesTemplate {
+	if r.Query == nil {
+		return nil
+	}
+	return r.Query.GetAllProps()
+}
+
+// GetOptionalQueryProps returns the properties of the inputs which are optional or negated. The rule doesn't
+// require these to exist, but needs to wait for any rules which could produce them.
+func (r *Rule) GetOptionalQueryProps() []*graph.PropertiesTemplate {
+	if r.Query == nil {
+		return nil
+	}
+	return r.Query.GetOptionalProps()
+}
+
 func (r *Rule) GetOutputProps() []*graph.PropertiesTemplate {
 	templates := make([]*graph.PropertiesTemplate, 0, len(r.Outputs)+len(r.ExpectedOutputs))
 
@@ -159,7 +230,12 @@ func (r *Rule) GetOutputProps() []*graph.PropertiesTemplate {
 		for _, output := range r.Outputs {
 			template := graph.PropertiesTemplate{}
 			for _, prop := range output.Properties {
-				template.AddConstantProperty(prop.Name, prop.Value)
+				// values which reference the inputs can't be known until the rule runs
+				if IsTemplate(prop.Value) {
+					template.AddVariableProperty(prop.Name)
+				} else {
+					template.AddConstantProperty(prop.Name, prop.Value)
+				}
 			}
 			templates = append(templates, &template)
 		}
@@ -167,7 +243,9 @@ func (r *Rule) GetOutputProps() []*graph.PropertiesTemplate {
 		for _, inTemplate := range r.ExpectedOutputs {
 			template := graph.PropertiesTemplate{}
 			for _, prop := range inTemplate.Properties {
-				if !prop.NoValue {
+				if prop.NoValue || IsTemplate(prop.Value) {
+					template.AddVariableProperty(prop.Name)
+				} else {
 					template.AddConstantProperty(prop.Name, prop.Value)
 				}
 			}
@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/pgm/goconseq/model"
+)
+
+// ParseError is a problem with a conseq file at a specific location. Line is 1-based and Column is 0-based, as
+// reported by ANTLR.
+type ParseError struct {
+	Filename string
+	Line     int
+	Column   int
+	// the text of the token the error was found at, if known
+	Token   string
+	Message string
+	// the text of the line the error is on, used to show where the error is
+	SourceLine string
+}
+
+func (e *ParseError) Location() string {
+	if e.Filename == "" {
+		return fmt.Sprintf("line %d:%d", e.Line, e.Column+1)
+	}
+	return fmt.Sprintf("%s:%d:%d", e.Filename, e.Line, e.Column+1)
+}
+
+// Error formats the error like a compiler would, with the source line and a caret under the column
+func (e *ParseError) Error() string {
+	sb := strings.Builder{}
+	sb.WriteString(e.Location())
+	sb.WriteString(": ")
+	sb.WriteString(e.Message)
+	if e.SourceLine != "" {
+		sb.WriteString("\n")
+		sb.WriteString(e.SourceLine)
+		sb.WriteString("\n")
+		// keep any tabs so the caret lines up with the source
+		for i, c := range []rune(e.SourceLine) {
+			if i >= e.Column {
+				break
+			}
+			if c == '\t' {
+				sb.WriteRune('\t')
+			} else {
+				sb.WriteRune(' ')
+			}
+		}
+		sb.WriteString("^")
+	}
+	return sb.String()
+}
+
+// ParseErrors is all of the syntax errors found in a file
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// newSourceError creates an error for a problem with the statement at source. The source line is read from the
+// file if there is one.
+func newSourceError(source model.SourceLocation, format string, args ...interface{}) *ParseError {
+	err := &ParseError{Filename: source.Filename,
+		Line:    source.Line,
+		Column:  source.Column,
+		Message: fmt.Sprintf(format, args...)}
+	if source.Filename != "" {
+		if content, readErr := ioutil.ReadFile(source.Filename); readErr == nil {
+			err.SourceLine = getLine(string(content), source.Line)
+		}
+	}
+	return err
+}
+
+// getLine returns the text of the given 1-based line, or "" if there aren't that many lines
+func getLine(text string, line int) string {
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line-1], "\r")
+}
+
+type CollectingErrorListener struct {
+	*antlr.DefaultErrorListener
+	filename string
+	text     string
+	errors   *ParseErrors
+}
+
+func (l *CollectingErrorListener) SyntaxError(recognizer antlr.Recognizer, offendingSymbol interface{}, line, column int, msg string, e antlr.RecognitionException) {
+	err := &ParseError{Filename: l.filename,
+		Line:       line,
+		Column:     column,
+		Message:    msg,
+		SourceLine: getLine(l.text, line)}
+	if token, ok := offendingSymbol.(antlr.Token); ok {
+		err.Token = token.GetText()
+	}
+	*l.errors = append(*l.errors, err)
+}
+
+// NewCollectingErrorListener creates a listener which records errors in the text of is into errors
+func NewCollectingErrorListener(is antlr.CharStream, filename string, errors *ParseErrors) *CollectingErrorListener {
+	c := new(CollectingErrorListener)
+	c.filename = filename
+	if is.Size() > 0 {
+		c.text = is.GetText(0, is.Size()-1)
+	}
+	c.errors = errors
+	return c
+}
@@ -0,0 +1,387 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/pgm/goconseq/parser/antlrparser"
+)
+
+// lists and dictionaries which would extend past this column are split across lines
+const formatWidth = 100
+
+const formatIndent = "  "
+
+// formatter writes the parse tree of a conseq file back out in a canonical layout. Spacing between tokens is
+// determined by needsSpace and line breaks are added explicitly. Comments aren't part of the parse tree, so they
+// are written when the token following them is.
+type formatter struct {
+	stream *antlr.CommonTokenStream
+	out    strings.Builder
+	indent int
+	column int
+	// line breaks to write before the next text. These are written lazily so that a comment which was at the
+	// end of a line can be kept there.
+	pendingBreaks int
+	// the last token written and the source line it ended on
+	prev     antlr.TerminalNode
+	lastLine int
+	// the token indexes of the comments which have been written
+	written map[int]bool
+	// the token indexes of the "=" in input bindings
+	bindingEquals map[int]bool
+}
+
+// Format parses the contents of a conseq file and returns it in canonical form. filename is only used for
+// reporting errors.
+func Format(source string, filename string) (string, error) {
+	errors := make(ParseErrors, 0)
+	p, stream := newParser(antlr.NewInputStream(source), filename, &errors)
+	tree := p.All_declarations()
+	if len(errors) > 0 {
+		return "", errors
+	}
+
+	f := &formatter{stream: stream, written: make(map[int]bool), bindingEquals: make(map[int]bool)}
+	f.findBindingEquals(tree)
+	children := tree.GetChildren()
+	f.declarations(children[:len(children)-1])
+	// writes any comments at the end of the file
+	f.terminal(children[len(children)-1].(antlr.TerminalNode))
+
+	if f.out.Len() == 0 {
+		return "", nil
+	}
+	return f.out.String() + "\n", nil
+}
+
+func (f *formatter) breakLine(n int) {
+	if n > f.pendingBreaks {
+		f.pendingBreaks = n
+	}
+}
+
+func (f *formatter) write(text string) {
+	if f.pendingBreaks > 0 && f.out.Len() > 0 {
+		f.out.WriteString(strings.Repeat("\n", f.pendingBreaks))
+		f.out.WriteString(strings.Repeat(formatIndent, f.indent))
+		f.column = f.indent * len(formatIndent)
+	}
+	f.pendingBreaks = 0
+	f.out.WriteString(text)
+	if i := strings.LastIndex(text, "\n"); i >= 0 {
+		f.column = len(text) - i - 1
+	} else {
+		f.column += len(text)
+	}
+}
+
+func endLine(t antlr.Token) int {
+	return t.GetLine() + strings.Count(t.GetText(), "\n")
+}
+
+// comments writes any comments which preceded the token in the source
+func (f *formatter) comments(before antlr.Token) {
+	for _, comment := range f.stream.GetHiddenTokensToLeft(before.GetTokenIndex(), antlr.TokenHiddenChannel) {
+		if f.written[comment.GetTokenIndex()] {
+			continue
+		}
+		f.written[comment.GetTokenIndex()] = true
+
+		text := strings.TrimRight(comment.GetText(), " \t")
+		if f.out.Len() > 0 && comment.GetLine() == f.lastLine {
+			// the comment was at the end of the line the last token was on, so write it before any line breaks
+			f.out.WriteString("  " + text)
+			f.column += len(text) + 2
+		} else {
+			// keep blank lines which separated comments from what came before
+			if f.out.Len() > 0 && comment.GetLine() > f.lastLine+1 {
+				f.breakLine(2)
+			} else {
+				f.breakLine(1)
+			}
+			f.write(text)
+		}
+		f.breakLine(1)
+		f.lastLine = comment.GetLine()
+	}
+	if f.prev == nil && f.out.Len() > 0 && before.GetLine() > f.lastLine+1 {
+		// keep a header comment separate from the first statement
+		f.breakLine(2)
+	}
+}
+
+// findBindingEquals records the "=" of each input binding, which is written without spaces around it
+func (f *formatter) findBindingEquals(tree antlr.Tree) {
+	_, isBinding := tree.(*antlrparser.BindingContext)
+	for _, child := range tree.GetChildren() {
+		if node, ok := child.(antlr.TerminalNode); ok {
+			if isBinding && node.GetText() == "=" {
+				f.bindingEquals[node.GetSymbol().GetTokenIndex()] = true
+			}
+		} else {
+			f.findBindingEquals(child)
+		}
+	}
+}
+
+// needsSpace returns true if there should be a space between two tokens on the same line
+func (f *formatter) needsSpace(prev antlr.TerminalNode, next antlr.TerminalNode) bool {
+	switch prev.GetText() {
+	case "{", "(", "[", "~":
+		return false
+	}
+	switch next.GetText() {
+	case "}", ")", "]", ",", ":", "(":
+		return false
+	}
+	return !f.bindingEquals[prev.GetSymbol().GetTokenIndex()] && !f.bindingEquals[next.GetSymbol().GetTokenIndex()]
+}
+
+func (f *formatter) terminal(node antlr.TerminalNode) {
+	t := node.GetSymbol()
+	f.comments(t)
+	if t.GetTokenType() == antlr.TokenEOF {
+		return
+	}
+	if f.pendingBreaks == 0 && f.prev != nil && f.needsSpace(f.prev, node) {
+		f.write(" ")
+	}
+	f.write(t.GetText())
+	f.prev = node
+	f.lastLine = endLine(t)
+}
+
+// isTrailingComma returns true for a comma which is the last thing before the closing brace of a dictionary
+func isTrailingComma(node antlr.TerminalNode) bool {
+	if node.GetText() != "," {
+		return false
+	}
+	siblings := node.GetParent().(antlr.Tree).GetChildren()
+	for i, sibling := range siblings {
+		if sibling == antlr.Tree(node) {
+			next, ok := siblings[i+1].(antlr.TerminalNode)
+			return ok && next.GetText() == "}"
+		}
+	}
+	return false
+}
+
+// forEachTerminal calls visit with each token of the tree in order, leaving out trailing commas
+func forEachTerminal(tree antlr.Tree, visit func(node antlr.TerminalNode)) {
+	if node, ok := tree.(antlr.TerminalNode); ok {
+		if !isTrailingComma(node) {
+			visit(node)
+		}
+		return
+	}
+	for _, child := range tree.GetChildren() {
+		forEachTerminal(child, visit)
+	}
+}
+
+// tokens writes the tree on a single line
+func (f *formatter) tokens(tree antlr.Tree) {
+	forEachTerminal(tree, f.terminal)
+}
+
+func (f *formatter) hasComments(ctx antlr.ParserRuleContext) bool {
+	for i := ctx.GetStart().GetTokenIndex(); i <= ctx.GetStop().GetTokenIndex(); i++ {
+		if f.stream.Get(i).GetChannel() == antlr.TokenHiddenChannel {
+			return true
+		}
+	}
+	return false
+}
+
+// fits returns true if the tree can be written on the rest of the current line
+func (f *formatter) fits(tree antlr.Tree) bool {
+	if f.hasComments(tree.(antlr.ParserRuleContext)) {
+		return false
+	}
+	sb := strings.Builder{}
+	prev := f.prev
+	if f.pendingBreaks > 0 {
+		prev = nil
+	}
+	forEachTerminal(tree, func(node antlr.TerminalNode) {
+		if prev != nil && f.needsSpace(prev, node) {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(node.GetText())
+		prev = node
+	})
+	column := f.column
+	if f.pendingBreaks > 0 {
+		column = f.indent * len(formatIndent)
+	}
+	return !strings.Contains(sb.String(), "\n") && column+sb.Len() <= formatWidth
+}
+
+// declarationSpacing returns the number of line breaks to put between two declarations. Runs of simple
+// statements of the same kind are kept together and everything else is separated by a blank line.
+func declarationSpacing(prev antlr.Tree, next antlr.Tree) int {
+	switch prev.(type) {
+	case *antlrparser.Rule_declarationContext, *antlrparser.ConditionalContext:
+		return 2
+	}
+	if reflect.TypeOf(prev) != reflect.TypeOf(next) {
+		return 2
+	}
+	return 1
+}
+
+func (f *formatter) declarations(children []antlr.Tree) {
+	var prev antlr.Tree
+	for _, child := range children {
+		stmt := child.GetChildren()[0]
+		if prev != nil {
+			f.breakLine(declarationSpacing(prev, stmt))
+		}
+		switch ctx := stmt.(type) {
+		case *antlrparser.Rule_declarationContext:
+			f.rule(ctx)
+		case *antlrparser.ConditionalContext:
+			f.conditional(ctx)
+		case *antlrparser.Artifact_stmtContext, *antlrparser.Add_if_missingContext:
+			children := ctx.GetChildren()
+			f.terminal(children[0].(antlr.TerminalNode))
+			f.dict(children[1])
+		default:
+			f.tokens(ctx)
+		}
+		f.breakLine(1)
+		prev = stmt
+	}
+}
+
+// block writes the declarations within a conditional, followed by any comments before end
+func (f *formatter) block(children []antlr.Tree, end antlr.TerminalNode) {
+	f.indent++
+	f.breakLine(1)
+	f.declarations(children)
+	f.comments(end.GetSymbol())
+	f.indent--
+	f.breakLine(1)
+	f.terminal(end)
+}
+
+func (f *formatter) conditional(ctx *antlrparser.ConditionalContext) {
+	children := ctx.GetChildren()
+	f.terminal(children[0].(antlr.TerminalNode))
+	f.tokens(children[1])
+	f.terminal(children[2].(antlr.TerminalNode))
+
+	end := 3
+	for end < len(children) {
+		if _, ok := children[end].(*antlrparser.DeclarationContext); !ok {
+			break
+		}
+		end++
+	}
+	if elseClause, ok := children[end].(*antlrparser.Else_clauseContext); ok {
+		elseChildren := elseClause.GetChildren()
+		f.block(children[3:end], elseChildren[0].(antlr.TerminalNode))
+		f.terminal(elseChildren[1].(antlr.TerminalNode))
+		f.block(elseChildren[2:], children[end+1].(antlr.TerminalNode))
+	} else {
+		f.block(children[3:end], children[end].(antlr.TerminalNode))
+	}
+}
+
+func (f *formatter) rule(ctx *antlrparser.Rule_declarationContext) {
+	children := ctx.GetChildren()
+	for _, child := range children[:3] {
+		f.tokens(child)
+	}
+
+	f.indent++
+	for _, child := range children[3:] {
+		f.breakLine(1)
+		switch part := child.(type) {
+		case *antlrparser.Input_bindingsContext, *antlrparser.OutputContext, *antlrparser.Expected_outputsContext:
+			f.list(part.(antlr.ParserRuleContext))
+		default:
+			f.tokens(part)
+		}
+	}
+	f.indent--
+}
+
+// list writes the inputs or outputs of a rule. If they don't fit on one line, each gets its own line.
+func (f *formatter) list(ctx antlr.ParserRuleContext) {
+	if f.fits(ctx) {
+		f.tokens(ctx)
+		return
+	}
+
+	children := ctx.GetChildren()
+	f.terminal(children[0].(antlr.TerminalNode))
+	f.terminal(children[1].(antlr.TerminalNode))
+	items := children[2:]
+	if len(items) == 1 {
+		f.item(items[0])
+		return
+	}
+
+	f.indent++
+	for _, child := range items {
+		if node, ok := child.(antlr.TerminalNode); ok {
+			f.terminal(node)
+		} else {
+			f.breakLine(1)
+			f.item(child)
+		}
+	}
+	f.indent--
+}
+
+func (f *formatter) item(tree antlr.Tree) {
+	binding, ok := tree.(*antlrparser.BindingContext)
+	if !ok {
+		f.dict(tree)
+		return
+	}
+
+	if f.fits(binding) {
+		f.tokens(binding)
+		return
+	}
+	for _, child := range binding.GetChildren() {
+		if template, ok := child.(*antlrparser.Artifact_templateContext); ok {
+			f.dict(template)
+		} else {
+			f.tokens(child)
+		}
+	}
+}
+
+// dict writes an artifact or query. If it doesn't fit on one line, each property gets its own line.
+func (f *formatter) dict(tree antlr.Tree) {
+	if f.fits(tree) {
+		f.tokens(tree)
+		return
+	}
+
+	children := tree.GetChildren()
+	f.terminal(children[0].(antlr.TerminalNode))
+	f.indent++
+	hasTrailingComma := false
+	for _, child := range children[1 : len(children)-1] {
+		if node, ok := child.(antlr.TerminalNode); ok {
+			f.terminal(node)
+			hasTrailingComma = true
+		} else {
+			f.breakLine(1)
+			f.tokens(child)
+			hasTrailingComma = false
+		}
+	}
+	if !hasTrailingComma {
+		f.write(",")
+	}
+	f.indent--
+	f.breakLine(1)
+	f.terminal(children[len(children)-1].(antlr.TerminalNode))
+}
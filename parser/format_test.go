@@ -0,0 +1,132 @@
+package parser
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pgm/goconseq/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const unformatted = `# header comment
+
+let  a='x'
+let b = "y"   # trailing comment
+artifact {'type':'a', 'value' : 'one',}
+add-if-missing   {"type": "b",
+    "name": "really long name which will not fit on one line", "other": "another property value"}
+rule   first :
+ inputs: in={'type':'a'}, others=all {'type': 'b', 'name' :~ 'really.*' } by 'other'
+ # a comment within a rule
+ outputs : {'type':'c', 'file': {'$filename':'out.txt'}}
+ run 'python' with """
+print('{{ inputs.in.value }}')
+"""
+ run "echo done"
+if "{{config.a}}"=='x':
+  rule second:
+    inputs: x = optional {'type':'c'}, y=not{'type':'d', 'extra':exists}
+    outputs-expected: {'type', 'value':'z'}
+    run 'true'
+  # comment at the end of a block
+else:
+rule third:
+   run 'false'
+endif
+include "other.conseq"
+# comment at the end
+`
+
+const formatted = `# header comment
+
+let a = 'x'
+let b = "y"  # trailing comment
+
+artifact {'type': 'a', 'value': 'one'}
+
+add-if-missing {
+  "type": "b",
+  "name": "really long name which will not fit on one line",
+  "other": "another property value",
+}
+
+rule first:
+  inputs: in={'type': 'a'}, others=all {'type': 'b', 'name': ~'really.*'} by 'other'
+  # a comment within a rule
+  outputs: {'type': 'c', 'file': {'$filename': 'out.txt'}}
+  run 'python' with """
+print('{{ inputs.in.value }}')
+"""
+  run "echo done"
+
+if "{{config.a}}" == 'x':
+  rule second:
+    inputs: x=optional {'type': 'c'}, y=not {'type': 'd', 'extra': exists}
+    outputs-expected: {'type', 'value': 'z'}
+    run 'true'
+  # comment at the end of a block
+else:
+  rule third:
+    run 'false'
+endif
+
+include "other.conseq"
+# comment at the end
+`
+
+func TestFormat(t *testing.T) {
+	result, err := Format(unformatted, "")
+	assert.Nil(t, err)
+	assert.Equal(t, formatted, result)
+
+	// formatting an already formatted file doesn't change it
+	result, err = Format(formatted, "")
+	assert.Nil(t, err)
+	assert.Equal(t, formatted, result)
+}
+
+func TestFormatSplitsLongInputs(t *testing.T) {
+	result, err := Format(`rule a: inputs: first={'type': 'a-long-type-name'}, second={'type': 'another-long-type-name'}, third={'type': 'c'}
+  run 'x'`, "")
+	assert.Nil(t, err)
+	assert.Equal(t, `rule a:
+  inputs:
+    first={'type': 'a-long-type-name'},
+    second={'type': 'another-long-type-name'},
+    third={'type': 'c'}
+  run 'x'
+`, result)
+}
+
+func TestFormatReportsParseErrors(t *testing.T) {
+	_, err := Format("rule x: inputs:", "broken.conseq")
+	assert.NotNil(t, err)
+	assert.Equal(t, "broken.conseq", err.(ParseErrors)[0].Filename)
+}
+
+func evalForComparison(t *testing.T, source string) *model.Config {
+	stmts, err := ParseString(source)
+	assert.Nil(t, err)
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	// where things were defined is expected to differ after formatting, and the order of output properties
+	// isn't preserved when parsing
+	for _, rule := range config.Rules {
+		rule.Source = model.SourceLocation{}
+		for _, output := range rule.Outputs {
+			sort.Slice(output.Properties, func(i, j int) bool {
+				return output.Properties[i].Name < output.Properties[j].Name
+			})
+		}
+	}
+	config.VarSources = make(map[string]model.SourceLocation)
+	return config
+}
+
+func TestFormattedConfigIsUnchanged(t *testing.T) {
+	// includes need a file to exist, so leave them out
+	source := unformatted[:len(unformatted)-len("include \"other.conseq\"\n# comment at the end\n")]
+	result, err := Format(source, "")
+	assert.Nil(t, err)
+	assert.Equal(t, evalForComparison(t, source), evalForComparison(t, result))
+}
@@ -2,7 +2,11 @@ package parser
 
 import (
 	"log"
+	"path"
 
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+
+	"github.com/pgm/goconseq/graph"
 	"github.com/pgm/goconseq/model"
 	"github.com/pgm/goconseq/parser/antlrparser"
 )
@@ -12,6 +16,17 @@ type Listener struct {
 	Statements *Statements
 	Values     []interface{}
 	CurRule    *RuleStatement
+	// the file being parsed. Empty if parsing a string
+	Filename string
+	// the absolute paths of the files which led to this file being parsed, ending with this file
+	IncludedFrom []string
+	// the enclosing conditionals and the statement lists which were being added to before entering them
+	conditionals    []*ConditionalStatement
+	outerStatements []*Statements
+}
+
+func (l *Listener) sourceLocation(ctx antlr.ParserRuleContext) model.SourceLocation {
+	return model.SourceLocation{Filename: l.Filename, Line: ctx.GetStart().GetLine(), Column: ctx.GetStart().GetColumn()}
 }
 
 func (l *Listener) Pop() interface{} {
@@ -71,8 +86,8 @@ func parseQuotedString(s string) string {
 }
 
 func (l *Listener) EnterRule_declaration(ctx *antlrparser.Rule_declarationContext) {
-	name := ctx.IDENTIFIER().GetText()
-	l.CurRule = &RuleStatement{Name: name, ExecutorName: model.DefaultExecutorName}
+	name := ctx.Identifier().GetText()
+	l.CurRule = &RuleStatement{Name: name, ExecutorName: model.DefaultExecutorName, Source: l.sourceLocation(ctx)}
 	l.Statements.Add(l.CurRule)
 }
 
@@ -103,9 +118,23 @@ func (l *Listener) ExitQuoted_string(ctx *antlrparser.Quoted_stringContext) {
 	}
 }
 
+func (l *Listener) ExitQuery_value(ctx *antlrparser.Query_valueContext) {
+	// a plain string is left on the stack, anything else is replaced by a predicate which is checked when the
+	// statement is evaluated
+	if ctx.EXISTS() != nil {
+		l.Push(&graph.Predicate{Op: graph.OpExists})
+	} else if ctx.MISSING() != nil {
+		l.Push(&graph.Predicate{Op: graph.OpMissing})
+	} else if ctx.NOTEQ() != nil {
+		l.Push(&graph.Predicate{Op: graph.OpNotEquals, Value: l.PopString()})
+	} else if ctx.REGEX() != nil {
+		l.Push(&graph.Predicate{Op: graph.OpRegex, Value: l.PopString()})
+	}
+}
+
 func (l *Listener) ExitArtifact_template_pair(ctx *antlrparser.Artifact_template_pairContext) {
 	// pop and push the args to sanity check TOS
-	value := l.PopString()
+	value := l.Pop()
 	name := l.PopString()
 
 	l.Push(name)
@@ -113,24 +142,35 @@ func (l *Listener) ExitArtifact_template_pair(ctx *antlrparser.Artifact_template
 }
 
 func (l *Listener) ExitArtifact_template(ctx *antlrparser.Artifact_templateContext) {
-	obj := make(map[string]string)
+	query := &model.InputQuery{Properties: make(map[string]string)}
 	i := 0
 	for {
 		pair := ctx.Artifact_template_pair(i)
 		if pair != nil {
-			value := l.PopString()
+			value := l.Pop()
 			name := l.PopString()
-			obj[name] = value
+			if predicate, ok := value.(*graph.Predicate); ok {
+				if query.Predicates == nil {
+					query.Predicates = make(map[string]*graph.Predicate)
+				}
+				query.Predicates[name] = predicate
+			} else {
+				query.Properties[name] = value.(string)
+			}
 		} else {
 			break
 		}
 		i++
 	}
-	l.Push(obj)
+	l.Push(query)
 }
 
 func (l *Listener) ExitArtifact_def_pair_value(ctx *antlrparser.Artifact_def_pair_valueContext) {
-	if len(ctx.AllQuoted_string()) == 1 {
+	if ctx.Filename_ref() != nil {
+		// filename('...') is shorthand for {'$filename': '...'}
+		value := l.PopString()
+		l.Push(model.ArtifactValue{Value: value, IsFilename: true})
+	} else if len(ctx.AllQuoted_string()) == 1 {
 		// string on stack, push/pop it to check the type
 		value := l.PopString()
 		l.Push(model.ArtifactValue{Value: value})
@@ -165,7 +205,7 @@ func (l *Listener) ExitArtifact_def(ctx *antlrparser.Artifact_defContext) {
 }
 
 func (l *Listener) ExitVar_stmt(ctx *antlrparser.Var_stmtContext) {
-	name := ctx.IDENTIFIER().GetText()
+	name := ctx.Identifier().GetText()
 	//name := ctx.GetChild(1).GetPayload().(antlr.Token).GetText()
 	//	value := ctx.GetChild(3).GetPayload().(antlr.ParseTree).GetText()
 	// value := ctx.Quoted_string().GetText()
@@ -178,7 +218,7 @@ func (l *Listener) ExitVar_stmt(ctx *antlrparser.Var_stmtContext) {
 	// 	log.Printf("text: %s", txt)
 	// }
 	//	pp := ctx.GetChild(1).GetPayload()
-	l.Statements.Add(&LetStatement{Name: name, Value: value})
+	l.Statements.Add(&LetStatement{Name: name, Value: value, Source: l.sourceLocation(ctx)})
 }
 
 func mapFileRefArtifact(filename string) (map[string]string, map[string]model.ArtifactValue) {
@@ -193,11 +233,18 @@ func mapFileRefArtifact(filename string) (map[string]string, map[string]model.Ar
 
 func (l *Listener) ExitBinding(ctx *antlrparser.BindingContext) {
 	var value map[string]string
+	var predicates map[string]*graph.Predicate
 
 	isAll := ctx.ALL() != nil
-	name := ctx.IDENTIFIER().GetText()
+	name := ctx.Identifier().GetText()
+	groupBy := ""
+	if ctx.BY() != nil {
+		groupBy = l.PopString()
+	}
 	if ctx.Artifact_template() != nil {
-		value = l.PopStrMap()
+		query := l.PopQuery()
+		value = query.Properties
+		predicates = query.Predicates
 	} else {
 		// if not a json obj, then this is a filename ref
 		if ctx.Filename_ref() == nil {
@@ -208,11 +255,16 @@ func (l *Listener) ExitBinding(ctx *antlrparser.BindingContext) {
 		var fileArtifact map[string]model.ArtifactValue
 		// query for finding file by filename
 		value, fileArtifact = mapFileRefArtifact(filename)
-		l.Statements.Add(&ArtifactStatement{fileArtifact})
+		l.Statements.Add(&ArtifactStatement{Artifact: fileArtifact})
 	}
 
 	l.Push(name)
-	l.Push(&model.InputQuery{IsAll: isAll, Properties: value})
+	l.Push(&model.InputQuery{IsAll: isAll,
+		IsOptional: ctx.OPTIONAL() != nil,
+		IsNegated:  ctx.NOT() != nil,
+		GroupBy:    groupBy,
+		Properties: value,
+		Predicates: predicates})
 }
 
 func (l *Listener) ExitInput_bindings(ctx *antlrparser.Input_bindingsContext) {
@@ -237,6 +289,33 @@ func (l *Listener) ExitOutput(ctx *antlrparser.OutputContext) {
 	}
 }
 
+func (l *Listener) ExitExpected_template_pair(ctx *antlrparser.Expected_template_pairContext) {
+	if len(ctx.AllQuoted_string()) == 2 {
+		value := l.PopString()
+		name := l.PopString()
+		l.Push(&model.TemplateProperty{Name: name, Value: value})
+	} else {
+		name := l.PopString()
+		l.Push(&model.TemplateProperty{Name: name, NoValue: true})
+	}
+}
+
+func (l *Listener) ExitExpected_template(ctx *antlrparser.Expected_templateContext) {
+	props := make([]*model.TemplateProperty, len(ctx.AllExpected_template_pair()))
+	for i := len(props) - 1; i >= 0; i-- {
+		props[i] = l.Pop().(*model.TemplateProperty)
+	}
+	l.Push(&model.QueryTemplate{Properties: props})
+}
+
+func (l *Listener) ExitExpected_outputs(ctx *antlrparser.Expected_outputsContext) {
+	templates := make([]*model.QueryTemplate, len(ctx.AllExpected_template()))
+	for i := len(templates) - 1; i >= 0; i-- {
+		templates[i] = l.Pop().(*model.QueryTemplate)
+	}
+	l.CurRule.ExpectedOutputs = templates
+}
+
 func (l *Listener) ExitResult_outputs(ctx *antlrparser.Result_outputsContext) {
 	outputs := make([]map[string]model.ArtifactValue, len(ctx.AllArtifact_def()))
 	for i, _ := range ctx.AllArtifact_def() {
@@ -252,7 +331,46 @@ func (l *Listener) ExitFilename_ref(ctx *antlrparser.Filename_refContext) {
 	l.Push(filename)
 }
 
+func (l *Listener) ExitInclude_stmt(ctx *antlrparser.Include_stmtContext) {
+	filename := l.PopString()
+	if !path.IsAbs(filename) && l.Filename != "" {
+		filename = path.Join(path.Dir(l.Filename), filename)
+	}
+	l.Statements.Add(&IncludeStatement{Filename: filename, Source: l.sourceLocation(ctx), includedFrom: l.IncludedFrom})
+}
+
+func (l *Listener) EnterConditional(ctx *antlrparser.ConditionalContext) {
+	cond := &ConditionalStatement{Source: l.sourceLocation(ctx)}
+	l.Statements.Add(cond)
+	l.conditionals = append(l.conditionals, cond)
+	l.outerStatements = append(l.outerStatements, l.Statements)
+	l.Statements = &cond.IfTrue
+}
+
+func (l *Listener) ExitCondition(ctx *antlrparser.ConditionContext) {
+	cond := l.conditionals[len(l.conditionals)-1]
+	cond.Right = l.PopString()
+	cond.Left = l.PopString()
+	cond.NotEqual = ctx.NOTEQ() != nil
+}
+
+func (l *Listener) EnterElse_clause(ctx *antlrparser.Else_clauseContext) {
+	l.Statements = &l.conditionals[len(l.conditionals)-1].IfFalse
+}
+
+func (l *Listener) ExitConditional(ctx *antlrparser.ConditionalContext) {
+	last := len(l.conditionals) - 1
+	l.Statements = l.outerStatements[last]
+	l.conditionals = l.conditionals[:last]
+	l.outerStatements = l.outerStatements[:last]
+}
+
+func (l *Listener) ExitArtifact_stmt(ctx *antlrparser.Artifact_stmtContext) {
+	artifact := l.PopArtifact()
+	l.Statements.Add(&ArtifactStatement{Artifact: artifact})
+}
+
 func (l *Listener) ExitAdd_if_missing(ctx *antlrparser.Add_if_missingContext) {
 	artifact := l.PopArtifact()
-	l.Statements.Add(&ArtifactStatement{artifact})
+	l.Statements.Add(&ArtifactStatement{Artifact: artifact, AddIfMissing: true})
 }
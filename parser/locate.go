@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/pgm/goconseq/parser/antlrparser"
+)
+
+// ParseSource parses source as the contents of filename, which need not match what is on disk. Includes are
+// resolved relative to filename.
+func ParseSource(source string, filename string) (*Statements, error) {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseCharStream(antlr.NewInputStream(source), filename, []string{absPath})
+}
+
+// TemplateRef identifies an input or output of a rule
+type TemplateRef struct {
+	Rule string
+	// the name of the input, or "" if this refers to an output
+	Input string
+	// the index of the output within the outputs of the rule
+	Output int
+}
+
+func parseTree(source string) antlr.Tree {
+	errors := make(ParseErrors, 0)
+	p, _ := newParser(antlr.NewInputStream(source), "", &errors)
+	tree := p.All_declarations()
+	if len(errors) > 0 {
+		return nil
+	}
+	return tree
+}
+
+// contains returns true if the 1-based line and 0-based column is within the text of ctx
+func contains(ctx antlr.ParserRuleContext, line int, column int) bool {
+	start := ctx.GetStart()
+	if line < start.GetLine() || (line == start.GetLine() && column < start.GetColumn()) {
+		return false
+	}
+
+	stop := ctx.GetStop()
+	text := stop.GetText()
+	endLine := stop.GetLine() + strings.Count(text, "\n")
+	endColumn := stop.GetColumn() + len([]rune(text))
+	if i := strings.LastIndex(text, "\n"); i >= 0 {
+		endColumn = len([]rune(text[i+1:]))
+	}
+	return line < endLine || (line == endLine && column <= endColumn)
+}
+
+// findRuleAt returns the rule declaration containing the location, looking within conditionals
+func findRuleAt(tree antlr.Tree, line int, column int) *antlrparser.Rule_declarationContext {
+	for _, child := range tree.GetChildren() {
+		ctx, ok := child.(antlr.ParserRuleContext)
+		if !ok || !contains(ctx, line, column) {
+			continue
+		}
+		if rule, ok := ctx.(*antlrparser.Rule_declarationContext); ok {
+			return rule
+		}
+		return findRuleAt(ctx, line, column)
+	}
+	return nil
+}
+
+// TemplateAt returns the input or output of a rule at the 1-based line and 0-based column of source, or nil if
+// there isn't one there or the source can't be parsed
+func TemplateAt(source string, line int, column int) *TemplateRef {
+	tree := parseTree(source)
+	if tree == nil {
+		return nil
+	}
+	rule := findRuleAt(tree, line, column)
+	if rule == nil {
+		return nil
+	}
+
+	ref := &TemplateRef{Rule: rule.Identifier().GetText()}
+	if inputs, ok := rule.Input_bindings().(*antlrparser.Input_bindingsContext); ok {
+		for _, binding := range inputs.AllBinding() {
+			if contains(binding, line, column) {
+				ref.Input = binding.(*antlrparser.BindingContext).Identifier().GetText()
+				return ref
+			}
+		}
+	}
+
+	var outputs []antlr.ParserRuleContext
+	if output, ok := rule.Output().(*antlrparser.OutputContext); ok {
+		for _, def := range output.AllArtifact_def() {
+			outputs = append(outputs, def)
+		}
+	} else if expected, ok := rule.Expected_outputs().(*antlrparser.Expected_outputsContext); ok {
+		for _, template := range expected.AllExpected_template() {
+			outputs = append(outputs, template)
+		}
+	}
+	for i, output := range outputs {
+		if contains(output, line, column) {
+			ref.Output = i
+			return ref
+		}
+	}
+	return nil
+}
+
+func collectPropertyNames(tree antlr.Tree, names map[string]bool) {
+	switch ctx := tree.(type) {
+	case *antlrparser.Artifact_template_pairContext, *antlrparser.Artifact_def_pairContext, *antlrparser.Expected_template_pairContext:
+		key := ctx.GetChildren()[0].(*antlrparser.Quoted_stringContext)
+		if t := key.SHORT_STRING(); t != nil {
+			names[parseQuotedString(t.GetText())] = true
+		}
+	}
+	for _, child := range tree.GetChildren() {
+		collectPropertyNames(child, names)
+	}
+}
+
+// PropertyNames returns the sorted names of the properties used in the artifacts, inputs and outputs in source
+func PropertyNames(source string) []string {
+	tree := parseTree(source)
+	if tree == nil {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	collectPropertyNames(tree, names)
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
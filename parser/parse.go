@@ -2,8 +2,7 @@ package parser
 
 import (
 	"fmt"
-	"log"
-	"strings"
+	"path/filepath"
 
 	"github.com/pgm/goconseq/model"
 
@@ -39,15 +38,28 @@ import (
 
 func ParseString(s string) (*Statements, error) {
 	is := antlr.NewInputStream(s)
-	return parseCharStream(is)
+	return parseCharStream(is, "", nil)
 }
 
 func ParseFile(filename string) (*Statements, error) {
+	return parseFileIncludedFrom(filename, nil)
+}
+
+// parseFileIncludedFrom parses a file which was included by the files in includedFrom (outermost first)
+func parseFileIncludedFrom(filename string, includedFrom []string) (*Statements, error) {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
 	is, err := antlr.NewFileStream(filename)
 	if err != nil {
 		return nil, err
 	}
-	return parseCharStream(is)
+
+	chain := make([]string, len(includedFrom), len(includedFrom)+1)
+	copy(chain, includedFrom)
+	return parseCharStream(is, filename, append(chain, absPath))
 }
 
 func ParseResultsFile(filename string) ([]map[string]model.ArtifactValue, error) {
@@ -55,7 +67,7 @@ func ParseResultsFile(filename string) ([]map[string]model.ArtifactValue, error)
 	if err != nil {
 		return nil, err
 	}
-	return parseResultsCharStream(is)
+	return parseResultsCharStream(is, filename)
 }
 
 // func parseCharStream(is antlr.CharStream) (*Statements, error) {
@@ -74,69 +86,55 @@ func ParseResultsFile(filename string) ([]map[string]model.ArtifactValue, error)
 // 	return nil, v
 // }
 
-type CollectingErrorListener struct {
-	*antlr.DefaultErrorListener
-	errors *[]string
-}
-
-func (l *CollectingErrorListener) SyntaxError(recognizer antlr.Recognizer, offendingSymbol interface{}, line, column int, msg string, e antlr.RecognitionException) {
-	*l.errors = append(*l.errors, msg)
-}
-
-func NewCollectingErrorListener(errors *[]string) *CollectingErrorListener {
-	c := new(CollectingErrorListener)
-	c.errors = errors
-	return c
-}
-
-func parseCharStream(is antlr.CharStream) (*Statements, error) {
-	errors := make([]string, 0)
+// newParser creates a parser for is which records all syntax errors into errors instead of printing them. The
+// token stream is also returned so that tokens on the hidden channel, such as comments, can be found.
+func newParser(is antlr.CharStream, filename string, errors *ParseErrors) (*antlrparser.DepfileParser, *antlr.CommonTokenStream) {
+	errorListener := NewCollectingErrorListener(is, filename, errors)
 
 	lexer := antlrparser.NewDepfileLexer(is)
+	lexer.RemoveErrorListeners()
+	lexer.AddErrorListener(errorListener)
+
 	stream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
 	p := antlrparser.NewDepfileParser(stream)
-
-	// replace error handler with custom version which collects all errors
 	p.RemoveErrorListeners()
-	p.AddErrorListener(NewCollectingErrorListener(&errors))
+	p.AddErrorListener(errorListener)
+	return p, stream
+}
+
+// parseCharStream parses the statements in is. filename is used for reporting where rules were defined and for
+// resolving includes, and includedFrom is the chain of files which led to this one being parsed.
+func parseCharStream(is antlr.CharStream, filename string, includedFrom []string) (*Statements, error) {
+	errors := make(ParseErrors, 0)
+	p, _ := newParser(is, filename, &errors)
 
 	// perform parsing
 	tree := p.All_declarations()
 
 	// check to see if we got any errors in course of parsing
 	if len(errors) > 0 {
-		for _, errMsg := range errors {
-			log.Printf(errMsg)
-		}
-		return nil, fmt.Errorf("%d errors", len(errors))
+		return nil, errors
 	}
 
 	// if parsing was good, now try walk the CST to create statements
 	statements := Statements{}
-	l := Listener{Statements: &statements}
+	l := Listener{Statements: &statements, Filename: filename, IncludedFrom: includedFrom}
 	antlr.ParseTreeWalkerDefault.Walk(&l, tree)
 	l.AssertStackEmpty()
 
 	return &statements, nil
 }
 
-func parseResultsCharStream(is antlr.CharStream) ([]map[string]model.ArtifactValue, error) {
-	errors := make([]string, 0)
-
-	lexer := antlrparser.NewDepfileLexer(is)
-	stream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
-	p := antlrparser.NewDepfileParser(stream)
-
-	// replace error handler with custom version which collects all errors
-	p.RemoveErrorListeners()
-	p.AddErrorListener(NewCollectingErrorListener(&errors))
+func parseResultsCharStream(is antlr.CharStream, filename string) ([]map[string]model.ArtifactValue, error) {
+	errors := make(ParseErrors, 0)
+	p, _ := newParser(is, filename, &errors)
 
 	// perform parsing
-	tree := p.Result_outputs()
+	tree := p.Results_file()
 
 	// check to see if we got any errors in course of parsing
 	if len(errors) > 0 {
-		return nil, fmt.Errorf("%d errors: %s", len(errors), strings.Join(errors, ", "))
+		return nil, errors
 	}
 
 	// if parsing was good, now try walk the CST to create statements
@@ -144,6 +142,12 @@ func parseResultsCharStream(is antlr.CharStream) ([]map[string]model.ArtifactVal
 	l := Listener{Statements: &statements}
 	antlr.ParseTreeWalkerDefault.Walk(&l, tree)
 	artifacts := l.Pop().([]map[string]model.ArtifactValue)
+	if tree.(*antlrparser.Results_fileContext).Quoted_string() != nil {
+		key := l.PopString()
+		if key != "outputs" {
+			return nil, fmt.Errorf("Expected results to be in a property named \"outputs\" but found \"%s\"", key)
+		}
+	}
 	l.AssertStackEmpty()
 
 	return artifacts, nil
@@ -1,11 +1,15 @@
 package parser
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/antlr/antlr4/runtime/Go/antlr"
 
+	"github.com/pgm/goconseq/graph"
 	"github.com/pgm/goconseq/model"
 	"github.com/stretchr/testify/assert"
 )
@@ -21,11 +25,20 @@ func TestParseLetStatement(t *testing.T) {
 }
 
 func TestParseResultOutputs(t *testing.T) {
-	outputs, err := parseResultsCharStream(antlr.NewInputStream(`[{"a": "b"}, {"c": {"$filename": "d"}}]`))
+	outputs, err := parseResultsCharStream(antlr.NewInputStream(`[{"a": "b"}, {"c": {"$filename": "d"}}]`), "")
 	assert.Nil(t, err)
 	assert.Equal(t, len(outputs), 2)
 }
 
+func TestParseResultsFile(t *testing.T) {
+	outputs, err := parseResultsCharStream(antlr.NewInputStream(`{"outputs": [{"a": "b"}, {"c": {"$filename": "d"}}]}`), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(outputs))
+
+	_, err = parseResultsCharStream(antlr.NewInputStream(`{"other": [{"a": "b"}]}`), "")
+	assert.NotNil(t, err)
+}
+
 func TestParseAddIfMissing(t *testing.T) {
 	log.Printf("%v", &antlr.Set{})
 	stmts, err := ParseString("add-if-missing {'x': 'b'}")
@@ -33,10 +46,21 @@ func TestParseAddIfMissing(t *testing.T) {
 	assert.Equal(t, len(stmts.Statements), 1)
 	config := model.NewConfig()
 	stmts.Eval(config)
-	assert.Equal(t, 1, len(config.Artifacts))
-	artifact := config.Artifacts[0]
+	assert.Equal(t, 0, len(config.Artifacts))
+	assert.Equal(t, 1, len(config.AddIfMissing))
+	artifact := config.AddIfMissing[0]
 	assert.Equal(t, artifact["x"], model.ArtifactValue{"b", false})
 }
+
+func TestParseArtifact(t *testing.T) {
+	stmts, err := ParseString("artifact {'x': 'b', 'file': {'$filename': 'data.csv'}}")
+	assert.Nil(t, err)
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	assert.Equal(t, 0, len(config.AddIfMissing))
+	assert.Equal(t, 1, len(config.Artifacts))
+	assert.Equal(t, model.ArtifactValue{Value: "data.csv", IsFilename: true}, config.Artifacts[0]["file"])
+}
 func TestParseRule(t *testing.T) {
 	log.Printf("%v", &antlr.Set{})
 	stmts, err := ParseString("rule x: inputs: a={'type': 'banana'} outputs: {'type': 'out'}")
@@ -54,6 +78,20 @@ func TestParseRule(t *testing.T) {
 	assert.Equal(t, "banana", stmt.Inputs["a"].Properties["type"])
 }
 
+func TestParseLongStrings(t *testing.T) {
+	// each long string ends at the first closing quotes rather than the last ones in the file
+	stmts, err := ParseString(`rule x:
+		run "python" with """print('a')"""
+		run "python" with '''print("b")'''
+		run "python" with """print('c')"""`)
+	assert.Nil(t, err)
+	stmt := stmts.Statements[0].(*RuleStatement)
+	assert.Equal(t, 3, len(stmt.RunStatements))
+	assert.Equal(t, "print('a')", stmt.RunStatements[0].Script)
+	assert.Equal(t, `print("b")`, stmt.RunStatements[1].Script)
+	assert.Equal(t, "print('c')", stmt.RunStatements[2].Script)
+}
+
 func TestParseFailure(t *testing.T) {
 	log.Printf("%v", &antlr.Set{})
 	stmts, err := ParseString("let x = x")
@@ -61,6 +99,20 @@ func TestParseFailure(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestParseErrorLocation(t *testing.T) {
+	_, err := ParseString("let a = 'x'\nrule r: inputs: a={'type' 'x'} run \"echo\"")
+	assert.NotNil(t, err)
+	errors := err.(ParseErrors)
+	assert.Equal(t, 1, len(errors))
+	parseErr := errors[0]
+	assert.Equal(t, 2, parseErr.Line)
+	assert.Equal(t, 26, parseErr.Column)
+	assert.Equal(t, "'x'", parseErr.Token)
+	assert.Equal(t, "line 2:27: "+parseErr.Message+"\n"+
+		"rule r: inputs: a={'type' 'x'} run \"echo\"\n"+
+		"                          ^", err.Error())
+}
+
 func TestParseRuleWithFilenameInInputs(t *testing.T) {
 	log.Printf("%v", &antlr.Set{})
 	stmts, err := ParseString("rule x: inputs: a=filename('sample') outputs: {'type': 'out'}")
@@ -87,3 +139,343 @@ func TestParseRuleWithFileRefInOutputs(t *testing.T) {
 	assert.Equal(t, "filename", fileProp.Name)
 	assert.True(t, fileProp.IsFilename)
 }
+
+func TestConfigVarsInRule(t *testing.T) {
+	stmts, err := ParseString(`let prefix = 'x'
+		rule r: inputs: a={'type': '{{config.prefix}}-in'} outputs: {'type': '{{ config.prefix }}-out', 'src': '{{inputs.a.type}}'}
+		run "echo {{config.prefix}}"`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	rule := config.Rules["r"]
+	assert.Equal(t, "x-in", rule.GetQueryProps()[0].Get("type"))
+	outputs := rule.GetOutputProps()
+	assert.Equal(t, "x-out", outputs[0].Get("type"))
+	// references to inputs are left to be expanded when the rule runs
+	assert.True(t, outputs[0].HasVariable("src"))
+	for _, prop := range rule.Outputs[0].Properties {
+		if prop.Name == "src" {
+			assert.Equal(t, "{{inputs.a.type}}", prop.Value)
+		}
+	}
+	assert.Equal(t, "echo {{config.prefix}}", rule.RunStatements[0].Executable)
+}
+
+func TestConfigVarOverridesAndDefaults(t *testing.T) {
+	os.Setenv("CONSEQ_TEST_ENV_VAR", "from-env")
+	defer os.Unsetenv("CONSEQ_TEST_ENV_VAR")
+
+	stmts, err := ParseString(`let a = 'from-let'
+		add-if-missing {'a': '{{config.a}}', 'env': '{{config.CONSEQ_TEST_ENV_VAR}}'}`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	config.Overrides["a"] = "from-set"
+	assert.Nil(t, stmts.Eval(config))
+	assert.Equal(t, "from-set", config.AddIfMissing[0]["a"].Value)
+	assert.Equal(t, "from-env", config.AddIfMissing[0]["env"].Value)
+}
+
+func TestUndefinedConfigVars(t *testing.T) {
+	stmts, err := ParseString(`let a = 'x'
+		rule r1: outputs: {'type': '{{config.b}}'}
+		rule r2: run "echo {{ config.a }} {{ config.c|upper }}"
+		add-if-missing {'type': '{{config.b}}'}`)
+	assert.Nil(t, err)
+
+	err = stmts.Eval(model.NewConfig())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"b", "c"}, err.(*UndefinedVariablesError).Names)
+	assert.Equal(t, "Undefined variables: b, c", err.Error())
+}
+
+func TestConfigVarsWithFilters(t *testing.T) {
+	stmts, err := ParseString(`let prefix = 'X'
+		let lower = '{{config.prefix|lower}}'
+		rule r: inputs: a={'type': '{{ config.prefix|lower }}-in', 'kind': '{% if config.prefix == "X" %}x{% else %}y{% endif %}'}
+		outputs: {'type': '{{config.prefix|lower}}-out', 'src': '{{inputs.a.type}}-{{config.prefix|lower}}'}
+		run "echo"`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	assert.Equal(t, "x", config.Vars["lower"])
+	rule := config.Rules["r"]
+	assert.Equal(t, "x-in", rule.GetQueryProps()[0].Get("type"))
+	assert.Equal(t, "x", rule.GetQueryProps()[0].Get("kind"))
+	assert.Equal(t, "x-out", rule.GetOutputProps()[0].Get("type"))
+	// outputs which also reference inputs are expanded when the rule runs
+	for _, prop := range rule.Outputs[0].Properties {
+		if prop.Name == "src" {
+			assert.Equal(t, "{{inputs.a.type}}-{{config.prefix|lower}}", prop.Value)
+		}
+	}
+
+	// a template which can't be expanded until the rule runs is never going to match anything as an input
+	stmts, err = ParseString(`let prefix = 'X'
+		rule r: inputs: a={'type': 'a'}, b={'type': '{{inputs.a.type}}-{{config.prefix|lower}}'} run "echo"`)
+	assert.Nil(t, err)
+	err = stmts.Eval(model.NewConfig())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid inputs of rule r")
+
+	stmts, err = ParseString(`add-if-missing {'type': '{{config.prefix|nosuchfilter}}'}`)
+	assert.Nil(t, err)
+	config = model.NewConfig()
+	config.Overrides["prefix"] = "X"
+	err = stmts.Eval(config)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid template")
+}
+
+func writeConseqFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	for name, content := range files {
+		filename := path.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(path.Dir(filename), 0777))
+		assert.Nil(t, ioutil.WriteFile(filename, []byte(content), 0666))
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeConseqFiles(t, map[string]string{
+		"main.conseq": `let prefix = 'x'
+include "sub/a.conseq"
+rule main: inputs: a={'type': 'a'} run "echo"`,
+		"sub/a.conseq": `include "b.conseq"
+
+rule a: outputs: {'type': '{{config.prefix}}-a'}`,
+		"sub/b.conseq": `let other = 'y'`})
+	defer os.RemoveAll(dir)
+
+	stmts, err := ParseFile(path.Join(dir, "main.conseq"))
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	assert.Equal(t, "y", config.Vars["other"])
+	assert.Equal(t, "x-a", config.Rules["a"].GetOutputProps()[0].Get("type"))
+	assert.Equal(t, model.SourceLocation{Filename: path.Join(dir, "sub/a.conseq"), Line: 3}, config.Rules["a"].Source)
+	assert.Equal(t, model.SourceLocation{Filename: path.Join(dir, "main.conseq"), Line: 3}, config.Rules["main"].Source)
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := writeConseqFiles(t, map[string]string{
+		"a.conseq": `include "b.conseq"`,
+		"b.conseq": `include "a.conseq"`})
+	defer os.RemoveAll(dir)
+
+	stmts, err := ParseFile(path.Join(dir, "a.conseq"))
+	assert.Nil(t, err)
+
+	err = stmts.Eval(model.NewConfig())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "creates a cycle")
+}
+
+func TestIncludeDuplicateRule(t *testing.T) {
+	dir := writeConseqFiles(t, map[string]string{
+		"a.conseq": `include "b.conseq"
+rule r: run "echo"`,
+		"b.conseq": `rule r: run "echo"`})
+	defer os.RemoveAll(dir)
+
+	stmts, err := ParseFile(path.Join(dir, "a.conseq"))
+	assert.Nil(t, err)
+
+	err = stmts.Eval(model.NewConfig())
+	assert.NotNil(t, err)
+	assert.Equal(t, path.Join(dir, "a.conseq")+":2:1: Rule r was already defined at "+path.Join(dir, "b.conseq")+":1\n"+
+		"rule r: run \"echo\"\n"+
+		"^", err.Error())
+}
+
+func TestConditional(t *testing.T) {
+	stmts, err := ParseString(`let ENV = 'test'
+		if "{{config.ENV}}" == "prod":
+			rule fetch: outputs: {'type': 'data', 'source': 'remote'}
+		else:
+			add-if-missing {'type': 'data', 'source': 'sample'}
+			if "{{config.ENV}}" != "dev":
+				let checked = 'true'
+			endif
+		endif
+		rule process: inputs: d={'type': 'data'} run "echo"`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	assert.Nil(t, config.Rules["fetch"])
+	assert.NotNil(t, config.Rules["process"])
+	assert.Equal(t, 1, len(config.AddIfMissing))
+	assert.Equal(t, "sample", config.AddIfMissing[0]["source"].Value)
+	assert.Equal(t, "true", config.Vars["checked"])
+
+	config = model.NewConfig()
+	config.Overrides["ENV"] = "prod"
+	assert.Nil(t, stmts.Eval(config))
+	assert.NotNil(t, config.Rules["fetch"])
+	assert.Equal(t, 0, len(config.AddIfMissing))
+}
+
+func TestConditionalWithFilter(t *testing.T) {
+	stmts, err := ParseString(`let ENV = 'prod'
+		if "{{config.ENV|upper}}" == 'PROD':
+			rule fetch: run "echo"
+		else:
+			rule sample: run "echo"
+		endif`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	assert.NotNil(t, config.Rules["fetch"])
+	assert.Nil(t, config.Rules["sample"])
+}
+
+func TestConditionalWithUndefinedVariable(t *testing.T) {
+	stmts, err := ParseString(`if "{{config.MISSING}}" == "prod":
+			rule fetch: run "echo"
+		endif`)
+	assert.Nil(t, err)
+
+	err = stmts.Eval(model.NewConfig())
+	assert.NotNil(t, err)
+	assert.Equal(t, "Undefined variables: MISSING", err.Error())
+}
+
+func TestParseOutputTemplates(t *testing.T) {
+	stmts, err := ParseString(`rule align:
+		inputs: s={'type': 'sample'}
+		outputs: {'type': 'aligned', 'sample': '{{inputs.s.name}}', 'bam': filename('{{inputs.s.name}}.bam')}`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	outputs := config.Rules["align"].Outputs
+	assert.Equal(t, 1, len(outputs))
+	for _, prop := range outputs[0].Properties {
+		assert.Equal(t, prop.Name == "bam", prop.IsFilename)
+	}
+
+	// only the constant properties are known before the rule runs
+	props := config.Rules["align"].GetOutputProps()[0]
+	assert.Equal(t, "aligned", props.Get("type"))
+	assert.Equal(t, "", props.Get("sample"))
+	assert.True(t, props.HasVariable("sample"))
+	assert.True(t, props.HasVariable("bam"))
+}
+
+func TestParseExpectedOutputs(t *testing.T) {
+	stmts, err := ParseString(`rule r:
+		outputs-expected: {'type': 'summary', 'sample'}, {'type': '{{config.t}}'}
+		run "summarize.py"`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	config.Overrides["t"] = "log"
+	assert.Nil(t, stmts.Eval(config))
+	rule := config.Rules["r"]
+	assert.Nil(t, rule.Outputs)
+	assert.Equal(t, 2, len(rule.ExpectedOutputs))
+	assert.Equal(t, []*model.TemplateProperty{{Name: "type", Value: "summary"}, {Name: "sample", NoValue: true}}, rule.ExpectedOutputs[0].Properties)
+	assert.Equal(t, "log", rule.ExpectedOutputs[1].Properties[0].Value)
+
+	props := rule.GetOutputProps()
+	assert.Equal(t, "summary", props[0].Get("type"))
+	assert.True(t, props[0].HasVariable("sample"))
+}
+
+func TestParseQueryPredicates(t *testing.T) {
+	stmts, err := ParseString(`let prefix = 'sample'
+		rule r:
+			inputs: a={'type': 'sample', 'name': ~'^{{config.prefix}}_[0-9]+$', 'status': != 'failed', 'bam': exists, 'error': missing}
+			run "echo"`)
+	assert.Nil(t, err)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	props := config.Rules["r"].GetQueryProps()[0]
+	assert.Equal(t, "sample", props.Get("type"))
+
+	produced := &graph.PropertiesTemplate{}
+	produced.AddConstantProperty("type", "sample")
+	produced.AddConstantProperty("name", "sample_12")
+	produced.AddConstantProperty("status", "ok")
+	produced.AddVariableProperty("bam")
+	assert.True(t, produced.Contains(props))
+
+	produced.AddConstantProperty("error", "oops")
+	assert.False(t, produced.Contains(props))
+
+	stmts, err = ParseString(`rule r: inputs: a={'name': ~'['} run "echo"`)
+	assert.Nil(t, err)
+	assert.NotNil(t, stmts.Eval(model.NewConfig()))
+}
+
+func TestParseOptionalAndNegatedInputs(t *testing.T) {
+	stmts, err := ParseString(`rule r:
+			inputs: s={'type': 'sample'}, qc=optional {'type': 'qc'}, x=not {'type': 'exclude'}
+			run "echo"`)
+	assert.Nil(t, err)
+
+	inputs := stmts.Statements[0].(*RuleStatement).Inputs
+	assert.False(t, inputs["s"].IsOptional || inputs["s"].IsNegated)
+	assert.True(t, inputs["qc"].IsOptional)
+	assert.True(t, inputs["x"].IsNegated)
+
+	config := model.NewConfig()
+	assert.Nil(t, stmts.Eval(config))
+	rule := config.Rules["r"]
+	assert.Equal(t, 1, len(rule.GetQueryProps()))
+	assert.Equal(t, 2, len(rule.GetOptionalQueryProps()))
+}
+
+func TestParseGroupBy(t *testing.T) {
+	stmts, err := ParseString(`rule r: inputs: bams=all {'type': 'bam'} by 'batch', ref=filename("ref.fa") by 'x' run "echo"`)
+	assert.Nil(t, err)
+	inputs := stmts.Statements[0].(*RuleStatement).Inputs
+	assert.True(t, inputs["bams"].IsAll)
+	assert.Equal(t, "batch", inputs["bams"].GroupBy)
+	assert.Equal(t, "x", inputs["ref"].GroupBy)
+	assert.Equal(t, "ref.fa", inputs["ref"].Properties["name"])
+
+	// only "all" inputs can be grouped
+	assert.NotNil(t, stmts.Eval(model.NewConfig()))
+
+	stmts, err = ParseString(`rule r: inputs: bams=all {'type': 'bam'} by 'batch' run "echo"`)
+	assert.Nil(t, err)
+	assert.Nil(t, stmts.Eval(model.NewConfig()))
+}
+
+func TestParseKeywordsAsNames(t *testing.T) {
+	// files written before these were keywords may have used them as names
+	source := `let missing = 'm'
+
+rule include:
+  inputs:
+    not=not {'type': 'a'},
+    by=all {'type': 'b'} by 'batch',
+    optional=optional {'type': 'c'},
+    if={'type': 'd'}
+  run 'echo'
+`
+	stmts, err := ParseString(source)
+	assert.Nil(t, err)
+	assert.Equal(t, "missing", stmts.Statements[0].(*LetStatement).Name)
+	rule := stmts.Statements[1].(*RuleStatement)
+	assert.Equal(t, "include", rule.Name)
+	assert.True(t, rule.Inputs["not"].IsNegated)
+	assert.True(t, rule.Inputs["by"].IsAll)
+	assert.Equal(t, "batch", rule.Inputs["by"].GroupBy)
+	assert.True(t, rule.Inputs["optional"].IsOptional)
+	assert.False(t, rule.Inputs["if"].IsOptional || rule.Inputs["if"].IsNegated || rule.Inputs["if"].IsAll)
+
+	// and formatting leaves them alone
+	formatted, err := Format(source, "")
+	assert.Nil(t, err)
+	assert.Equal(t, source, formatted)
+}
@@ -1,8 +1,11 @@
 package parser
 
 import (
-	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/pgm/goconseq/graph"
 	"github.com/pgm/goconseq/model"
 	"github.com/pgm/goconseq/persist"
 )
@@ -23,34 +26,97 @@ type RuleStatementOutput struct {
 
 type RuleStatement struct {
 	Name              string
+	Source            model.SourceLocation
 	Inputs            map[string]*model.InputQuery
 	Outputs           []RuleStatementOutput
+	ExpectedOutputs   []*model.QueryTemplate
 	ExecutorName      string
 	RequiredResources map[string]float64
 	RunStatements     []*model.RunWithStatement
 }
 
-func makeRuleOutput(output RuleStatementOutput) model.RuleOutput {
+func makeRuleOutput(output RuleStatementOutput, vars *varResolver) model.RuleOutput {
 	properties := make([]model.RuleOutputProperty, len(output.Properties))
 	for i, property := range output.Properties {
-		properties[i] = model.RuleOutputProperty{Name: property.Name, Value: property.Value, IsFilename: property.IsFilename}
+		properties[i] = model.RuleOutputProperty{Name: property.Name, Value: vars.resolve(property.Value), IsFilename: property.IsFilename}
 	}
 	return model.RuleOutput{Properties: properties}
 }
 
 func (s *RuleStatement) Eval(config *model.Config) error {
-	query := persist.QueryFromMaps(s.Inputs)
+	vars := newVarResolver(config)
+
+	inputs := make(map[string]*model.InputQuery, len(s.Inputs))
+	for name, input := range s.Inputs {
+		if input.GroupBy != "" && !input.IsAll {
+			return newSourceError(s.Source, "Invalid input %s of rule %s: only inputs bound with \"all\" can be grouped", name, s.Name)
+		}
+		properties := make(map[string]string, len(input.Properties))
+		for k, v := range input.Properties {
+			properties[k] = vars.resolve(v)
+		}
+		var predicates map[string]*graph.Predicate
+		if input.Predicates != nil {
+			predicates = make(map[string]*graph.Predicate, len(input.Predicates))
+			for k, p := range input.Predicates {
+				predicate, err := graph.NewPredicate(p.Op, vars.resolve(p.Value))
+				if err != nil {
+					return newSourceError(s.Source, "Invalid input %s of rule %s: %s", name, s.Name, err)
+				}
+				predicates[k] = predicate
+			}
+		}
+		inputs[name] = &model.InputQuery{IsAll: input.IsAll,
+			IsOptional: input.IsOptional,
+			IsNegated:  input.IsNegated,
+			GroupBy:    vars.resolve(input.GroupBy),
+			Properties: properties,
+			Predicates: predicates}
+	}
+	query, err := persist.QueryFromMaps(inputs)
+	if err != nil {
+		return newSourceError(s.Source, "Invalid inputs of rule %s: %s", s.Name, err)
+	}
+
 	outputs := make([]model.RuleOutput, len(s.Outputs))
 	if s.Outputs == nil {
 		outputs = nil
 	} else {
 		for i, output := range s.Outputs {
-			outputs[i] = makeRuleOutput(output)
+			outputs[i] = makeRuleOutput(output, vars)
 		}
 	}
+
+	var expectedOutputs []*model.QueryTemplate
+	if s.ExpectedOutputs != nil {
+		expectedOutputs = make([]*model.QueryTemplate, len(s.ExpectedOutputs))
+		for i, template := range s.ExpectedOutputs {
+			properties := make([]*model.TemplateProperty, len(template.Properties))
+			for j, property := range template.Properties {
+				properties[j] = &model.TemplateProperty{Name: property.Name, Value: vars.resolve(property.Value), NoValue: property.NoValue}
+			}
+			expectedOutputs[i] = &model.QueryTemplate{Properties: properties}
+		}
+	}
+
+	// run statements are expanded when the rule executes, so only check they don't reference anything undefined
+	for _, runStatement := range s.RunStatements {
+		vars.check(runStatement.Executable)
+		vars.check(runStatement.Script)
+	}
+	if err := vars.err(); err != nil {
+		return err
+	}
+
+	if existing, exists := config.Rules[s.Name]; exists {
+		return newSourceError(s.Source, "Rule %s was already defined at %s", s.Name, existing.Source)
+	}
+
 	config.AddRule(&model.Rule{Name: s.Name,
+		Source:            s.Source,
 		Query:             query,
 		Outputs:           outputs,
+		ExpectedOutputs:   expectedOutputs,
 		ExecutorName:      s.ExecutorName,
 		RequiredResources: s.RequiredResources,
 		RunStatements:     s.RunStatements})
@@ -58,24 +124,103 @@ func (s *RuleStatement) Eval(config *model.Config) error {
 }
 
 type LetStatement struct {
-	Name  string
-	Value string
+	Name   string
+	Value  string
+	Source model.SourceLocation
 }
 
 func (s *LetStatement) Eval(config *model.Config) error {
 	if existingValue, exists := config.Vars[s.Name]; exists {
-		return fmt.Errorf("Cannot define %s as %s (already defined as %s)", s.Name, s.Value, existingValue)
+		return newSourceError(s.Source, "Cannot define %s as %s (already defined as %s at %s)", s.Name, s.Value, existingValue, config.VarSources[s.Name])
 	}
-	config.Vars[s.Name] = s.Value
+	vars := newVarResolver(config)
+	value := vars.resolve(s.Value)
+	if err := vars.err(); err != nil {
+		return err
+	}
+	config.Vars[s.Name] = value
+	config.VarSources[s.Name] = s.Source
 	return nil
 }
 
+type IncludeStatement struct {
+	// the path to the included file, resolved relative to the including file
+	Filename string
+	Source   model.SourceLocation
+	// the absolute paths of the files which are being included, used to detect cycles
+	includedFrom []string
+}
+
+func (s *IncludeStatement) Eval(config *model.Config) error {
+	absPath, err := filepath.Abs(s.Filename)
+	if err != nil {
+		return err
+	}
+	for _, includer := range s.includedFrom {
+		if includer == absPath {
+			return newSourceError(s.Source, "Cannot include %s: this creates a cycle (%s)", s.Filename,
+				strings.Join(append(s.includedFrom, absPath), " -> "))
+		}
+	}
+
+	statements, err := parseFileIncludedFrom(s.Filename, s.includedFrom)
+	if parseErrors, ok := err.(ParseErrors); ok {
+		// these already say which file they're from
+		return parseErrors
+	} else if err != nil {
+		return newSourceError(s.Source, "Could not include %s: %s", s.Filename, err)
+	}
+
+	// all included statements are evaluated against the same config as the file which included them
+	return statements.Eval(config)
+}
+
+// ConditionalStatement evaluates the statements in IfTrue if the comparison of Left and Right holds once
+// they have been expanded as templates, otherwise those in IfFalse
+type ConditionalStatement struct {
+	Left     string
+	Right    string
+	NotEqual bool
+	IfTrue   Statements
+	IfFalse  Statements
+	Source   model.SourceLocation
+}
+
+func (s *ConditionalStatement) Eval(config *model.Config) error {
+	vars := newVarResolver(config)
+	left := vars.resolve(s.Left)
+	right := vars.resolve(s.Right)
+	if err := vars.err(); err != nil {
+		return err
+	}
+
+	if (left == right) != s.NotEqual {
+		return s.IfTrue.Eval(config)
+	}
+	return s.IfFalse.Eval(config)
+}
+
 type ArtifactStatement struct {
 	Artifact map[string]model.ArtifactValue
+	// if set, the artifact is only added if it doesn't already exist
+	AddIfMissing bool
 }
 
 func (s *ArtifactStatement) Eval(config *model.Config) error {
-	config.Artifacts = append(config.Artifacts, s.Artifact)
+	vars := newVarResolver(config)
+	artifact := make(map[string]model.ArtifactValue, len(s.Artifact))
+	for k, v := range s.Artifact {
+		artifact[k] = model.ArtifactValue{Value: vars.resolve(v.Value), IsFilename: v.IsFilename}
+	}
+	if err := vars.err(); err != nil {
+		return err
+	}
+
+	if s.AddIfMissing {
+		config.AddIfMissing = append(config.AddIfMissing, artifact)
+	} else {
+		config.Artifacts = append(config.Artifacts, artifact)
+	}
 	return nil
 }
 
@@ -83,13 +228,29 @@ type Statements struct {
 	Statements []Statement
 }
 
+// Eval evaluates each statement in order. References to undefined variables don't stop evaluation, so that all
+// of them can be reported in a single error.
 func (s *Statements) Eval(config *model.Config) error {
+	undefined := make(map[string]bool)
 	for _, stmt := range s.Statements {
 		err := stmt.Eval(config)
-		if err != nil {
+		if undefinedErr, ok := err.(*UndefinedVariablesError); ok {
+			for _, name := range undefinedErr.Names {
+				undefined[name] = true
+			}
+		} else if err != nil {
 			return err
 		}
 	}
+
+	if len(undefined) > 0 {
+		names := make([]string, 0, len(undefined))
+		for name := range undefined {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return &UndefinedVariablesError{Names: names}
+	}
 	return nil
 }
 
@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/pgm/goconseq/model"
+)
+
+// matches the contents of {{ ... }} and {% ... %} blocks within a template
+var templateTagExp = regexp.MustCompile(`(?s)\{[{%](.*?)[%}]\}`)
+
+// matches a reference to a variable within a template tag
+var configRefExp = regexp.MustCompile(`\bconfig\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// matches a reference to an input within a template
+var inputRefExp = regexp.MustCompile(`\binputs\.`)
+
+// matches a template which does nothing but print the value of a variable
+var simpleConfigRefExp = regexp.MustCompile(`\{\{\s*config\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+type UndefinedVariablesError struct {
+	Names []string
+}
+
+func (e *UndefinedVariablesError) Error() string {
+	return fmt.Sprintf("Undefined variables: %s", strings.Join(e.Names, ", "))
+}
+
+// findConfigRefs returns the names of all variables referenced by the template
+func findConfigRefs(template string) []string {
+	names := make([]string, 0)
+	for _, tag := range templateTagExp.FindAllStringSubmatch(template, -1) {
+		for _, ref := range configRefExp.FindAllStringSubmatch(tag[1], -1) {
+			names = append(names, ref[1])
+		}
+	}
+	return names
+}
+
+// varResolver substitutes the values of variables into templates and keeps track of any undefined variables
+type varResolver struct {
+	config    *model.Config
+	undefined map[string]bool
+	failed    error
+}
+
+func newVarResolver(config *model.Config) *varResolver {
+	return &varResolver{config: config, undefined: make(map[string]bool)}
+}
+
+// check records any variables referenced by the template which are not defined
+func (r *varResolver) check(template string) {
+	for _, name := range findConfigRefs(template) {
+		if _, ok := r.config.LookupVar(name); !ok {
+			r.undefined[name] = true
+		}
+	}
+}
+
+// resolve expands the references to variables in the template. Templates which also reference inputs can only be
+// expanded when the rule runs, so within those just references like {{config.NAME}} are replaced and anything else is
+// left as it is.
+func (r *varResolver) resolve(template string) string {
+	r.check(template)
+	if len(findConfigRefs(template)) == 0 {
+		return template
+	}
+
+	if inputRefExp.MatchString(template) {
+		return simpleConfigRefExp.ReplaceAllStringFunc(template, func(ref string) string {
+			name := simpleConfigRefExp.FindStringSubmatch(ref)[1]
+			value, ok := r.config.LookupVar(name)
+			if !ok {
+				return ref
+			}
+			return value
+		})
+	}
+
+	// the values aren't HTML, so they shouldn't be escaped
+	compiled, err := pongo2.FromString("{% autoescape off %}" + template + "{% endautoescape %}")
+	if err != nil {
+		r.fail(fmt.Errorf("Invalid template %q: %s", template, err))
+		return template
+	}
+	result, err := compiled.Execute(pongo2.Context{"config": r.config.TemplateVars()})
+	if err != nil {
+		r.fail(fmt.Errorf("Could not expand %q: %s", template, err))
+		return template
+	}
+	return result
+}
+
+// fail records the first error expanding a template
+func (r *varResolver) fail(err error) {
+	if r.failed == nil {
+		r.failed = err
+	}
+}
+
+func (r *varResolver) err() error {
+	if len(r.undefined) == 0 {
+		return r.failed
+	}
+	names := make([]string, 0, len(r.undefined))
+	for name := range r.undefined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &UndefinedVariablesError{Names: names}
+}
@@ -73,6 +73,13 @@ func (ar *Bindings) Equals(other *Bindings) bool {
 		}
 		otherArtifacts := otherv.GetArtifacts()
 
+		if m, ok := v.(*MultipleArtifacts); ok {
+			otherm, ok := otherv.(*MultipleArtifacts)
+			if !ok || m.groupValue != otherm.groupValue {
+				return false
+			}
+		}
+
 		if !artifactListSame(artifacts, otherArtifacts) {
 			return false
 		}
@@ -6,6 +6,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/pgm/goconseq/graph"
 )
 
 type ArtifactProperties struct {
@@ -110,6 +112,21 @@ func (a *Artifact) HasProperties(props map[string]string) bool {
 	return true
 }
 
+// MatchesPredicates returns true if the artifact satisfies all of the predicates. Files are considered to be
+// present, but don't have a value which can be compared.
+func (a *Artifact) MatchesPredicates(predicates map[string]*graph.Predicate) bool {
+	for name, predicate := range predicates {
+		value, present := a.Properties.Strings[name]
+		if !present {
+			_, present = a.Properties.Files[name]
+		}
+		if !predicate.Matches(value, present) {
+			return false
+		}
+	}
+	return true
+}
+
 func (a *Artifact) PropertiesEqual(other *Artifact) bool {
 	if len(a.Properties.Strings) != len(other.Properties.Strings) {
 		return false
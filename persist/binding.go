@@ -23,17 +23,29 @@ var EmptyBinding = NewBindings()
 
 type MultipleArtifacts struct {
 	artifacts []*Artifact
+	// the value of the property the artifacts were grouped by, or "" if they weren't grouped
+	groupValue string
 }
 
 func (m *MultipleArtifacts) GetArtifacts() []*Artifact {
 	return m.artifacts
 }
 
+func (m *MultipleArtifacts) GetGroupValue() string {
+	return m.groupValue
+}
+
+// Hash depends only on which artifacts are bound and not the order they were found in, so that
+// the same group of artifacts hashes to the same value across runs
 func (m *MultipleArtifacts) Hash() string {
 	sb := strings.Builder{}
 	sb.WriteString("(")
-	for _, artifact := range m.artifacts {
-		sb.WriteString(strconv.Itoa(artifact.id))
+	if m.groupValue != "" {
+		sb.WriteString(escapeStr(m.groupValue))
+		sb.WriteString(":")
+	}
+	for _, id := range artifactsToSortedIDs(m.artifacts) {
+		sb.WriteString(strconv.Itoa(id))
 		sb.WriteString(",")
 	}
 	sb.WriteString(")")
@@ -45,7 +57,29 @@ type SingleArtifact struct {
 	MultipleArtifacts
 }
 
+// IsNull returns true if this is an optional input which no artifact matched
+func (s *SingleArtifact) IsNull() bool {
+	return len(s.artifacts) == 0
+}
+
 func (b *Bindings) Hash() string {
+	return b.hashValues(func(value BindingValue) string {
+		return value.Hash()
+	})
+}
+
+// Key is the same as Hash, except that grouped inputs are identified by their group value alone. Applications of a
+// rule with the same key are for the same row or group, even if a group has since gained or lost artifacts.
+func (b *Bindings) Key() string {
+	return b.hashValues(func(value BindingValue) string {
+		if m, ok := value.(*MultipleArtifacts); ok && m.groupValue != "" {
+			return "(" + escapeStr(m.groupValue) + ":)"
+		}
+		return value.Hash()
+	})
+}
+
+func (b *Bindings) hashValues(hash func(value BindingValue) string) string {
 	keys := make([]string, len(b.ByName))
 	i := 0
 	for name := range b.ByName {
@@ -59,35 +93,85 @@ func (b *Bindings) Hash() string {
 	for _, name := range keys {
 		sb.WriteString(escapeStr(name))
 		sb.WriteString(":")
-		value := b.ByName[name]
-		sb.WriteString(value.Hash())
+		sb.WriteString(hash(b.ByName[name]))
 		sb.WriteString(",")
 	}
 	sb.WriteString(")")
 	return sb.String()
 }
 
+// String describes the artifacts bound to each name, ordered by name
+func (b *Bindings) String() string {
+	names := make([]string, 0, len(b.ByName))
+	for name := range b.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		switch value := b.ByName[name].(type) {
+		case *SingleArtifact:
+			if value.IsNull() {
+				parts[i] = name + "=null"
+			} else {
+				parts[i] = name + "=" + value.artifacts[0].String()
+			}
+		case *MultipleArtifacts:
+			artifacts := make([]string, len(value.artifacts))
+			for j, artifact := range value.artifacts {
+				artifacts[j] = artifact.String()
+			}
+			if value.groupValue != "" {
+				name = name + "[" + value.groupValue + "]"
+			}
+			parts[i] = name + "=[" + strings.Join(artifacts, ", ") + "]"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
 func (b *Bindings) AddArtifacts(name string, artifacts []*Artifact) {
-	b.ByName[name] = &MultipleArtifacts{artifacts}
+	b.ByName[name] = &MultipleArtifacts{artifacts: artifacts}
+}
+
+// AddGroup binds name to the artifacts which all have groupValue for the property the input was grouped by
+func (b *Bindings) AddGroup(name string, groupValue string, artifacts []*Artifact) {
+	b.ByName[name] = &MultipleArtifacts{artifacts: artifacts, groupValue: groupValue}
 }
 
 func (b *Bindings) AddArtifact(name string, artifact *Artifact) {
-	b.ByName[name] = &SingleArtifact{MultipleArtifacts: MultipleArtifacts{[]*Artifact{artifact}}}
+	b.ByName[name] = &SingleArtifact{MultipleArtifacts: MultipleArtifacts{artifacts: []*Artifact{artifact}}}
+}
+
+func (b *Bindings) copy() *Bindings {
+	nb := NewBindings()
+	for k, v := range b.ByName {
+		nb.ByName[k] = v
+	}
+	return nb
+}
+
+// AddNull binds name to no artifact at all
+func (b *Bindings) AddNull(name string) {
+	b.ByName[name] = &SingleArtifact{}
 }
 
 func (b *Bindings) Transform(transform func(artifact *Artifact) *Artifact) *Bindings {
 	nb := NewBindings()
 	for name, value := range b.ByName {
 		s, ok := value.(*SingleArtifact)
-		if ok {
+		if ok && s.IsNull() {
+			nb.AddNull(name)
+		} else if ok {
 			nb.AddArtifact(name, transform(s.artifacts[0]))
 		} else {
-			sArtifacts := value.GetArtifacts()
-			artifacts := make([]*Artifact, len(sArtifacts))
-			for i, sArtifact := range sArtifacts {
+			m := value.(*MultipleArtifacts)
+			artifacts := make([]*Artifact, len(m.artifacts))
+			for i, sArtifact := range m.artifacts {
 				artifacts[i] = transform(sArtifact)
 			}
-			nb.AddArtifacts(name, artifacts)
+			nb.AddGroup(name, m.groupValue, artifacts)
 		}
 	}
 	return nb
@@ -5,6 +5,9 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
+
+	"github.com/pgm/goconseq/graph"
 )
 
 // stored types: Artifacts, AppliedRules
@@ -41,15 +44,8 @@ type DBOp interface {
 	GetType() string
 }
 
-func NewDB(stateDir string) *DB {
-	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
-		err = os.MkdirAll(stateDir, os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	db := &DB{
+func newDB(stateDir string) *DB {
+	return &DB{
 		nextID:                 1,
 		currentArtifacts:       make(map[int]*Artifact),
 		artifactHistoryByID:    make(map[int]*Artifact),
@@ -59,6 +55,17 @@ func NewDB(stateDir string) *DB {
 		files:                  make(map[int]*File),
 		// appliedRuleHistoryByHash: make(map[string]*AppliedRule),
 		stateDir: stateDir}
+}
+
+func NewDB(stateDir string) *DB {
+	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+		err = os.MkdirAll(stateDir, os.ModePerm)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	db := newDB(stateDir)
 
 	logPath := path.Join(stateDir, "db.journal")
 	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
@@ -74,6 +81,20 @@ func NewDB(stateDir string) *DB {
 	return db
 }
 
+// NewInMemoryDB loads the DB in stateDir, if there is one, but keeps any changes in memory instead of writing them
+// to the journal. The state directory is not created or modified.
+func NewInMemoryDB(stateDir string) *DB {
+	db := newDB(stateDir)
+
+	logPath := path.Join(stateDir, "db.journal")
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		db.loadFromJournal(logPath)
+	}
+
+	db.writer = &OpLogWriter{}
+	return db
+}
+
 func (db *DB) DisableUpdates() {
 	db.writer.disableWrites = true
 }
@@ -107,9 +128,13 @@ func (db *DB) GetNextApplicationID() int {
 	return ID
 }
 
+// WorkDir returns the directory in stateDir where the application is executed
+func WorkDir(stateDir string, appliedRuleID int) string {
+	return path.Join(stateDir, fmt.Sprintf("r%d", appliedRuleID))
+}
+
 func (db *DB) GetWorkDir(appliedRuleID int) string {
-	return path.Join(db.stateDir,
-		fmt.Sprintf("r%d", appliedRuleID))
+	return WorkDir(db.stateDir, appliedRuleID)
 }
 
 func (db *DB) GetHackCount() int {
@@ -215,6 +240,38 @@ func (db *DB) FindArtifacts(Properties map[string]string) []*Artifact {
 	return results
 }
 
+// FindArtifactsMatching searches among the current artifacts for those with the properties/values which also
+// satisfy the predicates
+func (db *DB) FindArtifactsMatching(Properties map[string]string, Predicates map[string]*graph.Predicate) []*Artifact {
+	results := make([]*Artifact, 0, 10)
+	for _, artifact := range db.currentArtifacts {
+		if artifact.HasProperties(Properties) && artifact.MatchesPredicates(Predicates) {
+			results = append(results, artifact)
+		}
+	}
+	return results
+}
+
+// PropertyNames returns the sorted names of the properties of every artifact which has been recorded
+func (db *DB) PropertyNames() []string {
+	names := make(map[string]bool)
+	for _, artifact := range db.artifactHistoryByID {
+		for name := range artifact.Properties.Strings {
+			names[name] = true
+		}
+		for name := range artifact.Properties.Files {
+			names[name] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
 func (db *DB) FindAllAppliedRules() []*AppliedRule {
 	result := make([]*AppliedRule, 0, len(db.currentAppliedRules))
 	for _, appliedRule := range db.currentAppliedRules {
@@ -292,20 +349,95 @@ func (db *DB) DeleteAppliedRule(ID int) error {
 	appsToDelete := []*AppliedRule{app}
 	appsToDelete = append(appsToDelete, db.FindApplicationsDownstreamOfApplication(app.ID)...)
 
-	for _, app = range appsToDelete {
+	db.deleteAppliedRules(appsToDelete)
+	return nil
+}
+
+// InvalidateAppliedRules deletes the applications in the history for which match returns true along with every
+// application downstream of them, so that they are executed again instead of being reused. Returns the deleted
+// applications sorted by ID.
+func (db *DB) InvalidateAppliedRules(match func(appliedRule *AppliedRule) bool) []*AppliedRule {
+	invalidated := make(map[int]*AppliedRule)
+	for _, appliedRule := range db.appliedRuleHistoryByID {
+		if match(appliedRule) {
+			invalidated[appliedRule.ID] = appliedRule
+		}
+	}
+
+	// an artifact which several of the invalidated applications produced is going away too, so keep adding the
+	// consumers of outputs which nothing outside of the set produces until there are no more
+	for added := true; added; {
+		added = false
+		for _, appliedRule := range invalidated {
+			for _, output := range appliedRule.Outputs {
+				if db.isProducedByOther(output, invalidated) {
+					continue
+				}
+				for _, consumer := range db.FindRuleApplicationsWithInput(output) {
+					if _, exists := invalidated[consumer.ID]; !exists {
+						invalidated[consumer.ID] = consumer
+						added = true
+					}
+				}
+			}
+		}
+	}
+
+	result := make([]*AppliedRule, 0, len(invalidated))
+	for _, appliedRule := range invalidated {
+		result = append(result, appliedRule)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	db.deleteAppliedRules(result)
+	return result
+}
+
+// deleteAppliedRules deletes the applications and their outputs in a single transaction. Outputs which are also
+// outputs of an application that isn't being deleted are kept.
+func (db *DB) deleteAppliedRules(appsToDelete []*AppliedRule) {
+	if len(appsToDelete) == 0 {
+		return
+	}
+
+	deleting := make(map[int]bool)
+	for _, app := range appsToDelete {
+		deleting[app.ID] = true
+	}
+	keep := make(map[int]bool)
+	for _, app := range db.appliedRuleHistoryByID {
+		if deleting[app.ID] {
+			continue
+		}
 		for _, artifact := range app.Outputs {
+			keep[artifact.id] = true
+		}
+	}
+
+	for _, app := range appsToDelete {
+		if _, exists := db.appliedRuleHistoryByID[app.ID]; !exists {
+			// already deleted because it was downstream of more than one application
+			continue
+		}
+		for _, artifact := range app.Outputs {
+			if keep[artifact.id] {
+				continue
+			}
+			keep[artifact.id] = true
 			db.writer.WriteDeleteArtifact(artifact.id).Update(db)
 		}
-		db.writer.WriteDeleteAppliedRule(app.ID)
+		db.writer.WriteDeleteAppliedRule(app.ID).Update(db)
 	}
 	db.writer.Commit()
-	return nil
 }
 
+// FindRuleApplicationsWithInput returns the applications in the history which consumed the artifact
 func (db *DB) FindRuleApplicationsWithInput(artifact *Artifact) []*AppliedRule {
 	appliedRules := make([]*AppliedRule, 0, 10)
 outerLoop:
-	for _, appliedRule := range db.currentAppliedRules {
+	for _, appliedRule := range db.appliedRuleHistoryByID {
 		for _, value := range appliedRule.Inputs.ByName {
 			for _, a := range value.GetArtifacts() {
 				if a.id == artifact.id {
@@ -330,18 +462,37 @@ func (db *DB) FindApplicationsDownstreamOfArtifact(artifact *Artifact) []*Applie
 }
 
 func (db *DB) FindApplicationsDownstreamOfApplication(appliedRuleID int) []*AppliedRule {
-	appliedRule, exists := db.currentAppliedRules[appliedRuleID]
+	appliedRule, exists := db.appliedRuleHistoryByID[appliedRuleID]
 	if !exists {
 		panic("Looked up missing appliedRuleID")
 	}
 	result := make([]*AppliedRule, 0)
 	for _, output := range appliedRule.Outputs {
+		// the consumers of an artifact which another application also produced don't depend on this one
+		if db.isProducedByOther(output, map[int]*AppliedRule{appliedRuleID: appliedRule}) {
+			continue
+		}
 		result = append(result, db.FindApplicationsDownstreamOfArtifact(output)...)
 	}
 
 	return result
 }
 
+// isProducedByOther returns true if an application which isn't in excluded also produced the artifact
+func (db *DB) isProducedByOther(artifact *Artifact, excluded map[int]*AppliedRule) bool {
+	for _, appliedRule := range db.appliedRuleHistoryByID {
+		if _, ok := excluded[appliedRule.ID]; ok {
+			continue
+		}
+		for _, output := range appliedRule.Outputs {
+			if output.id == artifact.id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (db *DB) AddFileOrFind(localPath, sha256 string) int {
 	for _, file := range db.files {
 		if file.SHA256 == sha256 {
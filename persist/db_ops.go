@@ -57,6 +57,18 @@ func (op *SetFileOp) GetType() string {
 	return "SetFile"
 }
 
+type DeleteFileOp struct {
+	FileID int
+}
+
+func (op *DeleteFileOp) Update(db *DB) {
+	delete(db.files, op.FileID)
+}
+
+func (op *DeleteFileOp) GetType() string {
+	return "DeleteFile"
+}
+
 type SetArtifactOp struct {
 	ID          int
 	StringProps []*ArtifactStringProp
@@ -105,9 +117,10 @@ type SetAppliedRuleOp struct {
 }
 
 type InputEntry struct {
-	Name      string
-	Singleton bool
-	Artifacts []int
+	Name       string
+	Singleton  bool
+	Artifacts  []int
+	GroupValue string `json:",omitempty"`
 }
 
 func (op *SetAppliedRuleOp) Update(db *DB) {
@@ -117,10 +130,12 @@ func (op *SetAppliedRuleOp) Update(db *DB) {
 		for i, artifactID := range input.Artifacts {
 			artifacts[i] = db.artifactHistoryByID[artifactID]
 		}
-		if input.Singleton {
+		if input.Singleton && len(artifacts) == 0 {
+			inputs.AddNull(input.Name)
+		} else if input.Singleton {
 			inputs.AddArtifact(input.Name, artifacts[0])
 		} else {
-			inputs.AddArtifacts(input.Name, artifacts)
+			inputs.AddGroup(input.Name, input.GroupValue, artifacts)
 		}
 	}
 
@@ -200,6 +215,13 @@ func (w *OpLogWriter) WriteSetFile(file *File) DBOp {
 	return &op
 }
 
+func (w *OpLogWriter) WriteDeleteFile(fileID int) DBOp {
+	op := DeleteFileOp{FileID: fileID}
+	w.write(&op)
+
+	return &op
+}
+
 func (w *OpLogWriter) WriteDeleteArtifact(artifactID int) DBOp {
 	op := DeleteArtifactOp{ID: artifactID}
 	w.write(&op)
@@ -217,10 +239,15 @@ func (w *OpLogWriter) WriteSetAppliedRule(rule *AppliedRule) DBOp {
 		for j, srcArtifact := range srcArtifacts {
 			artifacts[j] = srcArtifact.id
 		}
+		groupValue := ""
+		if m, ok := input.(*MultipleArtifacts); ok {
+			groupValue = m.groupValue
+		}
 		inputs[i] = &InputEntry{
-			Name:      name,
-			Singleton: singleton,
-			Artifacts: artifacts}
+			Name:       name,
+			Singleton:  singleton,
+			Artifacts:  artifacts,
+			GroupValue: groupValue}
 		i++
 	}
 
@@ -255,6 +282,9 @@ func (w *OpLogWriter) WriteDeleteAppliedRule(id int) DBOp {
 }
 
 func (w *OpLogWriter) Close() {
+	if w.file == nil {
+		return
+	}
 	err := w.file.Close()
 	if err != nil {
 		panic(err)
@@ -262,6 +292,10 @@ func (w *OpLogWriter) Close() {
 }
 
 func (w *OpLogWriter) Commit() {
+	// nothing can have been written since the last commit
+	if w.file == nil || w.disableWrites {
+		return
+	}
 	_, err := w.file.WriteString("commit\n")
 	if err != nil {
 		panic(err)
@@ -329,6 +363,9 @@ func unmarshalOp(input []byte) (DBOp, error) {
 	case "SetFile":
 		var op SetFileOp
 		return unmarshalAndCheck(body, &op)
+	case "DeleteFile":
+		var op DeleteFileOp
+		return unmarshalAndCheck(body, &op)
 	case "SetNextIDs":
 		var op SetNextIDsOp
 		return unmarshalAndCheck(body, &op)
@@ -339,6 +376,7 @@ func unmarshalOp(input []byte) (DBOp, error) {
 	panic("not reachable")
 }
 
+// OpLogWriter appends operations to the journal. A writer without a file discards them.
 type OpLogWriter struct {
 	file          *os.File
 	disableWrites bool
@@ -363,6 +401,9 @@ func (w *OpLogWriter) write(x DBOp) {
 	if w.disableWrites {
 		panic("writes disabled")
 	}
+	if w.file == nil {
+		return
+	}
 	env := Envelope{Type: x.GetType(), Body: x}
 	buf, err := json.Marshal(&env)
 	if err != nil {
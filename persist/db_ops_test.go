@@ -2,6 +2,7 @@ package persist
 
 import (
 	"io/ioutil"
+	"os"
 	"path"
 	"testing"
 
@@ -93,3 +94,30 @@ func TestWriteSetAppliedRuleOp(t *testing.T) {
 		assert.Equal(t, 2, len(op.Inputs))
 	})
 }
+
+func TestWriteDeleteFileOp(t *testing.T) {
+	verifyOp(t, func(w *OpLogWriter) {
+		w.WriteDeleteFile(12)
+	}, func(ops []DBOp) {
+		assert.Equal(t, 1, len(ops))
+		op := ops[0].(*DeleteFileOp)
+		assert.Equal(t, 12, op.FileID)
+	})
+}
+
+func TestCommitWithWritesDisabled(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	logPath := path.Join(stateDir, "log")
+	w, err := OpenLogWriter(logPath)
+	assert.Nil(t, err)
+	w.disableWrites = true
+	w.Commit()
+	w.Close()
+
+	content, err := ioutil.ReadFile(logPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(content))
+}
@@ -1,11 +1,15 @@
 package persist
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"testing"
 
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/model"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,6 +39,261 @@ func TestAddFiles(t *testing.T) {
 	db.Close()
 }
 
+func TestQueryWithPredicates(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+	defer db.Close()
+
+	sample1, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "sample_1", "status": "ok"}})
+	sample2, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "sample_2", "status": "failed"}})
+	other, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "other"}, Files: map[string]int{"bam": 1}})
+	app, err := db.PersistAppliedRule(db.GetNextApplicationID(), "init", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(app.ID, []*Artifact{sample1, sample2, other}))
+
+	predicate := func(op string, value string) *graph.Predicate {
+		p, err := graph.NewPredicate(op, value)
+		assert.Nil(t, err)
+		return p
+	}
+	findIDs := func(predicates map[string]*graph.Predicate) []int {
+		query, err := QueryFromMaps(map[string]*model.InputQuery{"s": &model.InputQuery{
+			IsAll:      true,
+			Properties: map[string]string{"type": "sample"},
+			Predicates: predicates}})
+		assert.Nil(t, err)
+		ids := make([]int, 0)
+		for _, artifact := range ExecuteQuery(db, query)[0].ByName["s"].GetArtifacts() {
+			ids = append(ids, artifact.id)
+		}
+		sort.Ints(ids)
+		return ids
+	}
+
+	assert.Equal(t, []int{sample1.id, sample2.id}, findIDs(map[string]*graph.Predicate{"name": predicate(graph.OpRegex, "^sample_[0-9]+$")}))
+	assert.Equal(t, []int{sample1.id, other.id}, findIDs(map[string]*graph.Predicate{"status": predicate(graph.OpNotEquals, "failed")}))
+	assert.Equal(t, []int{sample1.id, sample2.id}, findIDs(map[string]*graph.Predicate{"status": predicate(graph.OpExists, "")}))
+	assert.Equal(t, []int{other.id}, findIDs(map[string]*graph.Predicate{"status": predicate(graph.OpMissing, "")}))
+	assert.Equal(t, []int{other.id}, findIDs(map[string]*graph.Predicate{"bam": predicate(graph.OpExists, "")}))
+}
+
+func TestOptionalAndNegatedQuery(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	dir := path.Join(stateDir, "db")
+	db := NewDB(dir)
+
+	joe, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "joe"}})
+	steve, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "steve"}})
+	ann, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "ann"}})
+	joeQC, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "qc", "name": "joe"}})
+	steveExclude, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "exclude", "name": "steve"}})
+	app, err := db.PersistAppliedRule(db.GetNextApplicationID(), "init", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(app.ID, []*Artifact{joe, steve, ann, joeQC, steveExclude}))
+
+	query := &Query{
+		forEach: []*QueryBinding{
+			&QueryBinding{
+				bindingVariable:        "sample",
+				constantConstraints:    map[string]string{"type": "sample"},
+				placeholderAssignments: []StringPair{StringPair{"name", "NAME"}}}},
+		optional: []*QueryBinding{
+			&QueryBinding{
+				bindingVariable:        "qc",
+				constantConstraints:    map[string]string{"type": "qc"},
+				placeholderConstraints: []StringPair{StringPair{"name", "NAME"}}}},
+		negated: []*QueryBinding{
+			&QueryBinding{
+				bindingVariable:        "exclude",
+				constantConstraints:    map[string]string{"type": "exclude"},
+				placeholderConstraints: []StringPair{StringPair{"name", "NAME"}}}}}
+
+	qcBySample := make(map[int]BindingValue)
+	for _, binding := range ExecuteQuery(db, query) {
+		_, hasExclude := binding.ByName["exclude"]
+		assert.False(t, hasExclude)
+		qcBySample[binding.ByName["sample"].GetArtifacts()[0].id] = binding.ByName["qc"]
+	}
+	assert.Equal(t, 2, len(qcBySample))
+	assert.Equal(t, []*Artifact{joeQC}, qcBySample[joe.id].GetArtifacts())
+	assert.True(t, qcBySample[ann.id].(*SingleArtifact).IsNull())
+
+	// verify a null binding survives reopening the DB
+	inputs := NewBindings()
+	inputs.AddArtifact("sample", ann)
+	inputs.AddNull("qc")
+	annApp, err := db.PersistAppliedRule(db.GetNextApplicationID(), "process", "hash2", inputs, "")
+	assert.Nil(t, err)
+	db.Close()
+
+	db = NewDB(dir)
+	defer db.Close()
+	reloaded := db.appliedRuleHistoryByID[annApp.ID].Inputs
+	assert.Equal(t, inputs.Hash(), reloaded.Hash())
+	assert.True(t, reloaded.ByName["qc"].(*SingleArtifact).IsNull())
+}
+
+func TestGroupedQuery(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	dir := path.Join(stateDir, "db")
+	db := NewDB(dir)
+
+	bam1, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "bam", "name": "1", "batch": "a"}})
+	bam2, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "bam", "name": "2", "batch": "b"}})
+	bam3, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "bam", "name": "3", "batch": "a"}})
+	bam4, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "bam", "name": "4"}})
+	app, err := db.PersistAppliedRule(db.GetNextApplicationID(), "init", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(app.ID, []*Artifact{bam1, bam2, bam3, bam4}))
+
+	query, err := QueryFromMaps(map[string]*model.InputQuery{"bams": &model.InputQuery{
+		IsAll:      true,
+		GroupBy:    "batch",
+		Properties: map[string]string{"type": "bam"}}})
+	assert.Nil(t, err)
+	bindings := ExecuteQuery(db, query)
+	assert.Equal(t, 2, len(bindings))
+	assert.Equal(t, "a", bindings[0].ByName["bams"].(*MultipleArtifacts).GetGroupValue())
+	assert.ElementsMatch(t, []*Artifact{bam1, bam3}, bindings[0].ByName["bams"].GetArtifacts())
+	assert.Equal(t, "b", bindings[1].ByName["bams"].(*MultipleArtifacts).GetGroupValue())
+	assert.Equal(t, []*Artifact{bam2}, bindings[1].ByName["bams"].GetArtifacts())
+
+	// the hash shouldn't depend on the order the artifacts were found in
+	reversed := NewBindings()
+	reversed.AddGroup("bams", "a", []*Artifact{bam3, bam1})
+	assert.Equal(t, bindings[0].Hash(), reversed.Hash())
+
+	groupApp, err := db.PersistAppliedRule(db.GetNextApplicationID(), "merge", "hash", bindings[0], "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(groupApp.ID, []*Artifact{}))
+	db.Close()
+
+	// after reopening, the same group should be found in the history but not a different one
+	db = NewDB(dir)
+	defer db.Close()
+	assert.NotNil(t, db.GetAppliedRuleFromHistory("merge", "hash", bindings[0]))
+	assert.Nil(t, db.GetAppliedRuleFromHistory("merge", "hash", bindings[1]))
+}
+
+func TestBindingsKeyIgnoresGroupMembers(t *testing.T) {
+	before := NewBindings()
+	before.AddGroup("bams", "a", []*Artifact{&Artifact{id: 1}})
+	after := NewBindings()
+	after.AddGroup("bams", "a", []*Artifact{&Artifact{id: 1}, &Artifact{id: 2}})
+	other := NewBindings()
+	other.AddGroup("bams", "b", []*Artifact{&Artifact{id: 1}})
+
+	assert.NotEqual(t, before.Hash(), after.Hash())
+	assert.Equal(t, before.Key(), after.Key())
+	assert.NotEqual(t, before.Key(), other.Key())
+}
+
+func TestQueryFromMapsOrdersBindings(t *testing.T) {
+	inputs := map[string]*model.InputQuery{
+		"c": &model.InputQuery{Properties: map[string]string{"type": "c"}},
+		"a": &model.InputQuery{Properties: map[string]string{"type": "a"}},
+		"b": &model.InputQuery{Properties: map[string]string{"type": "b"}},
+		"e": &model.InputQuery{Properties: map[string]string{"type": "e"}, IsOptional: true},
+		"d": &model.InputQuery{Properties: map[string]string{"type": "d"}, IsOptional: true}}
+
+	bindingNames := func(bindings []*QueryBinding) []string {
+		names := make([]string, len(bindings))
+		for i, binding := range bindings {
+			names[i] = binding.bindingVariable
+		}
+		return names
+	}
+
+	// map iteration order varies, so build the query a few times
+	for i := 0; i < 10; i++ {
+		query, err := QueryFromMaps(inputs)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a", "b", "c"}, bindingNames(query.forEach))
+		assert.Equal(t, []string{"d", "e"}, bindingNames(query.optional))
+	}
+}
+
+func TestRuleHashIsUnchanged(t *testing.T) {
+	// the hashes of rules which don't use any of the newer kinds of input must stay the same, otherwise none of
+	// their previous applications would be reused
+	query, err := QueryFromMaps(map[string]*model.InputQuery{"bam": &model.InputQuery{Properties: map[string]string{"type": "bam"}}})
+	assert.Nil(t, err)
+	rule := &model.Rule{Name: "count", Query: query,
+		Outputs: []model.RuleOutput{model.RuleOutput{Properties: []model.RuleOutputProperty{{Name: "type", Value: "count"}}}}}
+	assert.Equal(t, `{"name":"count","outputs":[[{"IsFilename":false,"Name":"type","Value":"count"}]],"query":{"forAll":[],"forEach":[{"bindingVariable":"bam","constantConstraints":{"type":"bam"}}]}}`, rule.Hash())
+
+	query, err = QueryFromMaps(map[string]*model.InputQuery{})
+	assert.Nil(t, err)
+	rule = &model.Rule{Name: "gen", Query: query}
+	assert.Equal(t, `{"name":"gen","outputs":[],"query":{"forAll":[],"forEach":[]}}`, rule.Hash())
+}
+
+func TestQueryWithInputReferences(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+	defer db.Close()
+
+	sample1, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "1"}})
+	sample2, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "sample", "name": "2"}})
+	qc2, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "qc", "sample": "2"}})
+	exclude1, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "exclude", "sample": "1"}})
+	app, err := db.PersistAppliedRule(db.GetNextApplicationID(), "init", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(app.ID, []*Artifact{sample1, sample2, qc2, exclude1}))
+
+	query, err := QueryFromMaps(map[string]*model.InputQuery{
+		"s": &model.InputQuery{Properties: map[string]string{"type": "sample"}},
+		"qc": &model.InputQuery{IsOptional: true,
+			Properties: map[string]string{"type": "qc", "sample": "{{inputs.s.name}}"}},
+		"excluded": &model.InputQuery{IsNegated: true,
+			Properties: map[string]string{"type": "exclude", "sample": "{{ inputs.s.name }}"}}})
+	assert.Nil(t, err)
+
+	// sample 1 is excluded and only sample 2 has a qc artifact
+	bindings := ExecuteQuery(db, query)
+	assert.Equal(t, 1, len(bindings))
+	assert.Equal(t, []*Artifact{sample2}, bindings[0].ByName["s"].GetArtifacts())
+	assert.Equal(t, []*Artifact{qc2}, bindings[0].ByName["qc"].GetArtifacts())
+
+	// without the exclusion, sample 1 is bound without a qc artifact
+	query, err = QueryFromMaps(map[string]*model.InputQuery{
+		"s": &model.InputQuery{Properties: map[string]string{"type": "sample"}},
+		"qc": &model.InputQuery{IsOptional: true,
+			Properties: map[string]string{"type": "qc", "sample": "{{inputs.s.name}}"}}})
+	assert.Nil(t, err)
+	bindings = ExecuteQuery(db, query)
+	assert.Equal(t, 2, len(bindings))
+	for _, binding := range bindings {
+		sample := binding.ByName["s"].GetArtifacts()[0]
+		if sample == sample1 {
+			assert.True(t, binding.ByName["qc"].(*SingleArtifact).IsNull())
+		} else {
+			assert.Equal(t, []*Artifact{qc2}, binding.ByName["qc"].GetArtifacts())
+		}
+	}
+
+	_, err = QueryFromMaps(map[string]*model.InputQuery{
+		"qc": &model.InputQuery{Properties: map[string]string{"type": "qc", "sample": "{{inputs.s.name}}"}}})
+	assert.NotNil(t, err)
+
+	_, err = QueryFromMaps(map[string]*model.InputQuery{
+		"a": &model.InputQuery{Properties: map[string]string{"name": "{{inputs.b.name}}"}},
+		"b": &model.InputQuery{Properties: map[string]string{"name": "{{inputs.a.name}}"}}})
+	assert.NotNil(t, err)
+}
+
 func TestJoinedQuery(t *testing.T) {
 	stateDir, err := ioutil.TempDir("", t.Name())
 	assert.Nil(t, err)
@@ -169,6 +428,89 @@ func TestFindRuleApplicationsWithInput(t *testing.T) {
 	assert.Equal(t, 0, len(apps))
 }
 
+func TestInvalidateAppliedRules(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	dir := path.Join(stateDir, "db")
+	db := NewDB(dir)
+
+	joe, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"name": "joe"}})
+	greeting, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"greeting": "hi joe"}})
+
+	genID := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(genID, "gen", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(genID, []*Artifact{joe}))
+
+	bindings := NewBindings()
+	bindings.AddArtifact("person", joe)
+	greetID := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(greetID, "greet", "hash", bindings, "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(greetID, []*Artifact{greeting}))
+	db.Close()
+
+	// after reopening, the applications are only in the history
+	db = NewDB(dir)
+	invalidated := db.InvalidateAppliedRules(func(appliedRule *AppliedRule) bool {
+		return appliedRule.Name == "gen"
+	})
+	assert.Equal(t, 2, len(invalidated))
+	assert.Equal(t, genID, invalidated[0].ID)
+	assert.Equal(t, greetID, invalidated[1].ID)
+	db.Close()
+
+	db = NewDB(dir)
+	defer db.Close()
+	assert.Nil(t, db.GetAppliedRule(genID))
+	assert.Nil(t, db.GetAppliedRule(greetID))
+	assert.Nil(t, db.GetArtifactFromHistory(joe.Properties))
+	assert.Nil(t, db.GetArtifactFromHistory(greeting.Properties))
+}
+
+func TestInvalidateAppliedRulesWithSharedOutput(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	// two applications in different runs produce the same artifact, so each looks like it isn't the only producer
+	producerIDs := make([]int, 2)
+	var shared *Artifact
+	for i := range producerIDs {
+		db := NewDB(stateDir)
+		if shared == nil {
+			shared, _ = db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"name": "shared"}})
+		} else {
+			shared = db.GetArtifactFromHistory(shared.Properties)
+		}
+		producerIDs[i] = db.GetNextApplicationID()
+		_, err = db.PersistAppliedRule(producerIDs[i], "gen", fmt.Sprintf("hash%d", i), NewBindings(), "")
+		assert.Nil(t, err)
+		assert.Nil(t, db.UpdateAppliedRuleComplete(producerIDs[i], []*Artifact{shared}))
+		db.Close()
+	}
+
+	db := NewDB(stateDir)
+	defer db.Close()
+	bindings := NewBindings()
+	bindings.AddArtifact("in", shared)
+	consumerID := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(consumerID, "use", "hash", bindings, "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(consumerID, []*Artifact{}))
+
+	// invalidating both producers removes the artifact, so its consumer must go too
+	invalidated := db.InvalidateAppliedRules(func(appliedRule *AppliedRule) bool {
+		return appliedRule.Name == "gen"
+	})
+	assert.Equal(t, 3, len(invalidated))
+	assert.Equal(t, consumerID, invalidated[2].ID)
+	assert.Nil(t, db.GetAppliedRule(consumerID))
+	assert.Nil(t, db.GetArtifactFromHistory(shared.Properties))
+}
+
 func TestSimpleQuery(t *testing.T) {
 	stateDir, err := ioutil.TempDir("", t.Name())
 	assert.Nil(t, err)
@@ -226,3 +568,85 @@ func TestSimpleQuery(t *testing.T) {
 	assert.Equal(t, 2, len(db.artifactHistoryByID))
 	assert.Equal(t, 2, len(db.artifactHistoryByHash))
 }
+
+func TestGetProvenance(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+	defer db.Close()
+
+	source, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "source"}})
+	appID := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(appID, "<artifact rule>", "hash1", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(appID, []*Artifact{source}))
+
+	derived, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "derived"}})
+	bindings := NewBindings()
+	bindings.AddArtifact("src", source)
+	appID = db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(appID, "derive", "hash2", bindings, "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(appID, []*Artifact{derived}))
+
+	p := db.GetProvenance(derived)
+	assert.Equal(t, derived.GetID(), p.ArtifactID)
+	assert.Equal(t, "derived", p.Properties["type"])
+	assert.Equal(t, "derive", p.ProducedBy.Name)
+	assert.Equal(t, "hash2", p.ProducedBy.Hash)
+	assert.Equal(t, db.GetWorkDir(appID), p.ProducedBy.WorkDir)
+	assert.Equal(t, 1, len(p.ProducedBy.Inputs["src"]))
+
+	upstream := p.ProducedBy.Inputs["src"][0]
+	assert.Equal(t, source.GetID(), upstream.ArtifactID)
+	assert.Equal(t, "<artifact rule>", upstream.ProducedBy.Name)
+	assert.Equal(t, 0, len(upstream.ProducedBy.Inputs))
+}
+
+func TestInstanceDiagram(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+	defer db.Close()
+
+	source, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "source"}})
+	appID := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(appID, "make", "hash1", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(appID, []*Artifact{source}))
+
+	bindings := NewBindings()
+	bindings.AddArtifacts("srcs", []*Artifact{source})
+	appID2 := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(appID2, "summarize", "hash2", bindings, "{\"pid\": 1}")
+	assert.Nil(t, err)
+	db.AddAppliedRuleToCurrent(appID2)
+
+	d := db.InstanceDiagram()
+	assert.Equal(t, 3, len(d.Nodes))
+	assert.Equal(t, graph.StateComplete, d.GetNode(fmt.Sprintf("r%d", appID)).State)
+	assert.Equal(t, graph.StatePending, d.GetNode(fmt.Sprintf("r%d", appID2)).State)
+
+	artifactNode := d.GetNode(fmt.Sprintf("artifact_%d", source.GetID()))
+	assert.Equal(t, graph.StateCurrent, artifactNode.State)
+	assert.Equal(t, "type: source", artifactNode.Label)
+
+	assert.Equal(t, 2, len(d.Edges))
+	assert.True(t, d.Edges[1].IsAll)
+}
+
+func TestConsumesAnySkipsDeletedInputs(t *testing.T) {
+	artifact := &Artifact{id: 1, Properties: NewArtifactProperties()}
+	// inputs which have been deleted are replayed as nil
+	inputs := NewBindings()
+	inputs.AddArtifact("deleted", nil)
+	inputs.AddArtifacts("all", []*Artifact{nil, artifact})
+	appliedRule := &AppliedRule{ID: 1, Name: "r", Inputs: inputs}
+
+	assert.True(t, consumesAny(appliedRule, map[int]*Artifact{1: artifact}))
+	assert.False(t, consumesAny(appliedRule, map[int]*Artifact{2: &Artifact{id: 2}}))
+}
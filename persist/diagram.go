@@ -0,0 +1,101 @@
+package persist
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pgm/goconseq/graph"
+)
+
+func artifactNodeID(artifact *Artifact) string {
+	return fmt.Sprintf("artifact_%d", artifact.GetID())
+}
+
+func appliedRuleNodeID(appliedRule *AppliedRule) string {
+	return fmt.Sprintf("r%d", appliedRule.ID)
+}
+
+func artifactLabel(props map[string]string) string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + ": " + props[name]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// InstanceDiagram creates a diagram of the applied rules in the current run and the artifacts they consumed and
+// produced. Applied rules are marked as complete or pending, and artifacts as current or stale.
+func (db *DB) InstanceDiagram() *graph.Diagram {
+	appliedRules := db.FindAllAppliedRules()
+	sort.Slice(appliedRules, func(i, j int) bool {
+		return appliedRules[i].ID < appliedRules[j].ID
+	})
+
+	current := make(map[int]bool)
+	for _, artifact := range db.FindArtifacts(map[string]string{}) {
+		current[artifact.GetID()] = true
+	}
+
+	d := graph.NewDiagram()
+	addArtifact := func(artifact *Artifact) string {
+		props := artifact.Properties.ToStrMap(func(fileID int) string {
+			file := db.GetFile(fileID)
+			if file == nil {
+				return fmt.Sprintf("<file %d>", fileID)
+			}
+			return path.Base(file.LocalPath)
+		})
+		state := graph.StateStale
+		if current[artifact.GetID()] {
+			state = graph.StateCurrent
+		}
+		node := d.AddNode(&graph.DiagramNode{ID: artifactNodeID(artifact),
+			Kind:       graph.ArtifactNode,
+			Label:      artifactLabel(props),
+			State:      state,
+			Properties: props})
+		return node.ID
+	}
+
+	for _, appliedRule := range appliedRules {
+		// the resume state is cleared once the outputs have been recorded
+		state := graph.StateComplete
+		if appliedRule.ResumeState != "" {
+			state = graph.StatePending
+		}
+		ruleID := d.AddNode(&graph.DiagramNode{ID: appliedRuleNodeID(appliedRule),
+			Kind:       graph.RuleNode,
+			Label:      fmt.Sprintf("%s (r%d)", appliedRule.Name, appliedRule.ID),
+			State:      state,
+			Properties: map[string]string{"name": appliedRule.Name}}).ID
+
+		names := make([]string, 0, len(appliedRule.Inputs.ByName))
+		for name := range appliedRule.Inputs.ByName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			_, isAll := appliedRule.Inputs.ByName[name].(*MultipleArtifacts)
+			for _, input := range appliedRule.Inputs.ByName[name].GetArtifacts() {
+				if input == nil {
+					continue
+				}
+				d.AddEdge(addArtifact(input), ruleID, isAll)
+			}
+		}
+
+		for _, output := range appliedRule.Outputs {
+			d.AddEdge(ruleID, addArtifact(output), false)
+		}
+	}
+
+	return d
+}
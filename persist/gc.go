@@ -0,0 +1,245 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OrphanedRuleName is the name used when reporting disk usage of work directories which
+// no longer belong to any applied rule (ie: failed or deleted applications)
+const OrphanedRuleName = "<orphaned>"
+
+var workDirExp = regexp.MustCompile("^r([0-9]+)$")
+
+// FailureFileName is written to the work dir of an application which failed, so that its logs can be told apart
+// from those of applications which were deleted for other reasons
+const FailureFileName = "failure.txt"
+
+type RuleDiskUsage struct {
+	Name         string
+	Applications int
+	Bytes        int64
+}
+
+type GCPlan struct {
+	// disk usage of every work dir, grouped by the name of the rule which created it
+	Usage []*RuleDiskUsage
+	// work dirs which don't belong to any applied rule in the history
+	OrphanedWorkDirs []string
+	// work dirs of failed applications which will be emptied except for their logs
+	FailedWorkDirs []string
+	// work dirs which don't belong to any applied rule but are kept, either because they contain files which are
+	// still referenced or because they only contain the logs of a failed application. Files are shared by every
+	// artifact with the same content, so a later application may have produced an artifact using a file left behind
+	// by a deleted one.
+	RetainedWorkDirs []string
+	// bytes which will be reclaimed by removing OrphanedWorkDirs and emptying FailedWorkDirs
+	OrphanedBytes int64
+	// files which are not referenced by any artifact
+	UnreferencedFiles []*File
+}
+
+func diskUsage(root string) int64 {
+	var total int64
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func isWithinDir(dir string, filename string) bool {
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// PlanGC compares the work dirs in the state directory and the files in the DB against the applied rules and
+// artifacts in the history to determine what is no longer referenced. If keepFailedLogs is set, the logs in the
+// work dirs of failed applications are kept. Nothing is modified.
+func (db *DB) PlanGC(keepFailedLogs bool) (*GCPlan, error) {
+	entries, err := ioutil.ReadDir(db.stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[int]bool)
+	referencedPaths := make([]string, 0)
+	for _, artifact := range db.artifactHistoryByID {
+		for _, fileID := range artifact.Properties.Files {
+			if file, ok := db.files[fileID]; ok && !referenced[fileID] && file.LocalPath != "" {
+				// compare absolute paths, as files may have been recorded either way
+				if localPath, err := filepath.Abs(file.LocalPath); err == nil {
+					referencedPaths = append(referencedPaths, localPath)
+				}
+			}
+			referenced[fileID] = true
+		}
+	}
+	containsReferencedFile := func(workDir string) bool {
+		workDir, err := filepath.Abs(workDir)
+		if err != nil {
+			// err on the side of keeping the work dir
+			return true
+		}
+		for _, localPath := range referencedPaths {
+			if isWithinDir(workDir, localPath) {
+				return true
+			}
+		}
+		return false
+	}
+
+	plan := &GCPlan{}
+	usageByName := make(map[string]*RuleDiskUsage)
+	addUsage := func(name string, bytes int64) {
+		usage, ok := usageByName[name]
+		if !ok {
+			usage = &RuleDiskUsage{Name: name}
+			usageByName[name] = usage
+		}
+		usage.Applications++
+		usage.Bytes += bytes
+	}
+
+	for _, entry := range entries {
+		m := workDirExp.FindStringSubmatch(entry.Name())
+		if m == nil || !entry.IsDir() {
+			continue
+		}
+		ID, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, err
+		}
+
+		workDir := path.Join(db.stateDir, entry.Name())
+		bytes := diskUsage(workDir)
+		if appliedRule, ok := db.appliedRuleHistoryByID[ID]; ok {
+			addUsage(appliedRule.Name, bytes)
+		} else if containsReferencedFile(workDir) {
+			addUsage(OrphanedRuleName, bytes)
+			plan.RetainedWorkDirs = append(plan.RetainedWorkDirs, workDir)
+		} else if keepFailedLogs && isFailedWorkDir(workDir) {
+			addUsage(OrphanedRuleName, bytes)
+			logBytes, onlyLogs, err := logUsage(workDir)
+			if err != nil {
+				return nil, err
+			}
+			if onlyLogs {
+				plan.RetainedWorkDirs = append(plan.RetainedWorkDirs, workDir)
+			} else {
+				plan.FailedWorkDirs = append(plan.FailedWorkDirs, workDir)
+				plan.OrphanedBytes += bytes - logBytes
+			}
+		} else {
+			addUsage(OrphanedRuleName, bytes)
+			plan.OrphanedWorkDirs = append(plan.OrphanedWorkDirs, workDir)
+			plan.OrphanedBytes += bytes
+		}
+	}
+
+	for fileID, file := range db.files {
+		if !referenced[fileID] {
+			plan.UnreferencedFiles = append(plan.UnreferencedFiles, file)
+		}
+	}
+
+	for _, usage := range usageByName {
+		plan.Usage = append(plan.Usage, usage)
+	}
+	sort.Slice(plan.Usage, func(i, j int) bool {
+		return plan.Usage[i].Name < plan.Usage[j].Name
+	})
+	sort.Strings(plan.OrphanedWorkDirs)
+	sort.Strings(plan.FailedWorkDirs)
+	sort.Strings(plan.RetainedWorkDirs)
+	sort.Slice(plan.UnreferencedFiles, func(i, j int) bool {
+		return plan.UnreferencedFiles[i].FileID < plan.UnreferencedFiles[j].FileID
+	})
+
+	return plan, nil
+}
+
+// names of the files which are kept in the work dirs of failed applications when keepFailedLogs is set
+var logFileNames = map[string]bool{"stdout.txt": true, "stderr.txt": true, FailureFileName: true}
+
+func isFailedWorkDir(workDir string) bool {
+	_, err := os.Stat(path.Join(workDir, FailureFileName))
+	return err == nil
+}
+
+// logUsage returns the size of the logs in the work dir and whether there is anything else in it
+func logUsage(workDir string) (int64, bool, error) {
+	entries, err := ioutil.ReadDir(workDir)
+	if err != nil {
+		return 0, false, err
+	}
+	var bytes int64
+	onlyLogs := true
+	for _, entry := range entries {
+		if logFileNames[entry.Name()] && !entry.IsDir() {
+			bytes += entry.Size()
+		} else {
+			onlyLogs = false
+		}
+	}
+	return bytes, onlyLogs, nil
+}
+
+func removeAllExceptLogs(workDir string) error {
+	entries, err := ioutil.ReadDir(workDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if logFileNames[entry.Name()] {
+			continue
+		}
+		err = os.RemoveAll(path.Join(workDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExecuteGC removes the orphaned work dirs and unreferenced files identified by PlanGC, and everything but the logs
+// in the work dirs of failed applications. Unreferenced files are removed from the DB, but only deleted from disk if
+// they reside within the state directory.
+func (db *DB) ExecuteGC(plan *GCPlan) error {
+	for _, workDir := range plan.OrphanedWorkDirs {
+		err := os.RemoveAll(workDir)
+		if err != nil {
+			return err
+		}
+	}
+	for _, workDir := range plan.FailedWorkDirs {
+		err := removeAllExceptLogs(workDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range plan.UnreferencedFiles {
+		if file.LocalPath != "" && isWithinDir(db.stateDir, file.LocalPath) {
+			err := os.Remove(file.LocalPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		db.writer.WriteDeleteFile(file.FileID).Update(db)
+	}
+	db.writer.Commit()
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, filename string, content string) {
+	err := ioutil.WriteFile(filename, []byte(content), os.ModePerm)
+	assert.Nil(t, err)
+}
+
+func TestGC(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+
+	// a successful application whose output references a file in its work dir
+	liveID := db.GetNextApplicationID()
+	liveDir := db.GetWorkDir(liveID)
+	os.MkdirAll(liveDir, os.ModePerm)
+	liveFilename := path.Join(liveDir, "out")
+	writeTestFile(t, liveFilename, "live")
+	liveFileID := db.AddFileOrFind(liveFilename, "sha-live")
+	props := NewArtifactProperties()
+	props.Files["filename"] = liveFileID
+	artifact, _ := db.PersistArtifact(props)
+	_, err = db.PersistAppliedRule(liveID, "live", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(liveID, []*Artifact{artifact}))
+
+	// a failed application which was deleted, leaving its work dir and a file behind
+	failedID := db.GetNextApplicationID()
+	failedDir := db.GetWorkDir(failedID)
+	os.MkdirAll(failedDir, os.ModePerm)
+	writeTestFile(t, path.Join(failedDir, "stderr.txt"), "error")
+	writeTestFile(t, path.Join(failedDir, FailureFileName), "failed")
+	writeTestFile(t, path.Join(failedDir, "partial"), "partial")
+	failedFileID := db.AddFileOrFind(path.Join(failedDir, "partial"), "sha-failed")
+	_, err = db.PersistAppliedRule(failedID, "failed", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	db.AddAppliedRuleToCurrent(failedID)
+	assert.Nil(t, db.DeleteAppliedRule(failedID))
+
+	// an application which succeeded but was deleted later, so its logs aren't worth keeping
+	deletedID := db.GetNextApplicationID()
+	deletedDir := db.GetWorkDir(deletedID)
+	os.MkdirAll(deletedDir, os.ModePerm)
+	writeTestFile(t, path.Join(deletedDir, "stderr.txt"), "ok")
+	_, err = db.PersistAppliedRule(deletedID, "deleted", "hash", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(deletedID, []*Artifact{}))
+	assert.Nil(t, db.DeleteAppliedRule(deletedID))
+
+	plan, err := db.PlanGC(true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{deletedDir}, plan.OrphanedWorkDirs)
+	assert.Equal(t, []string{failedDir}, plan.FailedWorkDirs)
+	assert.Equal(t, int64(len("ok")+len("partial")), plan.OrphanedBytes)
+	assert.Equal(t, 1, len(plan.UnreferencedFiles))
+	assert.Equal(t, failedFileID, plan.UnreferencedFiles[0].FileID)
+	assert.Equal(t, 2, len(plan.Usage))
+	assert.Equal(t, OrphanedRuleName, plan.Usage[0].Name)
+	assert.Equal(t, 2, plan.Usage[0].Applications)
+	assert.Equal(t, "live", plan.Usage[1].Name)
+	assert.Equal(t, int64(len("live")), plan.Usage[1].Bytes)
+
+	assert.Nil(t, db.ExecuteGC(plan))
+
+	// the logs should be kept, but everything else in the failed dir should be gone
+	_, err = os.Stat(path.Join(failedDir, "stderr.txt"))
+	assert.Nil(t, err)
+	_, err = os.Stat(path.Join(failedDir, "partial"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(deletedDir)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(liveFilename)
+	assert.Nil(t, err)
+	db.Close()
+
+	// verify the file deletion was persisted
+	db = NewDB(stateDir)
+	defer db.Close()
+	assert.Nil(t, db.GetFile(failedFileID))
+	assert.NotNil(t, db.GetFile(liveFileID))
+
+	// the logs which were kept aren't reported as something to remove again
+	plan, err = db.PlanGC(true)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(plan.OrphanedWorkDirs))
+	assert.Equal(t, 0, len(plan.FailedWorkDirs))
+	assert.Equal(t, []string{failedDir}, plan.RetainedWorkDirs)
+	assert.Equal(t, int64(0), plan.OrphanedBytes)
+
+	plan, err = db.PlanGC(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{failedDir}, plan.OrphanedWorkDirs)
+	assert.Equal(t, 0, len(plan.UnreferencedFiles))
+	assert.Nil(t, db.ExecuteGC(plan))
+	_, err = os.Stat(failedDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGCKeepsWorkDirsWithSharedFiles(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+	defer db.Close()
+
+	writeOutput := func(name string) (int, string, *Artifact) {
+		ID := db.GetNextApplicationID()
+		workDir := db.GetWorkDir(ID)
+		os.MkdirAll(workDir, os.ModePerm)
+		filename := path.Join(workDir, "out")
+		writeTestFile(t, filename, "same")
+		props := NewArtifactProperties()
+		props.Files["filename"] = db.AddFileOrFind(filename, "sha-same")
+		artifact, _ := db.PersistArtifact(props)
+		_, err := db.PersistAppliedRule(ID, name, "hash", NewBindings(), "")
+		assert.Nil(t, err)
+		assert.Nil(t, db.UpdateAppliedRuleComplete(ID, []*Artifact{artifact}))
+		return ID, workDir, artifact
+	}
+
+	// the first application is deleted, as it would be when forced to run again, which orphans its work dir
+	firstID, firstDir, _ := writeOutput("rule")
+	assert.Nil(t, db.DeleteAppliedRule(firstID))
+
+	// the rerun writes an identical output, so its artifact reuses the file in the first work dir
+	_, secondDir, secondArtifact := writeOutput("rule")
+	assert.Equal(t, path.Join(firstDir, "out"), db.GetFile(secondArtifact.Properties.Files["filename"]).LocalPath)
+
+	plan, err := db.PlanGC(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(plan.OrphanedWorkDirs))
+	assert.Equal(t, []string{firstDir}, plan.RetainedWorkDirs)
+	assert.Equal(t, 0, len(plan.UnreferencedFiles))
+
+	assert.Nil(t, db.ExecuteGC(plan))
+	_, err = os.Stat(path.Join(firstDir, "out"))
+	assert.Nil(t, err)
+	_, err = os.Stat(secondDir)
+	assert.Nil(t, err)
+}
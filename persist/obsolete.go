@@ -0,0 +1,154 @@
+package persist
+
+import (
+	"sort"
+	"strings"
+)
+
+// ObsoleteSet is the history which is no longer part of the current run because the artifacts it was derived from
+// are no longer defined
+type ObsoleteSet struct {
+	Artifacts    []*Artifact
+	AppliedRules []*AppliedRule
+}
+
+func (s *ObsoleteSet) IsEmpty() bool {
+	return len(s.Artifacts) == 0 && len(s.AppliedRules) == 0
+}
+
+// FindArtifactByKey searches the artifacts ever produced by applications of the named rule for one whose string
+// properties are exactly keyProps, ignoring the hashes recorded for files, and whose files are exactly fileProps.
+// If there are several, the most recently created is returned.
+func (db *DB) FindArtifactByKey(producerName string, keyProps map[string]string, fileProps []string) *Artifact {
+	var found *Artifact
+	for _, appliedRule := range db.appliedRuleHistoryByID {
+		if appliedRule.Name != producerName {
+			continue
+		}
+		for _, artifact := range appliedRule.Outputs {
+			if artifact == nil || !hasExactKey(artifact, keyProps, fileProps) {
+				continue
+			}
+			if found == nil || artifact.id > found.id {
+				found = artifact
+			}
+		}
+	}
+	return found
+}
+
+func hasExactKey(artifact *Artifact, keyProps map[string]string, fileProps []string) bool {
+	matched := 0
+	for name, value := range artifact.Properties.Strings {
+		if strings.HasSuffix(name, "$sha256") {
+			continue
+		}
+		if expected, ok := keyProps[name]; !ok || expected != value {
+			return false
+		}
+		matched++
+	}
+	if matched != len(keyProps) || len(artifact.Properties.Files) != len(fileProps) {
+		return false
+	}
+	for _, name := range fileProps {
+		if _, ok := artifact.Properties.Files[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// FindObsolete finds the artifacts which were produced by applications of the named rule in the past, but are not
+// part of the current run, and everything in the history which was derived from them. Should only be called after
+// the current run has completed.
+func (db *DB) FindObsolete(producerName string) *ObsoleteSet {
+	obsoleteArtifacts := make(map[int]*Artifact)
+	for _, appliedRule := range db.appliedRuleHistoryByID {
+		if appliedRule.Name != producerName {
+			continue
+		}
+		for _, output := range appliedRule.Outputs {
+			if _, current := db.currentArtifacts[output.id]; !current {
+				obsoleteArtifacts[output.id] = output
+			}
+		}
+	}
+
+	// repeatedly look for applications which consumed an obsolete artifact until no new ones are found
+	obsoleteAppliedRules := make(map[int]*AppliedRule)
+	for changed := true; changed; {
+		changed = false
+		for _, appliedRule := range db.appliedRuleHistoryByID {
+			if _, seen := obsoleteAppliedRules[appliedRule.ID]; seen {
+				continue
+			}
+			if _, current := db.currentAppliedRules[appliedRule.ID]; current {
+				continue
+			}
+			if !consumesAny(appliedRule, obsoleteArtifacts) {
+				continue
+			}
+			obsoleteAppliedRules[appliedRule.ID] = appliedRule
+			for _, output := range appliedRule.Outputs {
+				if _, current := db.currentArtifacts[output.id]; !current {
+					obsoleteArtifacts[output.id] = output
+				}
+			}
+			changed = true
+		}
+	}
+
+	obsolete := &ObsoleteSet{}
+	for _, artifact := range obsoleteArtifacts {
+		obsolete.Artifacts = append(obsolete.Artifacts, artifact)
+	}
+	sort.Slice(obsolete.Artifacts, func(i, j int) bool {
+		return obsolete.Artifacts[i].id < obsolete.Artifacts[j].id
+	})
+	for _, appliedRule := range obsoleteAppliedRules {
+		obsolete.AppliedRules = append(obsolete.AppliedRules, appliedRule)
+	}
+	sort.Slice(obsolete.AppliedRules, func(i, j int) bool {
+		return obsolete.AppliedRules[i].ID < obsolete.AppliedRules[j].ID
+	})
+	return obsolete
+}
+
+func consumesAny(appliedRule *AppliedRule, artifacts map[int]*Artifact) bool {
+	for _, value := range appliedRule.Inputs.ByName {
+		for _, input := range value.GetArtifacts() {
+			// inputs which have since been deleted are nil
+			if input == nil {
+				continue
+			}
+			if _, ok := artifacts[input.id]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FindSuperseded returns the applications of the named rule in the history which aren't part of the current run,
+// but were for the same inputs, or the same groups of inputs, as an application of the rule to inputs. Such an
+// application would replace them, because the rule or the artifacts in a group changed.
+func (db *DB) FindSuperseded(name string, inputs *Bindings) []*AppliedRule {
+	key := inputs.Key()
+	superseded := make([]*AppliedRule, 0)
+	for _, appliedRule := range db.appliedRuleHistoryByID {
+		if appliedRule.Name != name {
+			continue
+		}
+		if _, current := db.currentAppliedRules[appliedRule.ID]; current {
+			continue
+		}
+		if appliedRule.Inputs.Key() == key {
+			superseded = append(superseded, appliedRule)
+		}
+	}
+	sort.Slice(superseded, func(i, j int) bool {
+		return superseded[i].ID < superseded[j].ID
+	})
+	return superseded
+}
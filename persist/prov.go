@@ -0,0 +1,254 @@
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// ProvNamespace is the namespace used for all conseq specific identifiers and attributes in exported PROV-JSON documents
+const ProvNamespace = "https://github.com/pgm/goconseq#"
+
+// ProvDocument is a W3C PROV-JSON document (https://www.w3.org/Submission/prov-json/)
+type ProvDocument struct {
+	Prefix         map[string]string                 `json:"prefix"`
+	Entity         map[string]map[string]interface{} `json:"entity"`
+	Activity       map[string]map[string]interface{} `json:"activity"`
+	WasGeneratedBy map[string]map[string]interface{} `json:"wasGeneratedBy"`
+	Used           map[string]map[string]interface{} `json:"used"`
+	HadMember      map[string]map[string]interface{} `json:"hadMember"`
+}
+
+func newProvDocument() *ProvDocument {
+	return &ProvDocument{
+		Prefix:         map[string]string{"conseq": ProvNamespace},
+		Entity:         make(map[string]map[string]interface{}),
+		Activity:       make(map[string]map[string]interface{}),
+		WasGeneratedBy: make(map[string]map[string]interface{}),
+		Used:           make(map[string]map[string]interface{}),
+		HadMember:      make(map[string]map[string]interface{})}
+}
+
+func artifactProvID(id int) string {
+	return fmt.Sprintf("conseq:artifact%d", id)
+}
+
+func fileProvID(id int) string {
+	return fmt.Sprintf("conseq:file%d", id)
+}
+
+func appliedRuleProvID(id int) string {
+	return fmt.Sprintf("conseq:r%d", id)
+}
+
+// ProvExporter accumulates the provenance of artifacts into a single PROV document. If BundleDir is set, the run
+// scripts of each applied rule are copied into the bundle and, if CopyFiles is also set, so are the files
+// referenced by the artifacts.
+type ProvExporter struct {
+	db        *DB
+	doc       *ProvDocument
+	BundleDir string
+	CopyFiles bool
+}
+
+func (db *DB) NewProvExporter() *ProvExporter {
+	return &ProvExporter{db: db, doc: newProvDocument()}
+}
+
+func (e *ProvExporter) relationID(relation map[string]map[string]interface{}) string {
+	return fmt.Sprintf("_:id%d", len(relation)+1)
+}
+
+func copyFile(src string, dst string) error {
+	err := os.MkdirAll(path.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (e *ProvExporter) addFile(fileID int) (string, error) {
+	provID := fileProvID(fileID)
+	if _, exists := e.doc.Entity[provID]; exists {
+		return provID, nil
+	}
+
+	file := e.db.GetFile(fileID)
+	if file == nil {
+		return "", fmt.Errorf("Artifact references missing file %d", fileID)
+	}
+
+	attributes := map[string]interface{}{
+		"prov:type":        "conseq:File",
+		"prov:location":    file.LocalPath,
+		"conseq:sha256":    file.SHA256,
+		"conseq:localPath": file.LocalPath}
+	if file.GlobalPath != "" {
+		attributes["conseq:globalPath"] = file.GlobalPath
+	}
+
+	if e.BundleDir != "" && e.CopyFiles {
+		bundlePath := path.Join("files", fmt.Sprintf("%d", fileID), path.Base(file.LocalPath))
+		err := copyFile(file.LocalPath, path.Join(e.BundleDir, bundlePath))
+		if err != nil {
+			return "", err
+		}
+		attributes["prov:location"] = bundlePath
+	}
+
+	e.doc.Entity[provID] = attributes
+	return provID, nil
+}
+
+// reads the scripts which the executor wrote to the conseqfiles directory within the work dir
+func (e *ProvExporter) readScripts(appliedRuleID int) ([]string, error) {
+	scriptDir := path.Join(e.db.GetWorkDir(appliedRuleID), "conseqfiles")
+	entries, err := ioutil.ReadDir(scriptDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	scripts := make([]string, 0, len(names))
+	for _, name := range names {
+		src := path.Join(scriptDir, name)
+		if e.BundleDir != "" {
+			err := copyFile(src, path.Join(e.BundleDir, "scripts", fmt.Sprintf("r%d", appliedRuleID), name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		body, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, string(body))
+	}
+	return scripts, nil
+}
+
+func (e *ProvExporter) addAppliedRule(appliedRule *AppliedRule) (string, error) {
+	provID := appliedRuleProvID(appliedRule.ID)
+	if _, exists := e.doc.Activity[provID]; exists {
+		return provID, nil
+	}
+
+	scripts, err := e.readScripts(appliedRule.ID)
+	if err != nil {
+		return "", err
+	}
+
+	e.doc.Activity[provID] = map[string]interface{}{
+		"prov:type":      "conseq:AppliedRule",
+		"prov:label":     appliedRule.Name,
+		"conseq:rule":    appliedRule.Name,
+		"conseq:hash":    appliedRule.Hash,
+		"conseq:workDir": e.db.GetWorkDir(appliedRule.ID),
+		"conseq:scripts": scripts}
+
+	// sort the names of the inputs to get a deterministic numbering of relations
+	names := make([]string, 0, len(appliedRule.Inputs.ByName))
+	for name := range appliedRule.Inputs.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, input := range appliedRule.Inputs.ByName[name].GetArtifacts() {
+			if input == nil {
+				continue
+			}
+			inputID, err := e.Add(input)
+			if err != nil {
+				return "", err
+			}
+			e.doc.Used[e.relationID(e.doc.Used)] = map[string]interface{}{
+				"prov:activity": provID,
+				"prov:entity":   inputID,
+				"prov:role":     name}
+		}
+	}
+
+	return provID, nil
+}
+
+// Add records the artifact, the files it references and everything upstream of it in the document
+func (e *ProvExporter) Add(artifact *Artifact) (string, error) {
+	provID := artifactProvID(artifact.id)
+	if _, exists := e.doc.Entity[provID]; exists {
+		return provID, nil
+	}
+
+	attributes := map[string]interface{}{"prov:type": "conseq:Artifact"}
+	if len(artifact.Properties.Files) > 0 {
+		// the files are recorded as members of the artifact, which PROV requires to be a collection
+		attributes["prov:type"] = []string{"conseq:Artifact", "prov:Collection"}
+	}
+	for k, v := range artifact.Properties.Strings {
+		attributes["conseq:"+k] = v
+	}
+	e.doc.Entity[provID] = attributes
+
+	for k, fileID := range artifact.Properties.Files {
+		fileEntityID, err := e.addFile(fileID)
+		if err != nil {
+			return "", err
+		}
+		attributes["conseq:"+k] = map[string]string{"$": fileEntityID, "type": "prov:QUALIFIED_NAME"}
+		e.doc.HadMember[e.relationID(e.doc.HadMember)] = map[string]interface{}{
+			"prov:collection": provID,
+			"prov:entity":     fileEntityID}
+	}
+
+	appliedRule := e.db.FindAppliedRuleProducing(artifact)
+	if appliedRule != nil {
+		activityID, err := e.addAppliedRule(appliedRule)
+		if err != nil {
+			return "", err
+		}
+		e.doc.WasGeneratedBy[e.relationID(e.doc.WasGeneratedBy)] = map[string]interface{}{
+			"prov:entity":   provID,
+			"prov:activity": activityID}
+	}
+
+	return provID, nil
+}
+
+func (e *ProvExporter) Document() *ProvDocument {
+	return e.doc
+}
+
+func (e *ProvExporter) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(e.doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
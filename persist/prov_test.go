@@ -0,0 +1,71 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvExport(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db := NewDB(stateDir)
+	defer db.Close()
+
+	// an application which wrote a script and produced an artifact with a file
+	appID := db.GetNextApplicationID()
+	workDir := db.GetWorkDir(appID)
+	os.MkdirAll(path.Join(workDir, "conseqfiles"), os.ModePerm)
+	writeTestFile(t, path.Join(workDir, "conseqfiles", "file1"), "echo hello")
+	writeTestFile(t, path.Join(workDir, "out.txt"), "hello")
+	fileID := db.AddFileOrFind(path.Join(workDir, "out.txt"), "abc")
+	props := NewArtifactProperties()
+	props.Strings["type"] = "greeting"
+	props.Files["filename"] = fileID
+	greeting, _ := db.PersistArtifact(props)
+	_, err = db.PersistAppliedRule(appID, "hello", "hash1", NewBindings(), "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(appID, []*Artifact{greeting}))
+
+	// a downstream application which consumed it
+	summary, _ := db.PersistArtifact(&ArtifactProperties{Strings: map[string]string{"type": "summary"}})
+	bindings := NewBindings()
+	bindings.AddArtifact("g", greeting)
+	appID2 := db.GetNextApplicationID()
+	_, err = db.PersistAppliedRule(appID2, "summarize", "hash2", bindings, "")
+	assert.Nil(t, err)
+	assert.Nil(t, db.UpdateAppliedRuleComplete(appID2, []*Artifact{summary}))
+
+	bundleDir := path.Join(stateDir, "bundle")
+	exporter := db.NewProvExporter()
+	exporter.BundleDir = bundleDir
+	exporter.CopyFiles = true
+	_, err = exporter.Add(summary)
+	assert.Nil(t, err)
+
+	doc := exporter.Document()
+	assert.Equal(t, 3, len(doc.Entity))
+	assert.Equal(t, 2, len(doc.Activity))
+	assert.Equal(t, 2, len(doc.WasGeneratedBy))
+	assert.Equal(t, 1, len(doc.Used))
+	assert.Equal(t, 1, len(doc.HadMember))
+
+	assert.Equal(t, []string{"conseq:Artifact", "prov:Collection"}, doc.Entity[artifactProvID(greeting.id)]["prov:type"])
+	assert.Equal(t, "conseq:Artifact", doc.Entity[artifactProvID(summary.id)]["prov:type"])
+
+	file := doc.Entity[fileProvID(fileID)]
+	assert.Equal(t, "abc", file["conseq:sha256"])
+	assert.Equal(t, []string{"echo hello"}, doc.Activity[appliedRuleProvID(appID)]["conseq:scripts"])
+
+	// make sure the file and script were copied into the bundle
+	body, err := ioutil.ReadFile(path.Join(bundleDir, file["prov:location"].(string)))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+	_, err = os.Stat(path.Join(bundleDir, "scripts", "r0", "file1"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,88 @@
+package persist
+
+import "sort"
+
+// ArtifactProvenance describes an artifact and, recursively, how it was produced
+type ArtifactProvenance struct {
+	ArtifactID int                    `json:"artifact_id"`
+	Properties map[string]string      `json:"properties"`
+	ProducedBy *AppliedRuleProvenance `json:"produced_by,omitempty"`
+}
+
+// AppliedRuleProvenance describes the applied rule which produced an artifact along with the provenance of each of its inputs
+type AppliedRuleProvenance struct {
+	AppliedRuleID int                              `json:"applied_rule_id"`
+	Name          string                           `json:"name"`
+	Hash          string                           `json:"hash"`
+	WorkDir       string                           `json:"work_dir"`
+	Inputs        map[string][]*ArtifactProvenance `json:"inputs"`
+}
+
+func (a *Artifact) GetID() int {
+	return a.id
+}
+
+// FindAppliedRuleProducing returns the applied rule in the history which has the given artifact as an output or nil if none exists
+func (db *DB) FindAppliedRuleProducing(artifact *Artifact) *AppliedRule {
+	// iterate in ID order so the result is deterministic
+	IDs := make([]int, 0, len(db.appliedRuleHistoryByID))
+	for ID := range db.appliedRuleHistoryByID {
+		IDs = append(IDs, ID)
+	}
+	sort.Ints(IDs)
+
+	for _, ID := range IDs {
+		appliedRule := db.appliedRuleHistoryByID[ID]
+		for _, output := range appliedRule.Outputs {
+			if output.id == artifact.id {
+				return appliedRule
+			}
+		}
+	}
+	return nil
+}
+
+// GetProvenance walks back through the history from the given artifact, recording each applied rule and its inputs
+// until it reaches artifacts produced by rules without inputs.
+func (db *DB) GetProvenance(artifact *Artifact) *ArtifactProvenance {
+	return db.getProvenance(artifact, make(map[int]*ArtifactProvenance))
+}
+
+func (db *DB) getProvenance(artifact *Artifact, seen map[int]*ArtifactProvenance) *ArtifactProvenance {
+	if p, ok := seen[artifact.id]; ok {
+		return p
+	}
+
+	p := &ArtifactProvenance{ArtifactID: artifact.id,
+		Properties: artifact.Properties.ToStrMap(func(fileID int) string {
+			file := db.GetFile(fileID)
+			if file == nil {
+				return ""
+			}
+			return file.LocalPath
+		})}
+	seen[artifact.id] = p
+
+	appliedRule := db.FindAppliedRuleProducing(artifact)
+	if appliedRule != nil {
+		producedBy := &AppliedRuleProvenance{AppliedRuleID: appliedRule.ID,
+			Name:    appliedRule.Name,
+			Hash:    appliedRule.Hash,
+			WorkDir: db.GetWorkDir(appliedRule.ID),
+			Inputs:  make(map[string][]*ArtifactProvenance)}
+		for name, value := range appliedRule.Inputs.ByName {
+			inputs := make([]*ArtifactProvenance, 0, len(value.GetArtifacts()))
+			for _, input := range value.GetArtifacts() {
+				if input == nil {
+					// input was deleted after this rule ran
+					continue
+				}
+				inputs = append(inputs, db.getProvenance(input, seen))
+			}
+			producedBy.Inputs[name] = inputs
+		}
+		p.ProducedBy = producedBy
+	}
+
+	return p
+}
@@ -1,7 +1,11 @@
 package persist
 
 import (
+	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/pgm/goconseq/graph"
 	"github.com/pgm/goconseq/model"
@@ -17,6 +21,10 @@ type QueryBinding struct {
 	bindingVariable string
 	// the static constraints to use when querying
 	constantConstraints map[string]string
+	// constraints other than equality
+	predicates map[string]*graph.Predicate
+	// if set, one binding is created for each distinct value of this property
+	groupBy string
 	// the variable constraints to use when querying. Each of these will reference a field from a prior variable definition
 	placeholderConstraints []StringPair
 	placeholderAssignments []StringPair
@@ -30,14 +38,37 @@ type QueryBinding struct {
 type Query struct {
 	forEach []*QueryBinding
 	forAll  []*QueryBinding
+	// bindings which are null if nothing matches
+	optional []*QueryBinding
+	// bindings which must not match anything
+	negated []*QueryBinding
 }
 
 func (q *QueryBinding) AsDict() map[string]interface{} {
 	log.Printf("Warning: QueryBinding is incomplete")
-	return map[string]interface{}{
+	dict := map[string]interface{}{
 		"bindingVariable":     q.bindingVariable,
 		"constantConstraints": q.constantConstraints,
 	}
+	// only included when used so the hashes of existing rules don't change
+	if len(q.predicates) > 0 {
+		predicates := make(map[string]string, len(q.predicates))
+		for name, predicate := range q.predicates {
+			predicates[name] = predicate.String()
+		}
+		dict["predicates"] = predicates
+	}
+	if q.groupBy != "" {
+		dict["groupBy"] = q.groupBy
+	}
+	if len(q.placeholderConstraints) > 0 {
+		constraints := make(map[string]string, len(q.placeholderConstraints))
+		for _, constraint := range q.placeholderConstraints {
+			constraints[constraint.first] = constraint.second
+		}
+		dict["placeholderConstraints"] = constraints
+	}
+	return dict
 }
 
 func queryBindingSliceAsDict(v []*QueryBinding) []interface{} {
@@ -53,25 +84,77 @@ func (q *Query) AsDict() map[string]interface{} {
 		return nil
 	}
 
-	return map[string]interface{}{
+	dict := map[string]interface{}{
 		"forEach": queryBindingSliceAsDict(q.forEach),
 		"forAll":  queryBindingSliceAsDict(q.forAll)}
+	// only included when used so the hashes of existing rules don't change
+	if len(q.optional) > 0 {
+		dict["optional"] = queryBindingSliceAsDict(q.optional)
+	}
+	if len(q.negated) > 0 {
+		dict["negated"] = queryBindingSliceAsDict(q.negated)
+	}
+	return dict
 }
 
 func (q *Query) IsEmpty() bool {
-	return len(q.forEach) == 0 && len(q.forAll) == 0
+	return len(q.forEach) == 0 && len(q.forAll) == 0 && len(q.optional) == 0 && len(q.negated) == 0
+}
+
+func (qb *QueryBinding) props() *graph.PropertiesTemplate {
+	pp := graph.PropertiesTemplate{}
+	for name, value := range qb.constantConstraints {
+		pp.AddConstantProperty(name, value)
+	}
+	for name, predicate := range qb.predicates {
+		pp.AddPredicate(name, predicate)
+	}
+	return &pp
+}
+
+func queryBindingProps(bindings []*QueryBinding) []*graph.PropertiesTemplate {
+	result := make([]*graph.PropertiesTemplate, len(bindings))
+	for i, qb := range bindings {
+		result[i] = qb.props()
+	}
+	return result
 }
 
 func (q *Query) GetProps() []*graph.PropertiesTemplate {
-	result := make([]*graph.PropertiesTemplate, len(q.forEach))
-	for i, qb := range q.forEach {
-		pp := graph.PropertiesTemplate{}
-		for name, value := range qb.constantConstraints {
-			pp.AddConstantProperty(name, value)
+	return queryBindingProps(q.forEach)
+}
+
+// GetAllProps returns the properties of the bindings which consume all matching artifacts
+func (q *Query) GetAllProps() []*graph.PropertiesTemplate {
+	return queryBindingProps(q.forAll)
+}
+
+// GetOptionalProps returns the properties of the optional and negated bindings
+func (q *Query) GetOptionalProps() []*graph.PropertiesTemplate {
+	return append(queryBindingProps(q.optional), queryBindingProps(q.negated)...)
+}
+
+func (q *Query) InputNames() []string {
+	names := make([]string, 0, len(q.forEach)+len(q.forAll)+len(q.optional))
+	for _, bindings := range [][]*QueryBinding{q.forEach, q.forAll, q.optional} {
+		for _, binding := range bindings {
+			names = append(names, binding.bindingVariable)
 		}
-		result[i] = &pp
 	}
-	return result
+	sort.Strings(names)
+	return names
+}
+
+// GetInputProps returns the properties of the named input or nil if there is no such input
+func (q *Query) GetInputProps(name string) *graph.PropertiesTemplate {
+	for _, bindings := range [][]*QueryBinding{q.forEach, q.forAll, q.optional, q.negated} {
+		for _, binding := range bindings {
+			if binding.bindingVariable == name {
+				return binding.props()
+			}
+		}
+	}
+	return nil
 }
 
 func mergeConstraints(original map[string]string,
@@ -96,26 +179,103 @@ func copyStrMap(a map[string]string) map[string]string {
 	return b
 }
 
+func (q *QueryBinding) findArtifacts(db *DB, placeholders map[string]string) []*Artifact {
+	constraints := mergeConstraints(q.constantConstraints, q.placeholderConstraints, placeholders)
+	return db.FindArtifactsMatching(constraints, q.predicates)
+}
+
+// addOptionalBindings returns a copy of binding for each combination of artifacts matching the optional bindings.
+// An optional binding which doesn't match anything is bound to null.
+func addOptionalBindings(db *DB, placeholders map[string]string, binding *Bindings, optionalList []*QueryBinding) []*Bindings {
+	if len(optionalList) == 0 {
+		return []*Bindings{binding}
+	}
+
+	optional := optionalList[0]
+	artifacts := optional.findArtifacts(db, placeholders)
+	if len(artifacts) == 0 {
+		binding.AddNull(optional.bindingVariable)
+		return addOptionalBindings(db, placeholders, binding, optionalList[1:])
+	}
+
+	records := make([]*Bindings, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		record := binding.copy()
+		record.AddArtifact(optional.bindingVariable, artifact)
+		records = append(records, addOptionalBindings(db, placeholders, record, optionalList[1:])...)
+	}
+	return records
+}
+
+// groupArtifacts splits artifacts by the value of the named property. Artifacts without the property are left out.
+// Returns the groups and the sorted list of the distinct values.
+func groupArtifacts(artifacts []*Artifact, property string) (map[string][]*Artifact, []string) {
+	groups := make(map[string][]*Artifact)
+	values := make([]string, 0)
+	for _, artifact := range artifacts {
+		value, ok := artifact.Properties.Strings[property]
+		if !ok {
+			continue
+		}
+		if _, seen := groups[value]; !seen {
+			values = append(values, value)
+		}
+		groups[value] = append(groups[value], artifact)
+	}
+	sort.Strings(values)
+	return groups, values
+}
+
+// addGroupedBindings returns a copy of binding for each combination of groups from the grouped bindings
+func addGroupedBindings(db *DB, placeholders map[string]string, binding *Bindings, groupedList []*QueryBinding) []*Bindings {
+	if len(groupedList) == 0 {
+		return []*Bindings{binding}
+	}
+
+	grouped := groupedList[0]
+	groups, values := groupArtifacts(grouped.findArtifacts(db, placeholders), grouped.groupBy)
+	records := make([]*Bindings, 0, len(values))
+	for _, value := range values {
+		record := binding.copy()
+		record.AddGroup(grouped.bindingVariable, value, groups[value])
+		records = append(records, addGroupedBindings(db, placeholders, record, groupedList[1:])...)
+	}
+	return records
+}
+
 func _executeQuery(db *DB,
 	origPlaceholders map[string]string,
 	forEachList []*QueryBinding,
-	forAllList []*QueryBinding) []*Bindings {
+	query *Query) []*Bindings {
 
 	if len(forEachList) == 0 {
+		for _, negated := range query.negated {
+			if len(negated.findArtifacts(db, origPlaceholders)) > 0 {
+				return nil
+			}
+		}
+
 		binding := NewBindings()
-		for _, forAll := range forAllList {
-			constraints := mergeConstraints(forAll.constantConstraints, forAll.placeholderConstraints, origPlaceholders)
-			artifacts := db.FindArtifacts(constraints)
-			binding.AddArtifacts(forAll.bindingVariable, artifacts)
+		grouped := make([]*QueryBinding, 0)
+		for _, forAll := range query.forAll {
+			if forAll.groupBy != "" {
+				grouped = append(grouped, forAll)
+			} else {
+				binding.AddArtifacts(forAll.bindingVariable, forAll.findArtifacts(db, origPlaceholders))
+			}
 		}
-		return []*Bindings{binding}
+
+		records := make([]*Bindings, 0)
+		for _, record := range addGroupedBindings(db, origPlaceholders, binding, grouped) {
+			records = append(records, addOptionalBindings(db, origPlaceholders, record, query.optional)...)
+		}
+		return records
 	}
 
 	forEach := forEachList[0]
 	restForEach := forEachList[1:]
 
-	constraints := mergeConstraints(forEach.constantConstraints, forEach.placeholderConstraints, origPlaceholders)
-	artifacts := db.FindArtifacts(constraints)
+	artifacts := forEach.findArtifacts(db, origPlaceholders)
 	if len(artifacts) == 0 {
 		return nil
 	}
@@ -140,7 +300,7 @@ func _executeQuery(db *DB,
 		for _, assignment := range forEach.placeholderAssignments {
 			placeholders[assignment.second] = artifact.Properties.Strings[assignment.first]
 		}
-		records := _executeQuery(db, placeholders, restForEach, forAllList)
+		records := _executeQuery(db, placeholders, restForEach, query)
 		for _, record := range records {
 			binding := &Bindings{ByName: make(map[string]BindingValue)}
 			binding.AddArtifact(forEach.bindingVariable, artifact)
@@ -156,7 +316,7 @@ func _executeQuery(db *DB,
 func ExecuteQuery(db *DB, query *Query) []*Bindings {
 	// resolve all forEaches before doing any forAlls
 	placeholders := make(map[string]string)
-	return _executeQuery(db, placeholders, query.forEach, query.forAll)
+	return _executeQuery(db, placeholders, query.forEach, query)
 }
 
 func (query *Query) ExecuteQuery(db interface{}) []interface{} {
@@ -168,27 +328,125 @@ func (query *Query) ExecuteQuery(db interface{}) []interface{} {
 	return r2
 }
 
-func QueryFromMaps(bindMap map[string]*model.InputQuery) *Query {
+// matches a query property whose value is nothing but a reference to a property of another input, such as
+// {{inputs.sample.name}}
+var inputRefExp = regexp.MustCompile(`^\s*\{\{\s*inputs\.([A-Za-z][A-Za-z0-9_+-]*)\.([^\s{}]+)\s*\}\}\s*$`)
+
+// QueryFromMaps builds a query from the inputs of a rule. A property whose value refers to a property of another
+// input, like {{inputs.sample.name}}, only matches artifacts with the same value as the artifact bound to that
+// input, which must be one bound to each matching artifact (ie: not all, optional or not).
+func QueryFromMaps(bindMap map[string]*model.InputQuery) (*Query, error) {
 	var query Query
 
-	for name, inputQuery := range bindMap {
+	// add the bindings in a consistent order so that queries built from the same inputs are identical
+	names := make([]string, 0, len(bindMap))
+	for name := range bindMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bindings := make(map[string]*QueryBinding, len(names))
+	// the names of the inputs each input refers to
+	references := make(map[string][]string)
+	for _, name := range names {
+		inputQuery := bindMap[name]
 		binding := &QueryBinding{bindingVariable: name,
-			constantConstraints: inputQuery.Properties}
-		// bindingVariable string
-		// // the static constraints to use when querying
-		// constantConstraints map[string]string
-		// // the variable constraints to use when querying. Each of these will reference a field from a prior variable definition
-		// placeholderConstraints []StringPair
-		// placeholderAssignments []StringPair
-
-		// for k, v := template {
-		// }
+			constantConstraints: make(map[string]string, len(inputQuery.Properties)),
+			predicates:          inputQuery.Predicates,
+			groupBy:             inputQuery.GroupBy}
+		bindings[name] = binding
+
+		properties := make([]string, 0, len(inputQuery.Properties))
+		for property := range inputQuery.Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		for _, property := range properties {
+			value := inputQuery.Properties[property]
+			m := inputRefExp.FindStringSubmatch(value)
+			if m == nil {
+				if model.IsTemplate(value) {
+					return nil, fmt.Errorf("Input %s has the template %q as the value of %s, but only references like {{inputs.NAME.PROPERTY}} can be used in inputs", name, value, property)
+				}
+				binding.constantConstraints[property] = value
+				continue
+			}
+			referenced, ok := bindMap[m[1]]
+			if !ok || m[1] == name {
+				return nil, fmt.Errorf("Input %s refers to inputs.%s.%s, but there is no other input named %s", name, m[1], m[2], m[1])
+			}
+			if referenced.IsAll || referenced.IsOptional || referenced.IsNegated {
+				return nil, fmt.Errorf("Input %s refers to inputs.%s.%s, but %s is bound with all, optional or not", name, m[1], m[2], m[1])
+			}
+			placeholder := m[1] + "." + m[2]
+			binding.placeholderConstraints = append(binding.placeholderConstraints, StringPair{property, placeholder})
+			references[name] = append(references[name], m[1])
+		}
+
 		if inputQuery.IsAll {
 			query.forAll = append(query.forAll, binding)
-		} else {
-			query.forEach = append(query.forEach, binding)
+		} else if inputQuery.IsOptional {
+			query.optional = append(query.optional, binding)
+		} else if inputQuery.IsNegated {
+			query.negated = append(query.negated, binding)
 		}
 	}
 
-	return &query
+	// each referenced input assigns the placeholders the inputs which refer to it use
+	for _, name := range names {
+		binding := bindings[name]
+		for i, constraint := range binding.placeholderConstraints {
+			referenced := bindings[references[name][i]]
+			property := constraint.second[len(referenced.bindingVariable)+1:]
+			assignment := StringPair{property, constraint.second}
+			if !containsStringPair(referenced.placeholderAssignments, assignment) {
+				referenced.placeholderAssignments = append(referenced.placeholderAssignments, assignment)
+			}
+		}
+	}
+
+	// placeholders are only known once the input which assigns them has been bound, so inputs bound to each
+	// matching artifact are ordered after the ones they refer to
+	added := make(map[string]bool)
+	for len(added) < len(names)-len(query.forAll)-len(query.optional)-len(query.negated) {
+		progress := false
+		for _, name := range names {
+			inputQuery := bindMap[name]
+			if added[name] || inputQuery.IsAll || inputQuery.IsOptional || inputQuery.IsNegated {
+				continue
+			}
+			ready := true
+			for _, referenced := range references[name] {
+				if !added[referenced] {
+					ready = false
+				}
+			}
+			if ready {
+				query.forEach = append(query.forEach, bindings[name])
+				added[name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			cyclic := make([]string, 0)
+			for _, name := range names {
+				inputQuery := bindMap[name]
+				if !added[name] && !inputQuery.IsAll && !inputQuery.IsOptional && !inputQuery.IsNegated {
+					cyclic = append(cyclic, name)
+				}
+			}
+			return nil, fmt.Errorf("Inputs %s refer to each other", strings.Join(cyclic, ", "))
+		}
+	}
+
+	return &query, nil
+}
+
+func containsStringPair(pairs []StringPair, pair StringPair) bool {
+	for _, p := range pairs {
+		if p == pair {
+			return true
+		}
+	}
+	return false
 }
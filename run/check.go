@@ -0,0 +1,248 @@
+package run
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/pgm/goconseq/executor"
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/model"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is something found by CheckConfig which will cause the pipeline to fail or not do what was intended
+type Problem struct {
+	Severity string
+	Rule     string
+	Source   model.SourceLocation
+	Message  string
+}
+
+func (p *Problem) String() string {
+	if p.Source.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", p.Severity, p.Rule, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: rule %s: %s", p.Source, p.Severity, p.Rule, p.Message)
+}
+
+// matches a reference to an input within a template tag
+var inputRefExp = regexp.MustCompile(`\binputs\.([A-Za-z_][A-Za-z0-9_]*)`)
+var templateTagExp = regexp.MustCompile(`(?s)\{[{%](.*?)[%}]\}`)
+
+type checker struct {
+	config   *model.Config
+	problems []*Problem
+	// rules which already have an error, so we don't also report everything which follows from it
+	failed map[string]bool
+}
+
+func (c *checker) report(severity string, rule *model.Rule, format string, args ...interface{}) {
+	c.problems = append(c.problems, &Problem{Severity: severity,
+		Rule:    rule.Name,
+		Source:  rule.Source,
+		Message: fmt.Sprintf(format, args...)})
+	if severity == SeverityError {
+		c.failed[rule.Name] = true
+	}
+}
+
+func (c *checker) sortedRules() []*model.Rule {
+	rules := make([]*model.Rule, 0, len(c.config.Rules))
+	for _, rule := range c.config.Rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
+
+// checkTemplates compiles every template in the rule and verifies they only reference inputs which exist
+func (c *checker) checkTemplates(rule *model.Rule) {
+	inputNames := make(map[string]bool)
+	if rule.Query != nil {
+		for _, name := range rule.Query.InputNames() {
+			inputNames[name] = true
+		}
+	}
+
+	check := func(what string, template string) {
+		if _, err := pongo2.FromString(template); err != nil {
+			c.report(SeverityError, rule, "invalid template in %s: %s", what, err)
+			return
+		}
+		for _, tag := range templateTagExp.FindAllStringSubmatch(template, -1) {
+			for _, ref := range inputRefExp.FindAllStringSubmatch(tag[1], -1) {
+				if !inputNames[ref[1]] {
+					c.report(SeverityError, rule, "%s references inputs.%s but there is no input named %s", what, ref[1], ref[1])
+				}
+			}
+		}
+	}
+
+	for _, runStatement := range rule.RunStatements {
+		check("run statement", runStatement.Executable)
+		check("run statement", runStatement.Script)
+	}
+	for _, output := range rule.Outputs {
+		for _, prop := range output.Properties {
+			check("output property "+prop.Name, prop.Value)
+		}
+	}
+}
+
+// findProducers returns the names of the rules with an output which could satisfy the query
+func (c *checker) findProducers(queryProps *graph.PropertiesTemplate) []string {
+	producers := make([]string, 0)
+	for _, rule := range c.sortedRules() {
+		for _, outputProps := range rule.GetOutputProps() {
+			if outputProps.Contains(queryProps) {
+				producers = append(producers, rule.Name)
+				break
+			}
+		}
+	}
+	return producers
+}
+
+// checkInputs reports any required inputs which nothing produces and returns the names of the rules each rule
+// depends on
+func (c *checker) checkInputs() map[string][]string {
+	dependencies := make(map[string][]string)
+	for _, rule := range c.sortedRules() {
+		required := append(rule.GetQueryProps(), rule.GetAllQueryProps()...)
+		for _, queryProps := range required {
+			producers := c.findProducers(queryProps)
+			if len(producers) == 0 {
+				c.report(SeverityError, rule, "no rule or artifact produces anything matching the input %s", queryProps)
+			}
+			dependencies[rule.Name] = append(dependencies[rule.Name], producers...)
+		}
+		for _, queryProps := range rule.GetOptionalQueryProps() {
+			dependencies[rule.Name] = append(dependencies[rule.Name], c.findProducers(queryProps)...)
+		}
+	}
+	return dependencies
+}
+
+// checkCycles reports each cycle in the dependencies once
+func (c *checker) checkCycles(dependencies map[string][]string) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, dependency := range dependencies[name] {
+			if state[dependency] == visiting {
+				start := 0
+				for path[start] != dependency {
+					start++
+				}
+				cycle := append(append([]string{}, path[start:]...), dependency)
+				c.report(SeverityError, c.config.Rules[dependency], "dependency cycle: %s", strings.Join(cycle, " <- "))
+				for _, member := range cycle {
+					c.failed[member] = true
+				}
+			} else if state[dependency] == 0 {
+				visit(dependency)
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+	}
+
+	for _, rule := range c.sortedRules() {
+		if state[rule.Name] == 0 {
+			visit(rule.Name)
+		}
+	}
+}
+
+// checkReachable reports rules which will never run because something they depend on will never run
+func (c *checker) checkReachable() {
+	reachable := make(map[string]bool)
+	RulesToGraph(c.config.Rules).ForEachRule(func(r *graph.Rule) {
+		reachable[r.Name()] = true
+	})
+	for _, rule := range c.sortedRules() {
+		if !reachable[rule.Name] && !c.failed[rule.Name] {
+			c.report(SeverityError, rule, "will never run because the rules it depends on will never run")
+		}
+	}
+}
+
+// checkUnused warns about outputs which no rule consumes
+func (c *checker) checkUnused() {
+	inputs := make([]*graph.PropertiesTemplate, 0)
+	for _, rule := range c.config.Rules {
+		inputs = append(inputs, rule.GetQueryProps()...)
+		inputs = append(inputs, rule.GetAllQueryProps()...)
+		inputs = append(inputs, rule.GetOptionalQueryProps()...)
+	}
+
+	for _, rule := range c.sortedRules() {
+		for _, outputProps := range rule.GetOutputProps() {
+			used := false
+			for _, inputProps := range inputs {
+				if outputProps.Contains(inputProps) {
+					used = true
+					break
+				}
+			}
+			if !used {
+				c.report(SeverityWarning, rule, "nothing uses the output %s", outputProps)
+			}
+		}
+	}
+}
+
+// CheckConfig looks for problems with the rules in the config without running anything. Assumes the config has
+// already been evaluated and the artifact rule added.
+func CheckConfig(config *model.Config) []*Problem {
+	c := &checker{config: config, failed: make(map[string]bool)}
+
+	for _, rule := range c.sortedRules() {
+		if _, ok := config.Executors[rule.ExecutorName]; !ok {
+			c.report(SeverityError, rule, "unknown executor %s", rule.ExecutorName)
+		}
+		c.checkTemplates(rule)
+	}
+
+	c.checkCycles(c.checkInputs())
+	c.checkReachable()
+	c.checkUnused()
+
+	return c.problems
+}
+
+// CheckRulesInFile parses the file and reports any problems with the rules in it. Errors parsing or evaluating
+// the file are returned as err.
+func CheckRulesInFile(filename string, overrides map[string]string) ([]*Problem, error) {
+	config := model.NewConfig()
+	config.Overrides = overrides
+	config.Executors[model.DefaultExecutorName] = &executor.LocalExec{}
+
+	err := parseFile(config, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Artifacts) > 0 || len(config.AddIfMissing) > 0 {
+		AddArtifactRule(config, nil)
+	}
+
+	return CheckConfig(config), nil
+}
@@ -0,0 +1,160 @@
+package run
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+)
+
+// PlannedRule is what a run would do for one rule
+type PlannedRule struct {
+	Name string
+	// the inputs of each application which would be executed
+	New []*persist.Bindings
+	// applications from previous runs which would be reused
+	Reused []*persist.AppliedRule
+	// applications from previous runs which would be discarded, because they were derived from artifacts that are
+	// no longer defined, were forced to execute again or would be replaced by a new application for the same inputs
+	Invalidated []*persist.AppliedRule
+	// true if some of the new applications couldn't be simulated, so their outputs aren't known
+	notSimulated bool
+}
+
+// DryRun describes what running the rules in a file would do
+type DryRun struct {
+	// sorted by rule name
+	Rules []*PlannedRule
+	// true if some new applications would need to execute before the applications of the rules which consume
+	// their outputs can be determined
+	Incomplete bool
+}
+
+func (stats *RunStats) plannedRule(name string) *PlannedRule {
+	if stats.Planned == nil {
+		stats.Planned = make(map[string]*PlannedRule)
+	}
+	planned, ok := stats.Planned[name]
+	if !ok {
+		planned = &PlannedRule{Name: name}
+		stats.Planned[name] = planned
+	}
+	return planned
+}
+
+func (p *PlannedRule) add(pending PendingRuleApplication) {
+	if pending.existing == nil {
+		p.New = append(p.New, pending.inputs)
+	} else {
+		p.Reused = append(p.Reused, pending.existing)
+	}
+}
+
+// staticOutputs returns the outputs of an application of a rule which has no run statements, as these can be
+// determined without executing anything. Returns false if the outputs can't be known in advance.
+func staticOutputs(config *model.Config, db *persist.DB, pending PendingRuleApplication) ([]*persist.ArtifactProperties, bool) {
+	rule := config.Rules[pending.name]
+	if len(rule.RunStatements) > 0 || rule.Outputs == nil {
+		return nil, false
+	}
+
+	context := newTemplateContext(pending.inputs, config.TemplateVars(), nil)
+	outputs := make([]*persist.ArtifactProperties, len(rule.Outputs))
+	for i, output := range rule.Outputs {
+		props := persist.NewArtifactProperties()
+		for _, prop := range output.Properties {
+			value := expandTemplate(prop.Value, context)
+			if !prop.IsFilename {
+				props.Strings[prop.Name] = value
+				continue
+			}
+			// relative paths are resolved against the work dir, which won't exist
+			if !filepath.IsAbs(value) {
+				return nil, false
+			}
+			sha256, err := computeSha256(value)
+			if err != nil {
+				return nil, false
+			}
+			props.Files[prop.Name] = db.AddFileOrFind(value, sha256)
+		}
+		outputs[i] = props
+	}
+	return outputs, true
+}
+
+// simulateExec records a new application as complete if its outputs can be determined without executing it, so
+// that the applications which consume them can be planned too. Returns false if it couldn't be simulated.
+func simulateExec(config *model.Config, db *persist.DB, pending PendingRuleApplication) (bool, error) {
+	outputs, ok := staticOutputs(config, db, pending)
+	if !ok {
+		return false, nil
+	}
+
+	appID := db.GetNextApplicationID()
+	_, err := db.PersistAppliedRule(appID, pending.name, pending.hash, pending.inputs, "")
+	if err != nil {
+		return false, err
+	}
+	db.AddAppliedRuleToCurrent(appID)
+	return true, recordOutputs(db, appID, outputs)
+}
+
+// DryRunRulesInFile determines which rule applications running the file would execute, reuse or invalidate
+// without executing anything or changing the state directory
+func DryRunRulesInFile(stateDir string, filename string, overrides map[string]string, selection model.RuleSelection, force model.ForceRerun) (*DryRun, error) {
+	config := model.NewConfig()
+	config.StateDir = stateDir
+	config.Overrides = overrides
+	config.Selection = selection
+	config.Force = force
+	config.DryRun = true
+
+	db := persist.NewInMemoryDB(stateDir)
+	defer db.Close()
+
+	err := parseFile(config, filename)
+	if err != nil {
+		return nil, err
+	}
+	_, stats, err := runAndGetGraph(context.Background(), config, db, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DryRun{}
+	invalidated := make(map[int]bool)
+	for _, appliedRule := range append(stats.Forced, stats.Obsolete.AppliedRules...) {
+		planned := stats.plannedRule(appliedRule.Name)
+		planned.Invalidated = append(planned.Invalidated, appliedRule)
+		invalidated[appliedRule.ID] = true
+	}
+	// a previous application for the same inputs is replaced when the rule has changed
+	for _, planned := range stats.Planned {
+		for _, inputs := range planned.New {
+			for _, appliedRule := range db.FindSuperseded(planned.Name, inputs) {
+				if !invalidated[appliedRule.ID] {
+					planned.Invalidated = append(planned.Invalidated, appliedRule)
+					invalidated[appliedRule.ID] = true
+				}
+			}
+		}
+	}
+	for name := range config.Rules {
+		// include rules which would have no applications at all
+		stats.plannedRule(name)
+	}
+	for _, planned := range stats.Planned {
+		result.Incomplete = result.Incomplete || planned.notSimulated
+		sort.Slice(planned.Invalidated, func(i, j int) bool {
+			return planned.Invalidated[i].ID < planned.Invalidated[j].ID
+		})
+		result.Rules = append(result.Rules, planned)
+	}
+	sort.Slice(result.Rules, func(i, j int) bool {
+		return result.Rules[i].Name < result.Rules[j].Name
+	})
+	return result, nil
+}
@@ -0,0 +1,191 @@
+package run
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+)
+
+// EventsVersion is included in every event and is incremented whenever a field is removed or changes meaning.
+// Fields may be added without changing the version.
+const EventsVersion = 1
+
+// the types of events
+const (
+	EventRunStarted    = "run_started"
+	EventRuleEvaluated = "rule_evaluated"
+	EventReused        = "reused"
+	EventStarted       = "started"
+	EventStatus        = "status"
+	EventCompleted     = "completed"
+	EventFailed        = "failed"
+	EventRunCompleted  = "run_completed"
+)
+
+// EventArtifact is an artifact within an event. Files are given as their local paths.
+type EventArtifact struct {
+	ID         int               `json:"id"`
+	Properties map[string]string `json:"properties"`
+}
+
+// EventStats summarizes a run in the run_completed event
+type EventStats struct {
+	Executions int `json:"executions"`
+	Reused     int `json:"reused"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
+}
+
+// Event is a single line of the event log. Which of the optional fields are present depends on the type:
+//
+//	run_started:    rules
+//	rule_evaluated: rule, applications (the number of applications found, new or reused)
+//	reused:         rule, application_id, inputs, outputs
+//	started:        rule, application_id, inputs, work_dir
+//	status:         rule, application_id, status
+//	completed:      rule, application_id, outputs
+//	failed:         rule, application_id, message, logs (name of log to path)
+//	run_completed:  stats
+//
+// inputs maps each input name to an artifact, to a list of artifacts for inputs bound with all, or to null for
+// optional inputs which nothing matched. Like the other fields, it is left out when empty.
+type Event struct {
+	Version       int                    `json:"version"`
+	Time          string                 `json:"time"`
+	Type          string                 `json:"type"`
+	Rule          string                 `json:"rule,omitempty"`
+	ApplicationID *int                   `json:"application_id,omitempty"`
+	Applications  *int                   `json:"applications,omitempty"`
+	Rules         []string               `json:"rules,omitempty"`
+	Inputs        map[string]interface{} `json:"inputs,omitempty"`
+	Outputs       []*EventArtifact       `json:"outputs,omitempty"`
+	WorkDir       string                 `json:"work_dir,omitempty"`
+	Status        string                 `json:"status,omitempty"`
+	Message       string                 `json:"message,omitempty"`
+	Logs          map[string]string      `json:"logs,omitempty"`
+	Stats         *EventStats            `json:"stats,omitempty"`
+}
+
+// EventWriter is an Observer which writes each event as a line of JSON
+type EventWriter struct {
+	encoder *json.Encoder
+	now     func() time.Time
+	db      *persist.DB
+	// the name of the rule of each running application
+	running map[int]string
+	err     error
+}
+
+func NewEventWriter(out io.Writer) *EventWriter {
+	return &EventWriter{encoder: json.NewEncoder(out), now: time.Now, running: make(map[int]string)}
+}
+
+// Err returns the first error encountered writing the events
+func (w *EventWriter) Err() error {
+	return w.err
+}
+
+func (w *EventWriter) write(event *Event) {
+	if w.err != nil {
+		return
+	}
+	event.Version = EventsVersion
+	event.Time = w.now().UTC().Format(time.RFC3339Nano)
+	w.err = w.encoder.Encode(event)
+}
+
+func (w *EventWriter) artifact(artifact *persist.Artifact) *EventArtifact {
+	return &EventArtifact{ID: artifact.GetID(),
+		Properties: artifact.Properties.ToStrMap(func(fileID int) string {
+			return w.db.GetFile(fileID).LocalPath
+		})}
+}
+
+func (w *EventWriter) artifacts(artifacts []*persist.Artifact) []*EventArtifact {
+	result := make([]*EventArtifact, len(artifacts))
+	for i, artifact := range artifacts {
+		result[i] = w.artifact(artifact)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (w *EventWriter) inputs(bindings *persist.Bindings) map[string]interface{} {
+	inputs := make(map[string]interface{})
+	for name, value := range bindings.ByName {
+		if single, ok := value.(*persist.SingleArtifact); ok {
+			if single.IsNull() {
+				inputs[name] = nil
+			} else {
+				inputs[name] = w.artifact(single.GetArtifacts()[0])
+			}
+		} else {
+			inputs[name] = w.artifacts(value.GetArtifacts())
+		}
+	}
+	return inputs
+}
+
+func (w *EventWriter) RunStarted(db *persist.DB, ruleNames []string) {
+	w.db = db
+	w.write(&Event{Type: EventRunStarted, Rules: ruleNames})
+}
+
+func (w *EventWriter) RuleEvaluated(name string, applications int) {
+	w.write(&Event{Type: EventRuleEvaluated, Rule: name, Applications: &applications})
+}
+
+func (w *EventWriter) Reused(appliedRule *persist.AppliedRule) {
+	w.write(&Event{Type: EventReused,
+		Rule:          appliedRule.Name,
+		ApplicationID: &appliedRule.ID,
+		Inputs:        w.inputs(appliedRule.Inputs),
+		Outputs:       w.artifacts(appliedRule.Outputs)})
+}
+
+func (w *EventWriter) Started(appliedRule *persist.AppliedRule, workDir string) {
+	w.running[appliedRule.ID] = appliedRule.Name
+	w.write(&Event{Type: EventStarted,
+		Rule:          appliedRule.Name,
+		ApplicationID: &appliedRule.ID,
+		Inputs:        w.inputs(appliedRule.Inputs),
+		WorkDir:       workDir})
+}
+
+func (w *EventWriter) StatusUpdated(appliedRuleID int, status string) {
+	w.write(&Event{Type: EventStatus, Rule: w.running[appliedRuleID], ApplicationID: &appliedRuleID, Status: status})
+}
+
+func (w *EventWriter) Completed(appliedRule *persist.AppliedRule) {
+	delete(w.running, appliedRule.ID)
+	w.write(&Event{Type: EventCompleted,
+		Rule:          appliedRule.Name,
+		ApplicationID: &appliedRule.ID,
+		Outputs:       w.artifacts(appliedRule.Outputs)})
+}
+
+func (w *EventWriter) Failed(appliedRule *persist.AppliedRule, message string, logs []*model.NameValuePair) {
+	delete(w.running, appliedRule.ID)
+	event := &Event{Type: EventFailed, Rule: appliedRule.Name, ApplicationID: &appliedRule.ID, Message: message}
+	if len(logs) > 0 {
+		event.Logs = make(map[string]string)
+		for _, log := range logs {
+			event.Logs[log.Name] = log.Value
+		}
+	}
+	w.write(event)
+}
+
+func (w *EventWriter) RunCompleted(stats *RunStats) {
+	w.write(&Event{Type: EventRunCompleted,
+		Stats: &EventStats{Executions: stats.Executions,
+			Reused:    stats.ExistingAppliedRules,
+			Succeeded: stats.SuccessfulCompletions,
+			Failed:    stats.FailedCompletions}})
+}
@@ -0,0 +1,86 @@
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readEvents(t *testing.T, out *bytes.Buffer) []*Event {
+	events := make([]*Event, 0)
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var event Event
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, EventsVersion, event.Version)
+		events = append(events, &event)
+	}
+	return events
+}
+
+func eventTypes(events []*Event) []string {
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func TestEventWriter(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	rules := `
+		artifact {'type': 'sample', 'name': 'x'}
+		rule count:
+			inputs: sample={'type': 'sample'}
+			outputs: {'type': 'count', 'name': '{{inputs.sample.name}}'}`
+
+	db, config := parseRules(stateDir, rules)
+	setupLocalExec(config, stateDir)
+	var out bytes.Buffer
+	writer := NewEventWriter(&out)
+	_, _, err = runAndGetGraph(context.Background(), config, db, writer)
+	assert.Nil(t, err)
+	db.Close()
+	assert.Nil(t, writer.Err())
+
+	events := readEvents(t, &out)
+	assert.Equal(t, []string{EventRunStarted,
+		EventRuleEvaluated, EventStarted, EventStatus, EventCompleted,
+		EventRuleEvaluated, EventStarted, EventStatus, EventCompleted,
+		EventRunCompleted}, eventTypes(events))
+
+	assert.Equal(t, []string{ArtifactRuleName, "count"}, events[0].Rules)
+	started := events[6]
+	assert.Equal(t, "count", started.Rule)
+	assert.Equal(t, db.GetWorkDir(*started.ApplicationID), started.WorkDir)
+	sample := started.Inputs["sample"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "sample", "name": "x"}, sample["properties"])
+	completed := events[8]
+	assert.Equal(t, *started.ApplicationID, *completed.ApplicationID)
+	assert.Equal(t, map[string]string{"type": "count", "name": "x"}, completed.Outputs[0].Properties)
+	assert.Equal(t, 2, events[9].Stats.Succeeded)
+
+	// the second time, both applications are reused
+	db, config = parseRules(stateDir, rules)
+	setupLocalExec(config, stateDir)
+	out.Reset()
+	_, _, err = runAndGetGraph(context.Background(), config, db, NewEventWriter(&out))
+	assert.Nil(t, err)
+	db.Close()
+
+	events = readEvents(t, &out)
+	assert.Equal(t, []string{EventRunStarted, EventRuleEvaluated, EventReused, EventRuleEvaluated, EventReused,
+		EventRunCompleted}, eventTypes(events))
+	assert.Equal(t, 1, *events[3].Applications)
+	assert.Equal(t, "count", events[4].Rule)
+	assert.Equal(t, "x", events[4].Outputs[0].Properties["name"])
+}
@@ -0,0 +1,36 @@
+package run
+
+import (
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+)
+
+// isForced returns true if the previous application was selected to be executed again
+func isForced(force *model.ForceRerun, appliedRule *persist.AppliedRule) bool {
+	for _, name := range force.Rules {
+		if appliedRule.Name == name {
+			return true
+		}
+	}
+	if len(force.Query) == 0 && len(force.Predicates) == 0 {
+		return false
+	}
+	for _, output := range appliedRule.Outputs {
+		if output.HasProperties(force.Query) && output.MatchesPredicates(force.Predicates) {
+			return true
+		}
+	}
+	return false
+}
+
+// forceRerun removes the applications selected by config.Force, and those downstream of them, from the history so
+// that the run executes them again. Only applications of the rules in selected are forced, unless selected is nil.
+// Returns the removed applications.
+func forceRerun(config *model.Config, db *persist.DB, selected map[string]bool) []*persist.AppliedRule {
+	return db.InvalidateAppliedRules(func(appliedRule *persist.AppliedRule) bool {
+		if selected != nil && !selected[appliedRule.Name] {
+			return false
+		}
+		return isForced(&config.Force, appliedRule)
+	})
+}
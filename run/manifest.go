@@ -0,0 +1,96 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+)
+
+// manifestWriter writes the artifacts bound to an input to a file so that scripts with many inputs don't need
+// them all passed on the command line. Each manifest is only written once per execution, regardless of how
+// many times it is referenced.
+type manifestWriter struct {
+	inputs  *persist.Bindings
+	builder model.ExecutionBuilder
+	written map[string]string
+}
+
+func newManifestWriter(inputs *persist.Bindings, builder model.ExecutionBuilder) *manifestWriter {
+	return &manifestWriter{inputs: inputs, builder: builder, written: make(map[string]string)}
+}
+
+// write is called from templates as manifest(name, format) and returns the path to the manifest relative to
+// the job dir. format is either "json" or "tsv".
+func (m *manifestWriter) write(name string, format string) (string, error) {
+	key := name + "." + format
+	if filename, ok := m.written[key]; ok {
+		return filename, nil
+	}
+
+	value, ok := m.inputs.ByName[name]
+	if !ok {
+		return "", fmt.Errorf("Cannot write manifest: no input named %s", name)
+	}
+
+	body, err := formatManifest(value.GetArtifacts(), format)
+	if err != nil {
+		return "", err
+	}
+
+	filename, err := m.builder.AddFile(body)
+	if err != nil {
+		return "", err
+	}
+	m.written[key] = filename
+	return filename, nil
+}
+
+func formatManifest(artifacts []*persist.Artifact, format string) ([]byte, error) {
+	rows := make([]map[string]string, len(artifacts))
+	for i, artifact := range artifacts {
+		rows[i] = artifact.Properties.Strings
+	}
+
+	switch format {
+	case "json":
+		return json.MarshalIndent(rows, "", "  ")
+	case "tsv":
+		return formatTSV(rows), nil
+	default:
+		return nil, fmt.Errorf("Unknown manifest format \"%s\" (expected json or tsv)", format)
+	}
+}
+
+var tsvEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// formatTSV writes a header with the union of all property names followed by one row per artifact
+func formatTSV(rows []map[string]string) []byte {
+	nameSet := make(map[string]bool)
+	for _, row := range rows {
+		for name := range row {
+			nameSet[name] = true
+		}
+	}
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+	sb.WriteString(strings.Join(names, "\t"))
+	sb.WriteString("\n")
+	for _, row := range rows {
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = tsvEscaper.Replace(row[name])
+		}
+		sb.WriteString(strings.Join(values, "\t"))
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String())
+}
@@ -0,0 +1,93 @@
+package run
+
+import (
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+)
+
+// Observer is notified as a run progresses. The methods are called from the goroutine which schedules the rules,
+// so they should return quickly.
+type Observer interface {
+	// called before anything is evaluated with the sorted names of the rules which may be evaluated. db must only be
+	// used from within the methods of the observer.
+	RunStarted(db *persist.DB, ruleNames []string)
+	// the query of a rule was executed and found the given number of applications, either new or reused
+	RuleEvaluated(name string, applications int)
+	// a previous application was reused instead of executing it again
+	Reused(appliedRule *persist.AppliedRule)
+	Started(appliedRule *persist.AppliedRule, workDir string)
+	// the executor reported a change in the status of a running application
+	StatusUpdated(appliedRuleID int, status string)
+	// the application succeeded. appliedRule.Outputs are the artifacts it produced.
+	Completed(appliedRule *persist.AppliedRule)
+	Failed(appliedRule *persist.AppliedRule, message string, logs []*model.NameValuePair)
+	RunCompleted(stats *RunStats)
+}
+
+// nopObserver ignores everything, and is used when the caller doesn't need to observe the run
+type nopObserver struct{}
+
+func (nopObserver) RunStarted(db *persist.DB, ruleNames []string)            {}
+func (nopObserver) RuleEvaluated(name string, applications int)              {}
+func (nopObserver) Reused(appliedRule *persist.AppliedRule)                  {}
+func (nopObserver) Started(appliedRule *persist.AppliedRule, workDir string) {}
+func (nopObserver) StatusUpdated(appliedRuleID int, status string)           {}
+func (nopObserver) Completed(appliedRule *persist.AppliedRule)               {}
+func (nopObserver) Failed(appliedRule *persist.AppliedRule, message string, logs []*model.NameValuePair) {
+}
+func (nopObserver) RunCompleted(stats *RunStats) {}
+
+type multiObserver []Observer
+
+// NewMultiObserver returns an Observer which notifies each of the observers in turn
+func NewMultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+func (m multiObserver) RunStarted(db *persist.DB, ruleNames []string) {
+	for _, o := range m {
+		o.RunStarted(db, ruleNames)
+	}
+}
+
+func (m multiObserver) RuleEvaluated(name string, applications int) {
+	for _, o := range m {
+		o.RuleEvaluated(name, applications)
+	}
+}
+
+func (m multiObserver) Reused(appliedRule *persist.AppliedRule) {
+	for _, o := range m {
+		o.Reused(appliedRule)
+	}
+}
+
+func (m multiObserver) Started(appliedRule *persist.AppliedRule, workDir string) {
+	for _, o := range m {
+		o.Started(appliedRule, workDir)
+	}
+}
+
+func (m multiObserver) StatusUpdated(appliedRuleID int, status string) {
+	for _, o := range m {
+		o.StatusUpdated(appliedRuleID, status)
+	}
+}
+
+func (m multiObserver) Completed(appliedRule *persist.AppliedRule) {
+	for _, o := range m {
+		o.Completed(appliedRule)
+	}
+}
+
+func (m multiObserver) Failed(appliedRule *persist.AppliedRule, message string, logs []*model.NameValuePair) {
+	for _, o := range m {
+		o.Failed(appliedRule, message, logs)
+	}
+}
+
+func (m multiObserver) RunCompleted(stats *RunStats) {
+	for _, o := range m {
+		o.RunCompleted(stats)
+	}
+}
@@ -0,0 +1,324 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pgm/goconseq/adhoc"
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+)
+
+// the most work dirs listed for a rule in the summary, so that lines don't wrap
+const maxDirsShown = 3
+
+type ruleProgress struct {
+	// true until the rule is first evaluated
+	pending bool
+	done    int
+	failed  int
+	skipped int
+}
+
+type runningApplication struct {
+	name    string
+	workDir string
+	started time.Time
+	status  string
+}
+
+// Progress is an Observer which reports the progress of a run. Each application which is started, completes or
+// fails is written as a line. If interactive, a summary of the state of each rule and of the running applications
+// is kept below those lines and redrawn as the run progresses, which requires a terminal.
+type Progress struct {
+	mutex       sync.Mutex
+	out         io.Writer
+	interactive bool
+	now         func() time.Time
+
+	started   time.Time
+	ruleNames []string
+	rules     map[string]*ruleProgress
+	running   map[int]*runningApplication
+
+	// the number of lines of the summary currently on the screen
+	linesDrawn int
+	stopTicker chan bool
+}
+
+func NewProgress(out io.Writer, interactive bool) *Progress {
+	return &Progress{out: out,
+		interactive: interactive,
+		now:         time.Now,
+		rules:       make(map[string]*ruleProgress),
+		running:     make(map[int]*runningApplication)}
+}
+
+func formatElapsed(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func (p *Progress) rule(name string) *ruleProgress {
+	r, ok := p.rules[name]
+	if !ok {
+		r = &ruleProgress{}
+		p.rules[name] = r
+		p.ruleNames = append(p.ruleNames, name)
+		sort.Strings(p.ruleNames)
+	}
+	return r
+}
+
+func (p *Progress) totals() (pending int, done int, failed int, skipped int) {
+	for _, r := range p.rules {
+		if r.pending {
+			pending++
+		}
+		done += r.done
+		failed += r.failed
+		skipped += r.skipped
+	}
+	return
+}
+
+// runningDirs returns the work dirs of the running applications of a rule along with how long they've been
+// running and their latest status
+func (p *Progress) runningDirs(name string) (count int, dirs string) {
+	ids := make([]int, 0)
+	for id, app := range p.running {
+		if app.name == name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	descriptions := make([]string, 0, maxDirsShown+1)
+	for i, id := range ids {
+		if i == maxDirsShown {
+			descriptions = append(descriptions, fmt.Sprintf("+%d more", len(ids)-maxDirsShown))
+			break
+		}
+		app := p.running[id]
+		details := formatElapsed(p.now().Sub(app.started))
+		if app.status != "" {
+			details += " " + app.status
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", app.workDir, details))
+	}
+	return len(ids), strings.Join(descriptions, ", ")
+}
+
+// summary returns a table with a row for each rule and state which has any applications
+func (p *Progress) summary() string {
+	pending, done, failed, skipped := p.totals()
+	var sb bytes.Buffer
+	fmt.Fprintf(&sb, "%d running, %d rules pending, %d done, %d failed, %d skipped (%s elapsed)\n",
+		len(p.running), pending, done, failed, skipped, formatElapsed(p.now().Sub(p.started)))
+
+	rows := make([]adhoc.KVPairs, 0)
+	addRow := func(state string, name string, count int, dirs string) {
+		countStr := ""
+		if count > 0 {
+			countStr = strconv.Itoa(count)
+		}
+		rows = append(rows, adhoc.KVPairs{"state": state, "rule": name, "count": countStr, "dirs": dirs})
+	}
+	for _, name := range p.ruleNames {
+		if count, dirs := p.runningDirs(name); count > 0 {
+			addRow("running", name, count, dirs)
+		}
+	}
+	for _, name := range p.ruleNames {
+		if p.rules[name].pending {
+			addRow("pending", name, 0, "")
+		}
+	}
+	for _, name := range p.ruleNames {
+		r := p.rules[name]
+		if r.failed > 0 {
+			addRow("failed", name, r.failed, "")
+		}
+		if r.done > 0 {
+			addRow("done", name, r.done, "")
+		}
+		if r.skipped > 0 {
+			addRow("skipped", name, r.skipped, "")
+		}
+	}
+	if len(rows) > 0 {
+		sb.WriteString("\n")
+		adhoc.PrintTable(&sb, rows, []string{"state", "rule", "count", "dirs"}, "  ")
+	}
+	return sb.String()
+}
+
+func (p *Progress) clear() {
+	if p.linesDrawn > 0 {
+		// move the cursor to the start of the summary and erase everything after it
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.linesDrawn)
+		p.linesDrawn = 0
+	}
+}
+
+func (p *Progress) draw() {
+	if !p.interactive {
+		return
+	}
+	summary := p.summary()
+	io.WriteString(p.out, summary)
+	p.linesDrawn = strings.Count(summary, "\n")
+}
+
+func (p *Progress) redraw() {
+	p.clear()
+	p.draw()
+}
+
+// printf writes a line above the summary
+func (p *Progress) printf(format string, args ...interface{}) {
+	p.clear()
+	fmt.Fprintf(p.out, format, args...)
+	p.draw()
+}
+
+func (p *Progress) RunStarted(db *persist.DB, ruleNames []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.started = p.now()
+	for _, name := range ruleNames {
+		p.rule(name).pending = true
+	}
+	p.draw()
+
+	if p.interactive {
+		// redraw periodically so the elapsed times are kept up to date
+		p.stopTicker = make(chan bool)
+		go func(stop chan bool) {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					p.mutex.Lock()
+					p.redraw()
+					p.mutex.Unlock()
+				}
+			}
+		}(p.stopTicker)
+	}
+}
+
+func (p *Progress) RuleEvaluated(name string, applications int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rule(name).pending = false
+	p.redraw()
+}
+
+func (p *Progress) Reused(appliedRule *persist.AppliedRule) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rule(appliedRule.Name).skipped++
+	p.redraw()
+}
+
+func (p *Progress) Started(appliedRule *persist.AppliedRule, workDir string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.running[appliedRule.ID] = &runningApplication{name: appliedRule.Name, workDir: workDir, started: p.now()}
+	p.printf("Started %s (r%d) in %s\n", appliedRule.Name, appliedRule.ID, workDir)
+}
+
+func (p *Progress) StatusUpdated(appliedRuleID int, status string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	app, ok := p.running[appliedRuleID]
+	if !ok {
+		return
+	}
+	app.status = status
+	if p.interactive {
+		p.redraw()
+	} else {
+		p.printf("Status of %s (r%d): %s\n", app.name, appliedRuleID, status)
+	}
+}
+
+// finished stops tracking a running application, returning how long it ran for
+func (p *Progress) finished(appliedRuleID int) time.Duration {
+	app, ok := p.running[appliedRuleID]
+	if !ok {
+		return 0
+	}
+	delete(p.running, appliedRuleID)
+	return p.now().Sub(app.started)
+}
+
+func (p *Progress) Completed(appliedRule *persist.AppliedRule) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rule(appliedRule.Name).done++
+	elapsed := p.finished(appliedRule.ID)
+	p.printf("Completed %s (r%d) in %s\n", appliedRule.Name, appliedRule.ID, formatElapsed(elapsed))
+}
+
+func (p *Progress) Failed(appliedRule *persist.AppliedRule, message string, logs []*model.NameValuePair) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rule(appliedRule.Name).failed++
+	elapsed := p.finished(appliedRule.ID)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Failed %s (r%d) after %s: %s\n", appliedRule.Name, appliedRule.ID, formatElapsed(elapsed), message)
+	for _, failureLog := range logs {
+		tail, err := ReadTail(failureLog.Value, 20)
+		if err == nil {
+			if tail == "" {
+				fmt.Fprintf(&sb, "Log of %s (%s) was empty\n", failureLog.Name, failureLog.Value)
+			} else {
+				fmt.Fprintf(&sb, "Showing last 20 lines of %s (%s):\n%s\n", failureLog.Name, failureLog.Value, tail)
+			}
+		} else {
+			fmt.Fprintf(&sb, "Could not read %s (%s): %s\n", failureLog.Name, failureLog.Value, err)
+		}
+	}
+	p.printf("%s", sb.String())
+}
+
+func (p *Progress) RunCompleted(stats *RunStats) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stopTicker != nil {
+		close(p.stopTicker)
+		p.stopTicker = nil
+	}
+	p.clear()
+
+	notRun := make([]string, 0)
+	for _, name := range p.ruleNames {
+		if p.rules[name].pending {
+			notRun = append(notRun, name)
+		}
+	}
+	if len(notRun) > 0 {
+		fmt.Fprintf(p.out, "Never ran because nothing produced their inputs: %s\n", strings.Join(notRun, ", "))
+	}
+	_, done, failed, skipped := p.totals()
+	fmt.Fprintf(p.out, "%d done, %d failed, %d skipped in %s\n", done, failed, skipped, formatElapsed(p.now().Sub(p.started)))
+}
@@ -0,0 +1,80 @@
+package run
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgm/goconseq/persist"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProgress(interactive bool) (*Progress, *bytes.Buffer, *time.Time) {
+	var out bytes.Buffer
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewProgress(&out, interactive)
+	p.now = func() time.Time { return now }
+	return p, &out, &now
+}
+
+func TestProgressWithoutTerminal(t *testing.T) {
+	p, out, now := newTestProgress(false)
+
+	a := &persist.AppliedRule{ID: 1, Name: "a"}
+	b := &persist.AppliedRule{ID: 2, Name: "b"}
+	p.RunStarted(nil, []string{"a", "b", "c"})
+	p.RuleEvaluated("a", 2)
+	p.Reused(&persist.AppliedRule{ID: 3, Name: "a"})
+	p.Started(a, "state/r1")
+	p.StatusUpdated(1, "Executing")
+	*now = now.Add(5 * time.Second)
+	p.Completed(a)
+	p.RuleEvaluated("b", 1)
+	p.Started(b, "state/r2")
+	p.Failed(b, "Exit code was non-zero: 1", nil)
+	p.RunCompleted(&RunStats{})
+
+	assert.Equal(t, `Started a (r1) in state/r1
+Status of a (r1): Executing
+Completed a (r1) in 5s
+Started b (r2) in state/r2
+Failed b (r2) after 0s: Exit code was non-zero: 1
+Never ran because nothing produced their inputs: c
+1 done, 1 failed, 1 skipped in 5s
+`, out.String())
+}
+
+func TestProgressSummary(t *testing.T) {
+	p, out, now := newTestProgress(true)
+
+	p.RunStarted(nil, []string{"a", "b"})
+	p.RuleEvaluated("a", 1)
+	p.Started(&persist.AppliedRule{ID: 1, Name: "a"}, "state/r1")
+	p.StatusUpdated(1, "Executing")
+	// the summary is also redrawn in the background
+	p.mutex.Lock()
+	*now = now.Add(90 * time.Second)
+	p.mutex.Unlock()
+
+	p.mutex.Lock()
+	summary := p.summary()
+	p.mutex.Unlock()
+	lines := strings.Split(summary, "\n")
+	assert.Equal(t, "1 running, 1 rules pending, 0 done, 0 failed, 0 skipped (1m30s elapsed)", lines[0])
+	assert.Contains(t, lines[4], "running")
+	assert.Contains(t, lines[4], "state/r1 (1m30s Executing)")
+	assert.Contains(t, lines[5], "pending")
+	assert.Contains(t, lines[5], "b")
+
+	// the summary is erased before each line is written and then drawn again below it
+	p.mutex.Lock()
+	out.Reset()
+	p.mutex.Unlock()
+	p.Completed(&persist.AppliedRule{ID: 1, Name: "a"})
+	assert.True(t, strings.HasPrefix(out.String(), "\x1b["))
+	assert.Contains(t, out.String(), "Completed a (r1) in 1m30s\n0 running")
+
+	p.RunCompleted(&RunStats{})
+	assert.True(t, strings.HasSuffix(out.String(), "Never ran because nothing produced their inputs: b\n1 done, 0 failed, 0 skipped in 1m30s\n"))
+}
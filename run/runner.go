@@ -7,9 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/flosch/pongo2"
@@ -39,13 +42,20 @@ func (e *execListener) UpdateStatus(status string) {
 	e.c <- &Update{ruleApplicationID: e.ruleApplicationID, status: &status}
 }
 
-func rulesToGraph(rules map[string]*model.Rule) *graph.Graph {
+// RulesToGraph builds the graph of which rules consume the outputs of which other rules
+func RulesToGraph(rules map[string]*model.Rule) *graph.Graph {
 	gb := graph.NewGraphBuilder()
 	for _, rule := range rules {
 		gb.AddRule(rule.Name)
 		for _, queryProps := range rule.GetQueryProps() {
 			gb.AddRuleConsumes(rule.Name, false, queryProps)
 		}
+		for _, queryProps := range rule.GetAllQueryProps() {
+			gb.AddRuleConsumes(rule.Name, true, queryProps)
+		}
+		for _, queryProps := range rule.GetOptionalQueryProps() {
+			gb.AddRuleOptionallyConsumes(rule.Name, queryProps)
+		}
 		for _, outputProps := range rule.GetOutputProps() {
 			gb.AddRuleProduces(rule.Name, outputProps)
 		}
@@ -123,20 +133,39 @@ func localizeArtifact(localizer model.ExecutionBuilder, artifact *persist.Artifa
 	return &persist.Artifact{Properties: newProps}
 }
 
-func expandTemplate(s string, inputs *persist.Bindings) string {
-	// return s
-	template := pongo2.Must(pongo2.FromString(s))
+// newTemplateContext creates the variables available when expanding templates. Inputs bound to a single artifact
+// are exposed as a map of its properties and inputs bound with "all" as a list of such maps. If builder is not nil,
+// templates can also call manifest(name, format) to write the artifacts bound to an input to a file in the job dir.
+func newTemplateContext(inputs *persist.Bindings, vars map[string]string, builder model.ExecutionBuilder) pongo2.Context {
 	inputsContext := map[string]interface{}{}
 	for name, value := range inputs.ByName {
-		_, ok := value.(*persist.SingleArtifact)
-		if ok {
+		single, ok := value.(*persist.SingleArtifact)
+		if ok && single.IsNull() {
+			// optional inputs which didn't match anything can be tested with {% if inputs.name %}
+			inputsContext[name] = nil
+		} else if ok {
 			strings := value.GetArtifacts()[0].Properties.Strings
 			inputsContext[name] = strings
 		} else {
-			log.Printf("TODO: expandTemplate does not handle multiple artifact variables")
+			artifacts := value.GetArtifacts()
+			list := make([]map[string]string, len(artifacts))
+			for i, artifact := range artifacts {
+				list[i] = artifact.Properties.Strings
+			}
+			inputsContext[name] = list
 		}
 	}
-	result, err := template.Execute(map[string]interface{}{"inputs": inputsContext})
+
+	context := pongo2.Context{"inputs": inputsContext, "config": vars}
+	if builder != nil {
+		context["manifest"] = newManifestWriter(inputs, builder).write
+	}
+	return context
+}
+
+func expandTemplate(s string, context pongo2.Context) string {
+	template := pongo2.Must(pongo2.FromString(s))
+	result, err := template.Execute(context)
 	if err != nil {
 		panic(err)
 	}
@@ -189,11 +218,12 @@ func renderOutputsAsText(builder model.ExecutionBuilder, outputs []map[string]in
 	return sb.String()
 }
 
-func expandRunStatements(runWith []*model.RunWithStatement, inputs *persist.Bindings, outputs []model.RuleOutput,
+func expandRunStatements(runWith []*model.RunWithStatement, inputs *persist.Bindings, vars map[string]string, outputs []model.RuleOutput,
 	localPathLookup func(fileID int) string, builder model.ExecutionBuilder) []*model.RunWithStatement {
+	context := newTemplateContext(inputs, vars, builder)
 	result := make([]*model.RunWithStatement, len(runWith))
 	for i, r := range runWith {
-		result[i] = &model.RunWithStatement{Executable: expandTemplate(r.Executable, inputs), Script: expandTemplate(r.Script, inputs)}
+		result[i] = &model.RunWithStatement{Executable: expandTemplate(r.Executable, context), Script: expandTemplate(r.Script, context)}
 	}
 	if outputs != nil {
 		expandedOutputs := make([]map[string]interface{}, len(outputs))
@@ -201,7 +231,7 @@ func expandRunStatements(runWith []*model.RunWithStatement, inputs *persist.Bind
 			expandedOutputs[i] = transformRuleOutput(&output,
 				localPathLookup,
 				func(x string) string {
-					return expandTemplate(x, inputs)
+					return expandTemplate(x, context)
 				})
 		}
 		outputsText := renderOutputsAsText(builder, expandedOutputs)
@@ -226,6 +256,12 @@ type RunStats struct {
 	Executions            int
 	SuccessfulCompletions int
 	FailedCompletions     int
+	// work derived from artifacts which are no longer defined in the config
+	Obsolete *persist.ObsoleteSet
+	// what would be done for each rule, only recorded for dry runs
+	Planned map[string]*PlannedRule
+	// previous applications which were discarded so they would be executed again
+	Forced []*persist.AppliedRule
 }
 
 func computeSha256(filename string) (string, error) {
@@ -243,59 +279,152 @@ func computeSha256(filename string) (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func AddArtifactRule(c *model.Config, fileRepo model.FileRepository) {
-	outputs := make([]model.RuleOutput, 0, len(c.Artifacts))
-	log.Printf("Warning: need to change AddArtifactRule to create one rule per artifact")
+// ArtifactRuleName is the name of the synthetic rule which emits the artifacts defined in the config
+const ArtifactRuleName = "<artifact rule>"
 
-	for _, artifact := range c.Artifacts {
-		output := model.RuleOutput{Properties: make([]model.RuleOutputProperty, 0, len(artifact))}
+func artifactRuleOutput(artifact map[string]model.ArtifactValue) model.RuleOutput {
+	output := model.RuleOutput{Properties: make([]model.RuleOutputProperty, 0, len(artifact))}
 
-		for key, value := range artifact {
-			if value.IsFilename {
-				filename := value.Value
-				sha256, err := computeSha256(filename)
-				if err != nil {
-					log.Panicf("Could not read %s: %s", filename, err)
-				}
+	for key, value := range artifact {
+		if value.IsFilename {
+			// results are read relative to the job's work dir, so the path needs to be absolute
+			filename, err := filepath.Abs(value.Value)
+			if err != nil {
+				log.Panicf("Could not get absolute path of %s: %s", value.Value, err)
+			}
+			sha256, err := computeSha256(filename)
+			if err != nil {
+				log.Panicf("Could not read %s: %s", filename, err)
+			}
 
-				// fileID := fileRepo.AddFileOrFind(filename, sha256)
+			// fileID := fileRepo.AddFileOrFind(filename, sha256)
 
-				// // output.AddPropertyString("type", model.FileRefType)
-				output.AddPropertyString(key+"$sha256", sha256)
-				// // output.AddPropertyString("filename", filename)
-				output.AddPropertyFilename(key, value.Value)
-			} else {
-				output.AddPropertyString(key, value.Value)
-			}
+			// // output.AddPropertyString("type", model.FileRefType)
+			output.AddPropertyString(key+"$sha256", sha256)
+			// // output.AddPropertyString("filename", filename)
+			output.AddPropertyFilename(key, filename)
+		} else {
+			output.AddPropertyString(key, value.Value)
 		}
+	}
 
-		outputs = append(outputs, output)
+	return output
+}
+
+// existingArtifactOutput returns an output which recreates the artifact previously produced by the artifact rule
+// which has the same non-file properties as the given artifact. Returns nil if there is no such artifact.
+func existingArtifactOutput(db *persist.DB, artifact map[string]model.ArtifactValue) *model.RuleOutput {
+	keyProps := make(map[string]string)
+	fileProps := make([]string, 0)
+	for key, value := range artifact {
+		if value.IsFilename {
+			fileProps = append(fileProps, key)
+		} else {
+			keyProps[key] = value.Value
+		}
+	}
+
+	existing := db.FindArtifactByKey(ArtifactRuleName, keyProps, fileProps)
+	if existing == nil {
+		return nil
+	}
+
+	output := &model.RuleOutput{}
+	for key, value := range existing.Properties.Strings {
+		output.AddPropertyString(key, value)
+	}
+	for key, fileID := range existing.Properties.Files {
+		filename, err := filepath.Abs(db.GetFile(fileID).LocalPath)
+		if err != nil {
+			log.Panicf("Could not get absolute path of %s: %s", db.GetFile(fileID).LocalPath, err)
+		}
+		output.AddPropertyFilename(key, filename)
+	}
+	return output
+}
+
+// AddArtifactRule adds a rule which produces all of the artifacts defined in the config. If db is nil, the
+// properties of existing artifacts aren't reused for add-if-missing statements.
+func AddArtifactRule(c *model.Config, db *persist.DB) {
+	outputs := make([]model.RuleOutput, 0, len(c.Artifacts)+len(c.AddIfMissing))
+	log.Printf("Warning: need to change AddArtifactRule to create one rule per artifact")
+
+	for _, artifact := range c.Artifacts {
+		outputs = append(outputs, artifactRuleOutput(artifact))
 	}
 
-	rule := &model.Rule{Name: "<artifact rule>",
+	// artifacts from add-if-missing statements keep the properties of the existing artifact, so that changes
+	// to the files they reference don't result in downstream rules being run again
+	for _, artifact := range c.AddIfMissing {
+		var output *model.RuleOutput
+		if db != nil {
+			output = existingArtifactOutput(db, artifact)
+		}
+		if output == nil {
+			outputs = append(outputs, artifactRuleOutput(artifact))
+		} else {
+			outputs = append(outputs, *output)
+		}
+	}
+
+	rule := &model.Rule{Name: ArtifactRuleName,
 		Outputs:      outputs,
 		ExecutorName: model.DefaultExecutorName}
 
 	c.AddRule(rule)
 }
 
-func runAndGetGraph(context context.Context, config *model.Config, db *persist.DB) (*graph.Graph, *RunStats) {
+// runAndGetGraph runs the rules in the config. observer may be nil.
+func runAndGetGraph(context context.Context, config *model.Config, db *persist.DB, observer Observer) (*graph.Graph, *RunStats, error) {
+	if observer == nil {
+		observer = nopObserver{}
+	}
+
+	err := checkRuleNames(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// forcing a rule which isn't selected would remove its applications from the history without running it again
+	selected := selectedRuleNames(config)
+	forced := forceRerun(config, db, selected)
+
 	// make a synthetic rule which emits all the artifacts in the config
-	if len(config.Artifacts) > 0 {
+	if len(config.Artifacts) > 0 || len(config.AddIfMissing) > 0 {
 		AddArtifactRule(config, db)
 	}
 
 	// load rules into memory
-	execGraph := rulesToGraph(config.Rules)
+	execGraph := RulesToGraph(config.Rules)
+	if !config.Selection.IsEmpty() {
+		// rules which aren't selected are dropped so they are never evaluated
+		config.Rules = selectRules(config, execGraph)
+		execGraph = RulesToGraph(config.Rules)
+	}
 
-	stats := innerRun(context, config, execGraph, db)
+	stats := innerRun(context, config, execGraph, db, observer)
+	stats.Forced = forced
+	if _, ok := config.Rules[ArtifactRuleName]; ok || config.Selection.IsEmpty() {
+		stats.Obsolete = db.FindObsolete(ArtifactRuleName)
+	} else {
+		// the artifacts weren't added in this run, so nothing can be said about which are obsolete
+		stats.Obsolete = &persist.ObsoleteSet{}
+	}
+	observer.RunCompleted(stats)
 
-	return execGraph, stats
+	return execGraph, stats, nil
 }
 
-func innerRun(context context.Context, config *model.Config, execGraph *graph.Graph, db *persist.DB) *RunStats {
+func innerRun(context context.Context, config *model.Config, execGraph *graph.Graph, db *persist.DB, observer Observer) *RunStats {
 	var stats RunStats
 
+	ruleNames := make([]string, 0, len(config.Rules))
+	for name := range config.Rules {
+		ruleNames = append(ruleNames, name)
+	}
+	sort.Strings(ruleNames)
+	observer.RunStarted(db, ruleNames)
+
 	localPathLookup := func(fileID int) string {
 		return db.GetFile(fileID).LocalPath
 	}
@@ -314,6 +443,7 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 			}
 			if update.status != nil {
 				log.Printf("ID: %d status: %s", update.ruleApplicationID, *update.status)
+				observer.StatusUpdated(update.ruleApplicationID, *update.status)
 			}
 		}
 	}
@@ -333,9 +463,24 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 			hash := rule.Hash()
 			log.Printf("rule %s hash: %s", name, hash)
 			pendings := GetPendingRuleApplications(db, name, hash, query, config.ReplayOnly)
+			observer.RuleEvaluated(name, len(pendings))
 
 			for _, pending := range pendings {
-				if pending.existing == nil {
+				if config.DryRun {
+					stats.plannedRule(name).add(pending)
+				}
+				if pending.existing == nil && config.DryRun {
+					simulated, err := simulateExec(config, db, pending)
+					if err != nil {
+						return nil, err
+					}
+					if simulated {
+						plan.Started(pending.name)
+						completions = append(completions, pending.name)
+					} else {
+						stats.plannedRule(name).notSimulated = true
+					}
+				} else if pending.existing == nil {
 					stats.Executions++
 
 					appID := db.GetNextApplicationID()
@@ -346,6 +491,7 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 						return nil, err
 					}
 					db.AddAppliedRuleToCurrent(appID)
+					observer.Started(appliedRule, db.GetWorkDir(appID))
 
 					// update map tracking tasks current running and execution plan
 					plan.Started(pending.name)
@@ -354,6 +500,7 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 					stats.ExistingAppliedRules++
 
 					db.AddAppliedRuleToCurrent(pending.existing.ID)
+					observer.Reused(pending.existing)
 					plan.Started(pending.name)
 					completions = append(completions, pending.name)
 				}
@@ -417,6 +564,13 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 			if err != nil {
 				success = false
 				failureMessage = fmt.Sprintf("Could not read results.json in %s: %s", workDir, err.Error())
+			} else {
+				rule := config.Rules[db.GetAppliedRule(ruleApplicationID).Name]
+				err = checkExpectedOutputs(rule, outputs)
+				if err != nil {
+					success = false
+					failureMessage = err.Error()
+				}
 			}
 		} else {
 			failureMessage = completionState.FailureMessage
@@ -424,24 +578,8 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 		}
 
 		if success {
-			// write all of the artifacts to the DB
-			outputArtifacts := make([]*persist.Artifact, len(outputs))
 			log.Printf("Completed %s", running[ruleApplicationID])
-			for i, props := range outputs {
-				log.Printf("output artifact %d: %s", i, props.String())
-				artifact := db.GetArtifactFromHistory(props)
-				if artifact == nil {
-					var err error
-					artifact, err = db.PersistArtifact(props)
-					if err != nil {
-						panic(err)
-					}
-				}
-				outputArtifacts[i] = artifact
-			}
-
-			// mark applied rule as complete
-			err := db.UpdateAppliedRuleComplete(ruleApplicationID, outputArtifacts)
+			err := recordOutputs(db, ruleApplicationID, outputs)
 			if err != nil {
 				failureMessage = err.Error()
 				success = false
@@ -449,6 +587,7 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 				// notify the scheduler that this rule completed
 				stats.SuccessfulCompletions++
 				appliedRule := db.GetAppliedRule(ruleApplicationID)
+				observer.Completed(appliedRule)
 				completionQueue = append(completionQueue, appliedRule.Name)
 			}
 		}
@@ -457,17 +596,12 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 			stats.FailedCompletions++
 
 			log.Printf("Error: %s", failureMessage)
-			for _, failureLog := range failureLogs {
-				tail, err := readTail(failureLog.Value, 20)
-				if err == nil {
-					if tail == "" {
-						fmt.Printf("Log of %s (%s) was empty\n", failureLog.Name, failureLog.Value)
-					} else {
-						fmt.Printf("Showing last 20 lines of %s (%s):\n%s\n", failureLog.Name, failureLog.Value, tail)
-					}
-				} else {
-					fmt.Printf("Could not read %s (%s): %s\n", failureLog.Name, failureLog.Value, err)
-				}
+			observer.Failed(db.GetAppliedRule(ruleApplicationID), failureMessage, failureLogs)
+
+			// lets gc tell the work dir of a failed application from one which was deleted for other reasons
+			failureFile := path.Join(db.GetWorkDir(ruleApplicationID), persist.FailureFileName)
+			if err := ioutil.WriteFile(failureFile, []byte(failureMessage+"\n"), 0666); err != nil {
+				log.Printf("Could not write %s: %s", failureFile, err)
 			}
 
 			err := db.DeleteAppliedRule(ruleApplicationID)
@@ -480,10 +614,31 @@ func innerRun(context context.Context, config *model.Config, execGraph *graph.Gr
 	return &stats
 }
 
+// recordOutputs writes the artifacts to the DB, reusing any identical artifacts from the history, and marks the
+// application as complete
+func recordOutputs(db *persist.DB, ruleApplicationID int, outputs []*persist.ArtifactProperties) error {
+	outputArtifacts := make([]*persist.Artifact, len(outputs))
+	for i, props := range outputs {
+		log.Printf("output artifact %d: %s", i, props.String())
+		artifact := db.GetArtifactFromHistory(props)
+		if artifact == nil {
+			var err error
+			artifact, err = db.PersistArtifact(props)
+			if err != nil {
+				return err
+			}
+		}
+		outputArtifacts[i] = artifact
+	}
+
+	return db.UpdateAppliedRuleComplete(ruleApplicationID, outputArtifacts)
+}
+
 // only attempt to read 1MB at most
 const MaxTailSize = 1024 * 1024
 
-func readTail(filename string, maxLines int) (string, error) {
+// ReadTail returns the last maxLines lines of a file, looking no further back than MaxTailSize bytes
+func ReadTail(filename string, maxLines int) (string, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return "", err
@@ -526,7 +681,7 @@ func startExec(context context.Context, config *model.Config, localPathLookup fu
 	localizedInputs := inputs.Transform(func(artifact *persist.Artifact) *persist.Artifact {
 		return localizeArtifact(builder, artifact)
 	})
-	runStatements := expandRunStatements(rule.RunStatements, localizedInputs, rule.Outputs, localPathLookup, builder)
+	runStatements := expandRunStatements(rule.RunStatements, localizedInputs, config.TemplateVars(), rule.Outputs, localPathLookup, builder)
 	builder.Prepare(runStatements)
 
 	process, err := builder.Start(context)
@@ -586,19 +741,41 @@ func readResultOutputs(workDir string, getFileID func(filename string) (int, err
 	return outputs, nil
 }
 
+// checkExpectedOutputs returns an error if the rule declared the outputs it expects and one of the outputs
+// doesn't match any of them
+func checkExpectedOutputs(rule *model.Rule, outputs []*persist.ArtifactProperties) error {
+	if rule.ExpectedOutputs == nil {
+		return nil
+	}
+	for _, output := range outputs {
+		props := output.ToStrMap(nil)
+		matched := false
+		for _, template := range rule.ExpectedOutputs {
+			if template.Matches(props) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("Rule %s produced %s which does not match any of the expected outputs", rule.Name, output.String())
+		}
+	}
+	return nil
+}
+
 func parseFile(config *model.Config, filename string) error {
 	statements, err := parser.ParseFile(filename)
 	if err != nil {
 		return err
 	}
-	statements.Eval(config)
-	return nil
+	return statements.Eval(config)
 }
 
-func ReplayAndExport(stateDir string, filename string) (graph *graph.Graph, db *persist.DB, err error) {
+func ReplayAndExport(stateDir string, filename string, overrides map[string]string) (graph *graph.Graph, db *persist.DB, err error) {
 	config := model.NewConfig()
 	config.ReplayOnly = true
 	config.StateDir = stateDir
+	config.Overrides = overrides
 
 	db = persist.NewDB(stateDir)
 	db.DisableUpdates()
@@ -609,23 +786,56 @@ func ReplayAndExport(stateDir string, filename string) (graph *graph.Graph, db *
 		return nil, nil, err
 	}
 
-	graph, _ = runAndGetGraph(context.Background(), config, db)
+	graph, _, err = runAndGetGraph(context.Background(), config, db, nil)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
 	return graph, db, nil
 }
 
-func RunRulesInFile(stateDir string, filename string) (*RunStats, error) {
+// dbFiles makes the files recorded in the DB available to the local executor. Paths are made absolute because
+// each rule runs within its own work dir.
+type dbFiles struct {
+	db *persist.DB
+}
+
+func (f *dbFiles) EnsureLocallyAccessible(fileID int) (string, error) {
+	file := f.db.GetFile(fileID)
+	if file == nil {
+		return "", fmt.Errorf("Unknown file %d", fileID)
+	}
+	return filepath.Abs(file.LocalPath)
+}
+
+func (f *dbFiles) EnsureGloballyAccessible(fileID int) (string, error) {
+	file := f.db.GetFile(fileID)
+	if file == nil {
+		return "", fmt.Errorf("Unknown file %d", fileID)
+	}
+	if file.GlobalPath == "" {
+		return "", fmt.Errorf("File %d (%s) has no global path", fileID, file.LocalPath)
+	}
+	return file.GlobalPath, nil
+}
+
+// RunRulesInFile runs the rules in filename, reusing the results in stateDir where possible. observer may be nil.
+func RunRulesInFile(stateDir string, filename string, overrides map[string]string, selection model.RuleSelection, force model.ForceRerun, observer Observer) (*RunStats, error) {
 	config := model.NewConfig()
 	config.StateDir = stateDir
+	config.Overrides = overrides
+	config.Selection = selection
+	config.Force = force
 
 	db := persist.NewDB(stateDir)
 
-	config.Executors[model.DefaultExecutorName] = &executor.LocalExec{JobDir: stateDir}
+	config.Executors[model.DefaultExecutorName] = &executor.LocalExec{JobDir: stateDir, Files: &dbFiles{db: db}}
 
 	err := parseFile(config, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	_, stats := runAndGetGraph(context.Background(), config, db)
-	return stats, nil
+	_, stats, err := runAndGetGraph(context.Background(), config, db, observer)
+	return stats, err
 }
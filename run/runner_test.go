@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
 
 	"github.com/pgm/goconseq/executor"
@@ -92,8 +93,49 @@ func TestExpandTemplates(t *testing.T) {
 	props := persist.NewArtifactProperties()
 	props.Strings["c"] = "d"
 	bindings.AddArtifact("b", &persist.Artifact{Properties: props})
-	s := expandTemplate("inputs.b.c = {{ inputs.b.c }}", bindings)
+	s := expandTemplate("inputs.b.c = {{ inputs.b.c }}", newTemplateContext(bindings, nil, nil))
 	assert.Equal(t, "inputs.b.c = d", s)
+
+	s = expandTemplate("{{ config.x }}/{{ inputs.b.c }}", newTemplateContext(bindings, map[string]string{"x": "y"}, nil))
+	assert.Equal(t, "y/d", s)
+}
+
+type recordingBuilder struct {
+	MockExecutionBuilder
+	files [][]byte
+}
+
+func (b *recordingBuilder) AddFile(body []byte) (string, error) {
+	b.files = append(b.files, body)
+	return fmt.Sprintf("conseqfiles/file%d", len(b.files)), nil
+}
+
+func TestExpandTemplatesWithAllBinding(t *testing.T) {
+	bindings := persist.NewBindings()
+	artifacts := make([]*persist.Artifact, 2)
+	for i := range artifacts {
+		props := persist.NewArtifactProperties()
+		props.Strings["name"] = fmt.Sprintf("n%d", i)
+		props.Strings["filename"] = fmt.Sprintf("f%d.txt", i)
+		artifacts[i] = &persist.Artifact{Properties: props}
+	}
+	bindings.AddArtifacts("samples", artifacts)
+
+	builder := &recordingBuilder{}
+	context := newTemplateContext(bindings, nil, builder)
+	s := expandTemplate("{% for x in inputs.samples %}{{ x.filename }} {% endfor %}", context)
+	assert.Equal(t, "f0.txt f1.txt ", s)
+
+	// the manifest is only written once even if referenced multiple times
+	s = expandTemplate("{{ manifest('samples', 'tsv') }} {{ manifest('samples', 'tsv') }}", context)
+	assert.Equal(t, "conseqfiles/file1 conseqfiles/file1", s)
+	assert.Equal(t, 1, len(builder.files))
+	assert.Equal(t, "filename\tname\nf0.txt\tn0\nf1.txt\tn1\n", string(builder.files[0]))
+
+	s = expandTemplate("{{ manifest('samples', 'json') }}", context)
+	assert.Equal(t, "conseqfiles/file2", s)
+	assert.Equal(t, 2, len(builder.files))
+	assert.Contains(t, string(builder.files[1]), `"name": "n1"`)
 }
 
 func TestSimpleSingleRuleRun(t *testing.T) {
@@ -175,7 +217,10 @@ func TestReplay(t *testing.T) {
 
 }
 func run(ctx context.Context, config *model.Config, db *persist.DB) *RunStats {
-	_, stats := runAndGetGraph(ctx, config, db)
+	_, stats, err := runAndGetGraph(ctx, config, db, nil)
+	if err != nil {
+		panic(err)
+	}
 	return stats
 }
 
@@ -290,6 +335,13 @@ func TestRuleWithAllQuery(t *testing.T) {
 	assert.Equal(t, 2, len(aOut))
 	bOut := db.FindArtifacts(map[string]string{"type": "b-out"})
 	assert.Equal(t, 1, len(bOut))
+
+	// b must wait for both a1 and a2 before it runs
+	for _, appliedRule := range db.FindAllAppliedRules() {
+		if appliedRule.Name == "b" {
+			assert.Equal(t, 2, len(appliedRule.Inputs.ByName["a"].GetArtifacts()))
+		}
+	}
 }
 
 func TestRunTwice(t *testing.T) {
@@ -530,3 +582,394 @@ func TestInputFileRef(t *testing.T) {
 
 	db.Close()
 }
+
+func TestAddIfMissingKeepsExistingArtifact(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	dataFile := path.Join(stateDir, "data.txt")
+	runWithStatement := func(statement string) *RunStats {
+		db, config := parseRules(stateDir, statement+` {'type': 'data', 'file': {'$filename': '`+dataFile+`'}}
+			rule b1:
+				inputs: a={'type': 'data'}
+				outputs: {'type': 'b-out'}`)
+		defer db.Close()
+		e := setupLocalExec(config, stateDir)
+		e.Files = &dbFiles{db: db}
+		return run(context.Background(), config, db)
+	}
+
+	writeFile(dataFile, "1")
+	stats := runWithStatement("add-if-missing")
+	assert.Equal(t, 2, stats.Executions)
+
+	// the file changed, but an artifact with the same properties already exists so nothing needs to run
+	writeFile(dataFile, "2")
+	stats = runWithStatement("add-if-missing")
+	assert.Equal(t, 0, stats.Executions)
+	assert.Equal(t, 2, stats.ExistingAppliedRules)
+	assert.True(t, stats.Obsolete.IsEmpty())
+
+	// whereas artifact statements always reflect the current contents of the file
+	stats = runWithStatement("artifact")
+	assert.Equal(t, 2, stats.Executions)
+	assert.Equal(t, 0, stats.ExistingAppliedRules)
+}
+
+func TestAddIfMissingOnlyMatchesArtifactRuleOutputs(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	// a rule produces an artifact with the same properties plus one more
+	db, config := parseRules(stateDir, `
+		rule make:
+			outputs: {'type': 'sample', 'name': 'x', 'extra': 'y'}`)
+	setupLocalExec(config, stateDir)
+	run(context.Background(), config, db)
+	db.Close()
+
+	// which add-if-missing must not adopt, as it wasn't created by an artifact statement
+	db, config = parseRules(stateDir, `
+		add-if-missing {'type': 'sample', 'name': 'x'}`)
+	defer db.Close()
+	setupLocalExec(config, stateDir)
+	stats := run(context.Background(), config, db)
+	assert.Equal(t, 1, stats.Executions)
+	samples := db.FindArtifacts(map[string]string{"type": "sample"})
+	assert.Equal(t, 1, len(samples))
+	assert.Equal(t, map[string]string{"type": "sample", "name": "x"}, samples[0].Properties.Strings)
+}
+
+func TestRemovedArtifactIsObsolete(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db, config := parseRules(stateDir, `
+		artifact {'type': 'a-out', 'value': '1'}
+		artifact {'type': 'a-out', 'value': '2'}
+		rule b1:
+			inputs: a={'type': 'a-out'}
+			outputs: {'type': 'b-out', 'value': '{{inputs.a.value}}'}`)
+	setupLocalExec(config, stateDir)
+	stats := run(context.Background(), config, db)
+	assert.Equal(t, 3, stats.Executions)
+	assert.True(t, stats.Obsolete.IsEmpty())
+	db.Close()
+
+	db, config = parseRules(stateDir, `
+		artifact {'type': 'a-out', 'value': '1'}
+		rule b1:
+			inputs: a={'type': 'a-out'}
+			outputs: {'type': 'b-out', 'value': '{{inputs.a.value}}'}`)
+	setupLocalExec(config, stateDir)
+	stats = run(context.Background(), config, db)
+	defer db.Close()
+
+	assert.Equal(t, 1, stats.Executions)
+	assert.Equal(t, 1, stats.ExistingAppliedRules)
+	assert.Equal(t, 1, len(stats.Obsolete.AppliedRules))
+	assert.Equal(t, "b1", stats.Obsolete.AppliedRules[0].Name)
+	assert.Equal(t, 2, len(stats.Obsolete.Artifacts))
+	for _, artifact := range stats.Obsolete.Artifacts {
+		assert.Equal(t, "2", artifact.Properties.Strings["value"])
+	}
+}
+
+func TestOutputTemplatesFromInputs(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	db, config := parseRules(stateDir, `
+		artifact {'type': 'sample', 'name': 'a'}
+		artifact {'type': 'sample', 'name': 'b'}
+		rule align:
+			inputs: s={'type': 'sample'}
+			outputs: {'type': 'aligned', 'sample': '{{inputs.s.name}}', 'bam': filename('{{inputs.s.name}}.bam')}
+			run "echo {{inputs.s.name}} > {{inputs.s.name}}.bam"
+		rule summarize_a:
+			inputs: bam={'type': 'aligned', 'sample': 'a'}
+			outputs: {'type': 'summary', 'of': '{{inputs.bam.sample}}'}
+	`)
+	defer db.Close()
+	e := setupLocalExec(config, stateDir)
+	e.Files = &dbFiles{db: db}
+
+	execGraph, stats, err := runAndGetGraph(context.Background(), config, db, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, stats.SuccessfulCompletions)
+
+	// the planner must know that align can produce the artifact summarize_a consumes
+	upstream := execGraph.Diagram().Neighborhood([]string{"rule_summarize_a"}, 2)
+	assert.NotNil(t, upstream.GetNode("rule_align"))
+
+	aligned := db.FindArtifacts(map[string]string{"type": "aligned", "sample": "b"})
+	assert.Equal(t, 1, len(aligned))
+	assert.Equal(t, "b.bam", path.Base(db.GetFile(aligned[0].Properties.Files["bam"]).LocalPath))
+
+	summary := db.FindArtifacts(map[string]string{"type": "summary"})
+	assert.Equal(t, 1, len(summary))
+	assert.Equal(t, "a", summary[0].Properties.Strings["of"])
+}
+
+func TestExpectedOutputs(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	aResults := path.Join(stateDir, "a.json")
+	writeFile(aResults, `{"outputs": [{"type": "a-out", "value": "1"}]}`)
+	bResults := path.Join(stateDir, "b.json")
+	writeFile(bResults, `{"outputs": [{"type": "b-out", "extra": "1"}]}`)
+
+	db, config := parseRules(stateDir, fmt.Sprintf(`
+		rule a:
+			outputs-expected: {'type': 'a-out', 'value'}
+			run "cp %s results.json"
+		rule b:
+			inputs: in={'type': 'a-out', 'value': '1'}
+			outputs-expected: {'type': 'b-out'}
+			run "cp %s results.json"
+		rule c:
+			inputs: in={'type': 'b-out'}
+			outputs: {'type': 'c-out'}
+	`, aResults, bResults))
+	defer db.Close()
+	setupLocalExec(config, stateDir)
+
+	stats := run(context.Background(), config, db)
+	// b's output has a property which wasn't declared, so it fails and c never runs
+	assert.Equal(t, 1, stats.SuccessfulCompletions)
+	assert.Equal(t, 1, stats.FailedCompletions)
+	assert.Equal(t, 1, len(db.FindArtifacts(map[string]string{"type": "a-out", "value": "1"})))
+	assert.Equal(t, 0, len(db.FindArtifacts(map[string]string{"type": "b-out"})))
+	// the failure is recorded in b's work dir so that gc can keep its logs
+	failures, err := filepath.Glob(path.Join(stateDir, "r*", persist.FailureFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(failures))
+}
+
+func TestCheckExpectedOutputs(t *testing.T) {
+	rule := &model.Rule{Name: "r", ExpectedOutputs: []*model.QueryTemplate{
+		{Properties: []*model.TemplateProperty{{Name: "type", Value: "x"}, {Name: "file", NoValue: true}}}}}
+
+	output := persist.NewArtifactProperties()
+	output.Strings["type"] = "x"
+	output.Files["file"] = 1
+	assert.Nil(t, checkExpectedOutputs(rule, []*persist.ArtifactProperties{output}))
+
+	output.Strings["type"] = "y"
+	assert.NotNil(t, checkExpectedOutputs(rule, []*persist.ArtifactProperties{output}))
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "check.conseq")
+	err = ioutil.WriteFile(filename, []byte(`
+add-if-missing {'type': 'sample'}
+add-if-missing {'type': 'unused'}
+rule a:
+  inputs: s={'type': 'sample'}
+  outputs: {'type': 'a-out', 'name': '{{inputs.x.name}}'}
+  run "echo {% if %}"
+rule b:
+  inputs: in={'type': 'never-made'}
+  outputs: {'type': 'b-out'}
+rule c:
+  inputs: in={'type': 'b-out'}
+rule d:
+  inputs: in={'type': 'e-out'}
+  outputs: {'type': 'd-out'}
+rule e:
+  inputs: in={'type': 'd-out'}
+  outputs: {'type': 'e-out'}
+`), 0644)
+	assert.Nil(t, err)
+
+	problems, err := CheckRulesInFile(filename, nil)
+	assert.Nil(t, err)
+
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Severity + " " + problem.Rule + ": " + problem.Message
+	}
+	assert.Contains(t, messages[0], "error a: invalid template in run statement:")
+	assert.Contains(t, messages, "error a: output property name references inputs.x but there is no input named x")
+	assert.Contains(t, messages, "error b: no rule or artifact produces anything matching the input {'type': 'never-made'}")
+	assert.Contains(t, messages, "error c: will never run because the rules it depends on will never run")
+	assert.Contains(t, messages, "error d: dependency cycle: d <- e <- d")
+	assert.Contains(t, messages, "warning "+ArtifactRuleName+": nothing uses the output {'type': 'unused'}")
+	assert.Contains(t, messages, "warning a: nothing uses the output {'name': *, 'type': 'a-out'}")
+	assert.Equal(t, 7, len(problems))
+}
+
+func TestDryRun(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	filename := path.Join(stateDir, "rules.conseq")
+	writeFile(filename, `
+		artifact {'type': 'a-out', 'value': '1'}
+		rule b:
+			inputs: a={'type': 'a-out'}
+			outputs: {'type': 'b-out', 'value': '{{inputs.a.value}}'}
+		rule c:
+			inputs: b={'type': 'b-out'}
+			outputs: {'type': 'c-out'}
+			run 'true'
+	`)
+
+	dryRun, err := DryRunRulesInFile(stateDir, filename, nil, model.RuleSelection{}, model.ForceRerun{})
+	assert.Nil(t, err)
+	// c's outputs can't be known without running it
+	assert.True(t, dryRun.Incomplete)
+	assert.Equal(t, 3, len(dryRun.Rules))
+	assert.Equal(t, ArtifactRuleName, dryRun.Rules[0].Name)
+	assert.Equal(t, 1, len(dryRun.Rules[0].New))
+	assert.Equal(t, "b", dryRun.Rules[1].Name)
+	assert.Equal(t, 1, len(dryRun.Rules[1].New))
+	// c's input is only known because b was simulated
+	assert.Equal(t, "c", dryRun.Rules[2].Name)
+	assert.Equal(t, 1, len(dryRun.Rules[2].New))
+	_, err = os.Stat(path.Join(stateDir, "db.journal"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = RunRulesInFile(stateDir, filename, nil, model.RuleSelection{}, model.ForceRerun{}, nil)
+	assert.Nil(t, err)
+
+	dryRun, err = DryRunRulesInFile(stateDir, filename, nil, model.RuleSelection{}, model.ForceRerun{})
+	assert.Nil(t, err)
+	for _, planned := range dryRun.Rules {
+		assert.Equal(t, 0, len(planned.New))
+		assert.Equal(t, 1, len(planned.Reused))
+		assert.Equal(t, 0, len(planned.Invalidated))
+	}
+	previousC := dryRun.Rules[2].Reused[0]
+
+	// after changing c, its previous application would be replaced by a new one for the same inputs
+	writeFile(filename, `
+		artifact {'type': 'a-out', 'value': '1'}
+		rule b:
+			inputs: a={'type': 'a-out'}
+			outputs: {'type': 'b-out', 'value': '{{inputs.a.value}}'}
+		rule c:
+			inputs: b={'type': 'b-out'}
+			outputs: {'type': 'c-out', 'version': '2'}
+			run 'true'
+	`)
+	dryRun, err = DryRunRulesInFile(stateDir, filename, nil, model.RuleSelection{}, model.ForceRerun{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(dryRun.Rules[1].Reused))
+	assert.Equal(t, 0, len(dryRun.Rules[1].Invalidated))
+	assert.Equal(t, 1, len(dryRun.Rules[2].New))
+	assert.Equal(t, 0, len(dryRun.Rules[2].Reused))
+	assert.Equal(t, []*persist.AppliedRule{previousC}, dryRun.Rules[2].Invalidated)
+}
+
+func TestRunSelectedRules(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	rules := `
+		rule a:
+			outputs: {'type': 'a-out'}
+		rule b:
+			inputs: a={'type': 'a-out'}
+			outputs: {'type': 'b-out'}
+		rule c:
+			inputs: b={'type': 'b-out'}
+			outputs: {'type': 'c-out'}
+		rule d:
+			inputs: a={'type': 'a-out'}
+			outputs: {'type': 'd-out'}`
+
+	runSelected := func(selection model.RuleSelection) *RunStats {
+		db, config := parseRules(stateDir, rules)
+		defer db.Close()
+		setupLocalExec(config, stateDir)
+		config.Selection = selection
+		return run(context.Background(), config, db)
+	}
+
+	stats := runSelected(model.RuleSelection{Targets: []string{"b"}})
+	assert.Equal(t, 2, stats.Executions)
+
+	stats = runSelected(model.RuleSelection{Until: []string{"c"}})
+	assert.Equal(t, 0, stats.Executions)
+	assert.Equal(t, 2, stats.ExistingAppliedRules)
+
+	stats = runSelected(model.RuleSelection{Exclude: []string{"b"}})
+	assert.Equal(t, 1, stats.Executions)
+	assert.Equal(t, 1, stats.ExistingAppliedRules)
+
+	// c is the only rule which hasn't run yet
+	stats = runSelected(model.RuleSelection{})
+	assert.Equal(t, 1, stats.Executions)
+	assert.Equal(t, 3, stats.ExistingAppliedRules)
+	assert.True(t, stats.Obsolete.IsEmpty())
+}
+
+func TestForceRerun(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	rules := `
+		artifact {'type': 'sample', 'name': 'x'}
+		artifact {'type': 'sample', 'name': 'y'}
+		rule align:
+			inputs: sample={'type': 'sample'}
+			outputs: {'type': 'bam', 'name': '{{inputs.sample.name}}'}
+		rule count:
+			inputs: bam={'type': 'bam'}
+			outputs: {'type': 'count', 'name': '{{inputs.bam.name}}'}`
+
+	runWithForce := func(force model.ForceRerun) *RunStats {
+		db, config := parseRules(stateDir, rules)
+		defer db.Close()
+		setupLocalExec(config, stateDir)
+		config.Force = force
+		return run(context.Background(), config, db)
+	}
+
+	stats := runWithForce(model.ForceRerun{})
+	assert.Equal(t, 5, stats.Executions)
+
+	// forcing align also reruns count, which consumed its outputs
+	stats = runWithForce(model.ForceRerun{Rules: []string{"align"}})
+	assert.Equal(t, 4, len(stats.Forced))
+	assert.Equal(t, 4, stats.Executions)
+	assert.Equal(t, 1, stats.ExistingAppliedRules)
+	assert.True(t, stats.Obsolete.IsEmpty())
+
+	stats = runWithForce(model.ForceRerun{Query: map[string]string{"type": "bam", "name": "y"}})
+	assert.Equal(t, 2, len(stats.Forced))
+	assert.Equal(t, 2, stats.Executions)
+	assert.Equal(t, 3, stats.ExistingAppliedRules)
+
+	stats = runWithForce(model.ForceRerun{})
+	assert.Equal(t, 0, len(stats.Forced))
+	assert.Equal(t, 0, stats.Executions)
+
+	// forcing a rule which isn't selected leaves its applications in the history
+	db, config := parseRules(stateDir, rules)
+	setupLocalExec(config, stateDir)
+	config.Selection = model.RuleSelection{Exclude: []string{"align"}}
+	config.Force = model.ForceRerun{Rules: []string{"align"}}
+	stats = run(context.Background(), config, db)
+	db.Close()
+	assert.Equal(t, 0, len(stats.Forced))
+	assert.Equal(t, 0, stats.Executions)
+
+	stats = runWithForce(model.ForceRerun{})
+	assert.Equal(t, 0, stats.Executions)
+	assert.Equal(t, 5, stats.ExistingAppliedRules)
+}
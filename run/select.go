@@ -0,0 +1,75 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/model"
+)
+
+// checkRuleNames returns an error if the selection or the rules to force name a rule which isn't defined
+func checkRuleNames(config *model.Config) error {
+	selection := config.Selection
+	for _, names := range [][]string{selection.Targets, selection.Until, selection.Exclude, config.Force.Rules} {
+		for _, name := range names {
+			if _, ok := config.Rules[name]; !ok {
+				return fmt.Errorf("Unknown rule %s: no rule with that name is defined", name)
+			}
+		}
+	}
+	return nil
+}
+
+// selectedRuleNames returns the names of the rules which the selection in the config allows to run, including the
+// artifact rule once it's added. Returns nil if nothing was selected, meaning every rule runs.
+func selectedRuleNames(config *model.Config) map[string]bool {
+	if config.Selection.IsEmpty() {
+		return nil
+	}
+
+	// the artifact rule is only needed to find what depends on it, so nothing is reused from the history
+	withArtifacts := *config
+	withArtifacts.Rules = make(map[string]*model.Rule, len(config.Rules)+1)
+	for name, rule := range config.Rules {
+		withArtifacts.Rules[name] = rule
+	}
+	if len(config.Artifacts) > 0 || len(config.AddIfMissing) > 0 {
+		AddArtifactRule(&withArtifacts, nil)
+	}
+
+	names := make(map[string]bool)
+	for name := range selectRules(&withArtifacts, RulesToGraph(withArtifacts.Rules)) {
+		names[name] = true
+	}
+	return names
+}
+
+// selectRules returns the rules which the selection in the config allows to run, given the graph of all rules
+func selectRules(config *model.Config, execGraph *graph.Graph) map[string]*model.Rule {
+	selection := config.Selection
+
+	selected := make(map[string]bool)
+	if len(selection.Targets) == 0 && len(selection.Until) == 0 {
+		for name := range config.Rules {
+			selected[name] = true
+		}
+	}
+	for _, name := range execGraph.Upstream(selection.Targets) {
+		selected[name] = true
+	}
+	for _, name := range execGraph.Upstream(selection.Until) {
+		selected[name] = true
+	}
+	for _, name := range selection.Until {
+		delete(selected, name)
+	}
+	for _, name := range execGraph.Downstream(selection.Exclude) {
+		delete(selected, name)
+	}
+
+	rules := make(map[string]*model.Rule)
+	for name := range selected {
+		rules[name] = config.Rules[name]
+	}
+	return rules
+}
@@ -0,0 +1,140 @@
+package serve
+
+// page is the status page served at /. It only uses the API, which it polls while a run is in progress.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>conseq</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 2px 10px 2px 0; vertical-align: top; }
+pre { background: #f4f4f4; padding: 0.5em; max-height: 30em; overflow: auto; }
+.failed { color: #b00; }
+a { cursor: pointer; color: #00e; text-decoration: underline; }
+</style>
+</head>
+<body>
+<h1>conseq</h1>
+<p id="summary"></p>
+
+<h2>Rules</h2>
+<table id="rules"><thead><tr><th>rule</th><th>pending</th><th>running</th><th>done</th><th>failed</th><th>skipped</th></tr></thead><tbody></tbody></table>
+
+<h2>Running</h2>
+<table id="running"><thead><tr><th>id</th><th>rule</th><th>work dir</th><th>status</th><th>started</th></tr></thead><tbody></tbody></table>
+
+<h2>Failed</h2>
+<table id="failed"><thead><tr><th>id</th><th>rule</th><th>work dir</th><th>message</th></tr></thead><tbody></tbody></table>
+
+<h2>Artifacts</h2>
+<form id="filter-form">
+<input id="filters" size="60" placeholder="filters separated by spaces, such as type=sample name~^a">
+<button type="submit">List</button>
+</form>
+<p id="artifacts-error" class="failed"></p>
+<table id="artifacts"><thead></thead><tbody></tbody></table>
+
+<h2 id="log-title"></h2>
+<pre id="log" hidden></pre>
+
+<script>
+function cell(row, value) {
+  var td = document.createElement("td");
+  td.textContent = value === undefined || value === null ? "" : value;
+  row.appendChild(td);
+  return td;
+}
+
+function fill(id, items, columns) {
+  var body = document.querySelector("#" + id + " tbody");
+  body.innerHTML = "";
+  items.forEach(function(item) {
+    var row = document.createElement("tr");
+    columns.forEach(function(column) { column(row, item); });
+    body.appendChild(row);
+  });
+}
+
+function field(name) {
+  return function(row, item) { cell(row, item[name]); };
+}
+
+function logLinks(row, item) {
+  var td = cell(row, "r" + item.id + " ");
+  ["stdout", "stderr"].forEach(function(name) {
+    var a = document.createElement("a");
+    a.textContent = name;
+    a.onclick = function() { showLog(item.id, name); };
+    td.appendChild(a);
+    td.appendChild(document.createTextNode(" "));
+  });
+}
+
+function showLog(id, name) {
+  fetch("api/logs?id=" + id + "&name=" + name).then(function(r) { return r.json(); }).then(function(log) {
+    document.getElementById("log-title").textContent = log.error ? log.error : name + " of r" + id + " (" + log.path + ")";
+    var pre = document.getElementById("log");
+    pre.textContent = log.error ? "" : log.text;
+    pre.hidden = !!log.error;
+  });
+}
+
+function refreshStatus() {
+  fetch("api/status").then(function(r) { return r.json(); }).then(function(status) {
+    var summary = status.active ? "Running since " + status.started :
+      status.finished ? "Finished at " + status.finished : "Nothing is running";
+    document.getElementById("summary").textContent = summary;
+    fill("rules", status.rules, [field("name"), function(row, item) { cell(row, item.pending ? "yes" : ""); },
+      field("running"), field("done"), field("failed"), field("skipped")]);
+    fill("running", status.running, [logLinks, field("rule"), field("work_dir"), field("status"), field("started")]);
+    fill("failed", status.failed, [logLinks, field("rule"), field("work_dir"), field("message")]);
+    if (status.active) {
+      setTimeout(refreshStatus, 2000);
+    }
+  });
+}
+
+function listArtifacts() {
+  var params = document.getElementById("filters").value.split(/\s+/).filter(function(f) { return f !== ""; })
+    .map(function(f) { return "filter=" + encodeURIComponent(f); }).join("&");
+  fetch("api/artifacts?" + params).then(function(r) { return r.json(); }).then(function(artifacts) {
+    document.getElementById("artifacts-error").textContent = artifacts.error || "";
+    if (artifacts.error) {
+      artifacts = [];
+    }
+    var names = [];
+    artifacts.forEach(function(artifact) {
+      Object.keys(artifact.properties).forEach(function(name) {
+        if (names.indexOf(name) < 0) {
+          names.push(name);
+        }
+      });
+    });
+    names.sort();
+    var head = document.querySelector("#artifacts thead");
+    head.innerHTML = "";
+    var row = document.createElement("tr");
+    ["id"].concat(names).forEach(function(name) {
+      var th = document.createElement("th");
+      th.textContent = name;
+      row.appendChild(th);
+    });
+    head.appendChild(row);
+    fill("artifacts", artifacts, [field("id")].concat(names.map(function(name) {
+      return function(row, item) { cell(row, item.properties[name]); };
+    })));
+  });
+}
+
+document.getElementById("filter-form").onsubmit = function(e) {
+  e.preventDefault();
+  listArtifacts();
+};
+refreshStatus();
+listArtifacts();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,230 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/pgm/goconseq/graph"
+	"github.com/pgm/goconseq/persist"
+	"github.com/pgm/goconseq/run"
+)
+
+// the number of lines of a log returned when the request doesn't say
+const defaultLogLines = 100
+
+// the logs which can be read, by name, and the file each is written to in the work dir
+var logFiles = map[string]string{"stdout": "stdout.txt", "stderr": "stderr.txt"}
+
+// Artifact is an artifact as returned by the API. Files are given as their local paths.
+type Artifact struct {
+	ID         int               `json:"id"`
+	Properties map[string]string `json:"properties"`
+}
+
+// Application is a rule application recorded in the DB
+type Application struct {
+	ID      int                    `json:"id"`
+	Rule    string                 `json:"rule"`
+	WorkDir string                 `json:"work_dir"`
+	Inputs  map[string]interface{} `json:"inputs"`
+	Outputs []*Artifact            `json:"outputs"`
+}
+
+// Log is the tail of one of the logs of an application
+type Log struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Text string `json:"text"`
+}
+
+// Server answers read-only requests about the DB in a state directory and, if it was given the state of a run,
+// about the progress of that run
+type Server struct {
+	stateDir  string
+	filename  string
+	overrides map[string]string
+	// nil unless the server was started alongside a run
+	state *RunState
+}
+
+// NewServer creates a server for the rules in filename. If state is nil, the status reports that nothing is running.
+func NewServer(stateDir string, filename string, overrides map[string]string, state *RunState) *Server {
+	return &Server{stateDir: stateDir, filename: filename, overrides: overrides, state: state}
+}
+
+// Handler returns the handler for the page and the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handlePage)
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.HandleFunc("/api/artifacts", s.handleArtifacts)
+	mux.HandleFunc("/api/applications", s.handleApplications)
+	mux.HandleFunc("/api/logs", s.handleLogs)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Could not write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (s *Server) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, page)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if s.state == nil {
+		writeJSON(w, &Status{Rules: []*RuleCounts{}, Running: []*RunningApplication{}, Failed: []*FailedApplication{}})
+		return
+	}
+	writeJSON(w, s.state.Status())
+}
+
+// replay reads the DB the same way ls does. The DB must be closed by the caller.
+func (s *Server) replay() (*persist.DB, error) {
+	if _, err := os.Stat(path.Join(s.stateDir, "db.journal")); err != nil {
+		return nil, fmt.Errorf("No DB in %s: nothing has been run yet", s.stateDir)
+	}
+	_, db, err := run.ReplayAndExport(s.stateDir, s.filename, s.overrides)
+	return db, err
+}
+
+func toArtifact(db *persist.DB, artifact *persist.Artifact) *Artifact {
+	return &Artifact{ID: artifact.GetID(),
+		Properties: artifact.Properties.ToStrMap(func(fileID int) string {
+			return db.GetFile(fileID).LocalPath
+		})}
+}
+
+func toArtifacts(db *persist.DB, artifacts []*persist.Artifact) []*Artifact {
+	result := make([]*Artifact, len(artifacts))
+	for i, artifact := range artifacts {
+		result[i] = toArtifact(db, artifact)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// toInputs maps each input to an artifact, to a list of artifacts for inputs bound with all, or to null for
+// optional inputs which nothing matched
+func toInputs(db *persist.DB, bindings *persist.Bindings) map[string]interface{} {
+	inputs := make(map[string]interface{})
+	for name, value := range bindings.ByName {
+		if single, ok := value.(*persist.SingleArtifact); ok {
+			if single.IsNull() {
+				inputs[name] = nil
+			} else {
+				inputs[name] = toArtifact(db, single.GetArtifacts()[0])
+			}
+		} else {
+			inputs[name] = toArtifacts(db, value.GetArtifacts())
+		}
+	}
+	return inputs
+}
+
+// handleArtifacts lists the artifacts matching all of the filter parameters, which take the same form as the
+// filters of ls
+func (s *Server) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	query, predicates, err := graph.ParseFilters(r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	db, err := s.replay()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer db.Close()
+
+	writeJSON(w, toArtifacts(db, db.FindArtifactsMatching(query, predicates)))
+}
+
+// handleApplications lists the recorded applications, optionally only those of the rule parameter
+func (s *Server) handleApplications(w http.ResponseWriter, r *http.Request) {
+	rule := r.URL.Query().Get("rule")
+	db, err := s.replay()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer db.Close()
+
+	applications := make([]*Application, 0)
+	for _, appliedRule := range db.FindAllAppliedRules() {
+		if rule != "" && appliedRule.Name != rule {
+			continue
+		}
+		applications = append(applications, &Application{ID: appliedRule.ID,
+			Rule:    appliedRule.Name,
+			WorkDir: db.GetWorkDir(appliedRule.ID),
+			Inputs:  toInputs(db, appliedRule.Inputs),
+			Outputs: toArtifacts(db, appliedRule.Outputs)})
+	}
+	sort.Slice(applications, func(i, j int) bool {
+		return applications[i].ID < applications[j].ID
+	})
+	writeJSON(w, applications)
+}
+
+// handleLogs returns the last lines of the stdout or stderr of an application, which may still be running
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	id, err := strconv.Atoi(params.Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid application id \"%s\"", params.Get("id")))
+		return
+	}
+	name := params.Get("name")
+	if name == "" {
+		name = "stdout"
+	}
+	logFile, ok := logFiles[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unknown log \"%s\": must be stdout or stderr", name))
+		return
+	}
+	lines := defaultLogLines
+	if params.Get("lines") != "" {
+		lines, err = strconv.Atoi(params.Get("lines"))
+		if err != nil || lines <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid number of lines \"%s\"", params.Get("lines")))
+			return
+		}
+	}
+
+	logPath := path.Join(persist.WorkDir(s.stateDir, id), logFile)
+	text, err := run.ReadTail(logPath, lines)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No %s log for r%d", name, id))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, &Log{ID: id, Name: name, Path: logPath, Text: text})
+}
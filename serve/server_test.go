@@ -0,0 +1,84 @@
+package serve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/run"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, handler http.Handler, url string, expectedStatus int, value interface{}) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+	assert.Equal(t, expectedStatus, recorder.Code, url)
+	if value != nil {
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), value), url)
+	}
+}
+
+func TestServer(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", t.Name())
+	assert.Nil(t, err)
+	defer os.RemoveAll(stateDir)
+
+	filename := path.Join(stateDir, "rules.conseq")
+	assert.Nil(t, ioutil.WriteFile(filename, []byte(`
+		artifact {'type': 'sample', 'name': 'x'}
+		artifact {'type': 'sample', 'name': 'y'}
+		rule count:
+			inputs: sample={'type': 'sample'}
+			outputs: {'type': 'count', 'name': '{{inputs.sample.name}}'}
+			run 'echo counted {{inputs.sample.name}}'
+	`), 0644))
+
+	state := NewRunState()
+	handler := NewServer(stateDir, filename, nil, state).Handler()
+
+	// nothing has been run yet
+	get(t, handler, "/api/artifacts", http.StatusInternalServerError, nil)
+
+	_, err = run.RunRulesInFile(stateDir, filename, nil, model.RuleSelection{}, model.ForceRerun{}, state)
+	assert.Nil(t, err)
+
+	var status Status
+	get(t, handler, "/api/status", http.StatusOK, &status)
+	assert.False(t, status.Active)
+	assert.NotNil(t, status.Finished)
+	assert.Equal(t, 2, len(status.Rules))
+	assert.Equal(t, "count", status.Rules[1].Name)
+	assert.Equal(t, 2, status.Rules[1].Done)
+	assert.Equal(t, 0, status.Rules[1].Running)
+	assert.Equal(t, 0, len(status.Running))
+
+	var artifacts []*Artifact
+	get(t, handler, "/api/artifacts?filter=type=count", http.StatusOK, &artifacts)
+	assert.Equal(t, 2, len(artifacts))
+	get(t, handler, "/api/artifacts?filter=type=count&filter=name~^y", http.StatusOK, &artifacts)
+	assert.Equal(t, 1, len(artifacts))
+	assert.Equal(t, "y", artifacts[0].Properties["name"])
+	get(t, handler, "/api/artifacts?filter=type", http.StatusBadRequest, nil)
+
+	var applications []*Application
+	get(t, handler, "/api/applications?rule=count", http.StatusOK, &applications)
+	assert.Equal(t, 2, len(applications))
+	assert.Equal(t, 1, len(applications[0].Outputs))
+
+	var log Log
+	get(t, handler, "/api/logs?id="+strconv.Itoa(applications[0].ID)+"&name=stdout", http.StatusOK, &log)
+	assert.Contains(t, log.Text, "counted")
+	get(t, handler, "/api/logs?id="+strconv.Itoa(applications[0].ID)+"&name=journal", http.StatusBadRequest, nil)
+	get(t, handler, "/api/logs?id=1000", http.StatusNotFound, nil)
+
+	// a server without a run reports that nothing is running
+	get(t, NewServer(stateDir, filename, nil, nil).Handler(), "/api/status", http.StatusOK, &status)
+	assert.False(t, status.Active)
+	assert.Equal(t, 0, len(status.Rules))
+}
@@ -0,0 +1,198 @@
+package serve
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pgm/goconseq/model"
+	"github.com/pgm/goconseq/persist"
+	"github.com/pgm/goconseq/run"
+)
+
+// RuleCounts is the number of applications of a rule in each state
+type RuleCounts struct {
+	Name string `json:"name"`
+	// true until the rule is first evaluated
+	Pending bool `json:"pending"`
+	Running int  `json:"running"`
+	Done    int  `json:"done"`
+	Failed  int  `json:"failed"`
+	Skipped int  `json:"skipped"`
+}
+
+// RunningApplication is an application which has been started but hasn't completed or failed yet
+type RunningApplication struct {
+	ID      int       `json:"id"`
+	Rule    string    `json:"rule"`
+	WorkDir string    `json:"work_dir"`
+	Status  string    `json:"status"`
+	Started time.Time `json:"started"`
+}
+
+// FailedApplication is an application which failed during the run
+type FailedApplication struct {
+	ID      int    `json:"id"`
+	Rule    string `json:"rule"`
+	WorkDir string `json:"work_dir"`
+	Message string `json:"message"`
+}
+
+// Status is a snapshot of the state of a run
+type Status struct {
+	// true while the run is in progress
+	Active   bool                  `json:"active"`
+	Started  *time.Time            `json:"started,omitempty"`
+	Finished *time.Time            `json:"finished,omitempty"`
+	Rules    []*RuleCounts         `json:"rules"`
+	Running  []*RunningApplication `json:"running"`
+	Failed   []*FailedApplication  `json:"failed"`
+}
+
+// RunState is an Observer which keeps track of the state of a run so that it can be reported by the server while
+// the run is in progress
+type RunState struct {
+	mutex    sync.Mutex
+	now      func() time.Time
+	started  time.Time
+	finished time.Time
+	active   bool
+	rules    map[string]*RuleCounts
+	running  map[int]*RunningApplication
+	failed   []*FailedApplication
+}
+
+func NewRunState() *RunState {
+	return &RunState{now: time.Now,
+		rules:   make(map[string]*RuleCounts),
+		running: make(map[int]*RunningApplication)}
+}
+
+func (s *RunState) rule(name string) *RuleCounts {
+	r, ok := s.rules[name]
+	if !ok {
+		r = &RuleCounts{Name: name}
+		s.rules[name] = r
+	}
+	return r
+}
+
+// Status returns a copy of the current state
+func (s *RunState) Status() *Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := &Status{Active: s.active,
+		Rules:   make([]*RuleCounts, 0, len(s.rules)),
+		Running: make([]*RunningApplication, 0, len(s.running)),
+		Failed:  make([]*FailedApplication, len(s.failed))}
+	if !s.started.IsZero() {
+		started := s.started
+		status.Started = &started
+	}
+	if !s.finished.IsZero() {
+		finished := s.finished
+		status.Finished = &finished
+	}
+	for _, r := range s.rules {
+		copied := *r
+		status.Rules = append(status.Rules, &copied)
+	}
+	sort.Slice(status.Rules, func(i, j int) bool {
+		return status.Rules[i].Name < status.Rules[j].Name
+	})
+	for _, app := range s.running {
+		copied := *app
+		status.Running = append(status.Running, &copied)
+	}
+	sort.Slice(status.Running, func(i, j int) bool {
+		return status.Running[i].ID < status.Running[j].ID
+	})
+	copy(status.Failed, s.failed)
+	return status
+}
+
+func (s *RunState) RunStarted(db *persist.DB, ruleNames []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.started = s.now()
+	s.active = true
+	for _, name := range ruleNames {
+		s.rule(name).Pending = true
+	}
+}
+
+func (s *RunState) RuleEvaluated(name string, applications int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rule(name).Pending = false
+}
+
+func (s *RunState) Reused(appliedRule *persist.AppliedRule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rule(appliedRule.Name).Skipped++
+}
+
+func (s *RunState) Started(appliedRule *persist.AppliedRule, workDir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rule(appliedRule.Name).Running++
+	s.running[appliedRule.ID] = &RunningApplication{ID: appliedRule.ID,
+		Rule:    appliedRule.Name,
+		WorkDir: workDir,
+		Started: s.now()}
+}
+
+func (s *RunState) StatusUpdated(appliedRuleID int, status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if app, ok := s.running[appliedRuleID]; ok {
+		app.Status = status
+	}
+}
+
+// finishedApp stops tracking a running application
+func (s *RunState) finishedApp(appliedRule *persist.AppliedRule) {
+	if _, ok := s.running[appliedRule.ID]; ok {
+		delete(s.running, appliedRule.ID)
+		s.rule(appliedRule.Name).Running--
+	}
+}
+
+func (s *RunState) Completed(appliedRule *persist.AppliedRule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.finishedApp(appliedRule)
+	s.rule(appliedRule.Name).Done++
+}
+
+func (s *RunState) Failed(appliedRule *persist.AppliedRule, message string, logs []*model.NameValuePair) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	workDir := ""
+	if app, ok := s.running[appliedRule.ID]; ok {
+		workDir = app.WorkDir
+	}
+	s.finishedApp(appliedRule)
+	s.rule(appliedRule.Name).Failed++
+	s.failed = append(s.failed, &FailedApplication{ID: appliedRule.ID,
+		Rule:    appliedRule.Name,
+		WorkDir: workDir,
+		Message: message})
+}
+
+func (s *RunState) RunCompleted(stats *run.RunStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active = false
+	s.finished = s.now()
+}